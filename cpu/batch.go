@@ -0,0 +1,115 @@
+package cpu
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Job is a program to run by RunBatch, with its input
+type Job struct {
+	// Program is the object code, as returned by ReadObjectFile
+	Program []byte
+	Input   []byte
+	// NoEOFChariStop is set on the CPU running the program
+	NoEOFChariStop bool
+	// Encoding is the encoding of the output
+	Encoding Encoding
+	// MaxSteps limits the instructions executed, 0 for no limit
+	MaxSteps uint64
+	// Timeout limits the time the program runs, 0 for no limit
+	Timeout time.Duration
+	// Trace keeps the trace of the program in the result, the program is
+	// then run by Run
+	Trace bool
+}
+
+// Result is the outcome of a Job
+type Result struct {
+	Output []byte
+	// Trace is the text trace of the program when the job asked for it,
+	// followed by the fault if any, as qdpep8cli -t prints them
+	Trace []byte
+	// Fault is the error that stopped the program, if any
+	Fault error
+	// Steps is the number of instructions executed
+	Steps uint64
+	// Duration is the time the program ran
+	Duration time.Duration
+}
+
+// RunBatch runs the jobs on a pool of workers, each with its own CPU, and
+// returns their results in the order of the jobs
+//
+// workers is the number of programs run at the same time, the number of
+// CPUs of the machine if it is not positive. Programs are run by RunFast.
+func RunBatch(jobs []Job, workers int) []Result {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	results := make([]Result, len(jobs))
+	todo := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for k := 0; k < workers; k++ {
+		go func() {
+			defer wg.Done()
+			cpu := NewPep8Cpu()
+			for idx := range todo {
+				results[idx] = cpu.runJob(jobs[idx])
+			}
+		}()
+	}
+	for idx := range jobs {
+		todo <- idx
+	}
+	close(todo)
+	wg.Wait()
+	return results
+}
+
+// RunJob runs a job on a new CPU
+func RunJob(job Job) Result {
+	return NewPep8Cpu().runJob(job)
+}
+
+// runJob runs a job from a clean state, the CPU is reused between the jobs
+// of a worker
+func (cpu *Pep8CPU) runJob(job Job) Result {
+	for idx := range cpu.RAM {
+		cpu.RAM[idx] = 0
+	}
+	cpu.A, cpu.X = 0, 0
+	cpu.N, cpu.Z, cpu.V, cpu.C = false, false, false, false
+	cpu.Load(job.Program)
+
+	out := &bytes.Buffer{}
+	cpu.In = bytes.NewReader(job.Input)
+	cpu.Out = out
+	cpu.NoEOFChariStop = job.NoEOFChariStop
+	cpu.Encoding = job.Encoding
+	cpu.MaxSteps = job.MaxSteps
+	start := time.Now()
+	cpu.Deadline = time.Time{}
+	if job.Timeout > 0 {
+		cpu.Deadline = start.Add(job.Timeout)
+	}
+	cpu.Trace = job.Trace
+	trace := &bytes.Buffer{}
+	cpu.TraceOut = trace
+	err := cpu.RunFast()
+	res := Result{Output: out.Bytes(), Fault: err, Steps: cpu.Steps, Duration: time.Since(start)}
+	if job.Trace {
+		if err != nil {
+			fmt.Fprintf(trace, "%s\n", err)
+		}
+		res.Trace = trace.Bytes()
+	}
+	return res
+}
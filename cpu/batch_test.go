@@ -0,0 +1,158 @@
+package cpu
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// suiteJobs returns a job for every run of the test suite
+func suiteJobs(t *testing.T) (names []string, jobs []Job) {
+	for _, sc := range suiteCases(t) {
+		job, err := sc.Job()
+		if err != nil {
+			t.Fatal(err)
+		}
+		job.Trace = false
+		names = append(names, sc.Name)
+		jobs = append(jobs, job)
+	}
+	return names, jobs
+}
+
+// runAlone runs a job on a fresh CPU, with Run
+func runAlone(job Job) Result {
+	cpu := NewPep8Cpu()
+	cpu.Load(job.Program)
+	out := &bytes.Buffer{}
+	cpu.In = bytes.NewReader(job.Input)
+	cpu.Out = out
+	cpu.NoEOFChariStop = job.NoEOFChariStop
+	err := cpu.Run()
+	return Result{Output: out.Bytes(), Fault: err, Steps: cpu.Steps}
+}
+
+func sameResult(got, want Result) error {
+	if fmt.Sprint(got.Fault) != fmt.Sprint(want.Fault) {
+		return fmt.Errorf("fault %v, want %v", got.Fault, want.Fault)
+	}
+	if got.Steps != want.Steps {
+		return fmt.Errorf("%d steps, want %d", got.Steps, want.Steps)
+	}
+	if !bytes.Equal(got.Output, want.Output) {
+		return fmt.Errorf("output %q, want %q", got.Output, want.Output)
+	}
+	return nil
+}
+
+func TestRunBatch(t *testing.T) {
+	names, jobs := suiteJobs(t)
+	want := make([]Result, len(jobs))
+	for idx, job := range jobs {
+		want[idx] = runAlone(job)
+	}
+
+	// Every job several times, for the workers to reuse their CPU after
+	// programs of all kinds
+	const repeat = 4
+	batch := []Job{}
+	for k := 0; k < repeat; k++ {
+		batch = append(batch, jobs...)
+	}
+	for _, workers := range []int{1, 4, 0} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			results := RunBatch(batch, workers)
+			if len(results) != len(batch) {
+				t.Fatalf("%d results for %d jobs", len(results), len(batch))
+			}
+			for idx, res := range results {
+				if err := sameResult(res, want[idx%len(jobs)]); err != nil {
+					t.Errorf("%s: %s", names[idx%len(jobs)], err)
+				}
+			}
+		})
+	}
+}
+
+func TestRunBatchEmpty(t *testing.T) {
+	if results := RunBatch(nil, 4); len(results) != 0 {
+		t.Errorf("%d results for no job", len(results))
+	}
+}
+
+// TestConcurrentRun runs CPUs side by side with the interpreter, traced and
+// observed, for the race detector to check they share nothing
+func TestConcurrentRun(t *testing.T) {
+	names, jobs := suiteJobs(t)
+	wg := sync.WaitGroup{}
+	for idx, job := range jobs {
+		wg.Add(1)
+		go func(name string, job Job) {
+			defer wg.Done()
+			want := runAlone(job)
+
+			cpu := NewPep8Cpu()
+			cpu.Load(job.Program)
+			out := &bytes.Buffer{}
+			cpu.In = bytes.NewReader(job.Input)
+			cpu.Out = out
+			cpu.Trace = true
+			cpu.TraceOut = &bytes.Buffer{}
+			cpu.Observers = []Observer{NewCoverage()}
+			err := cpu.Run()
+			got := Result{Output: out.Bytes(), Fault: err, Steps: cpu.Steps}
+			if err := sameResult(got, want); err != nil {
+				t.Errorf("%s: %s", name, err)
+			}
+		}(names[idx], job)
+	}
+	wg.Wait()
+}
+
+// spinProgram loops forever
+var spinProgram = []byte{
+	0x04, 0x00, 0x00, // loop: BR loop,i
+}
+
+func TestLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		job   Job
+		fault error
+	}{
+		{"steps", Job{Program: loopProgram, MaxSteps: 1000}, ErrStepLimit},
+		{"steps-spin", Job{Program: spinProgram, MaxSteps: 12345}, ErrStepLimit},
+		{"time", Job{Program: spinProgram, Timeout: 20 * time.Millisecond}, ErrTimeLimit},
+		{"within", Job{Program: patchOperandProgram, MaxSteps: 1000, Timeout: time.Minute}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res := RunBatch([]Job{tc.job}, 1)[0]
+			if res.Fault != tc.fault {
+				t.Fatalf("fault %v, want %v", res.Fault, tc.fault)
+			}
+			if tc.fault == ErrStepLimit && res.Steps != tc.job.MaxSteps {
+				t.Errorf("%d steps, want %d", res.Steps, tc.job.MaxSteps)
+			}
+			if tc.job.Timeout == 0 {
+				// The interpreter stops on the same instruction
+				cpu := NewPep8Cpu()
+				cpu.Load(tc.job.Program)
+				cpu.Out = &bytes.Buffer{}
+				cpu.MaxSteps = tc.job.MaxSteps
+				if err := cpu.Run(); err != tc.fault || cpu.Steps != res.Steps {
+					t.Errorf("Run: fault %v after %d steps, RunFast: fault %v after %d steps", err, cpu.Steps, res.Fault, res.Steps)
+				}
+			}
+		})
+	}
+
+	// Run checks the deadline too
+	cpu := NewPep8Cpu()
+	cpu.Load(spinProgram)
+	cpu.Deadline = time.Now().Add(20 * time.Millisecond)
+	if err := cpu.Run(); err != ErrTimeLimit {
+		t.Errorf("Run: fault %v, want %v", err, ErrTimeLimit)
+	}
+}
@@ -0,0 +1,418 @@
+package cpu
+
+// maxBlockLen is the most instructions translated in a block
+const maxBlockLen = 64
+
+// step executes one translated instruction, it returns false when the
+// program stopped, normally or on a fault
+type step func(cpu *Pep8CPU) bool
+
+// block is a straight run of instructions, ending with the first one that
+// may jump, translated to closures
+type block struct {
+	// gen is the generation of the cache the block was translated in, or
+	// last found unchanged in, the block is stale if it is not the current
+	// one
+	gen   uint32
+	start uint16
+	// code is a copy of the bytes the block was translated from
+	code  []byte
+	steps []step
+}
+
+// blockCache caches the blocks translated by RunFast, keyed by their start
+// address
+//
+// A write to the bytes of a cached block makes the whole cache stale,
+// including the block being executed, which stops after the writing
+// instruction. A stale block whose bytes are unchanged is current again
+// when it is next run, only the blocks written over are translated again.
+// This keeps the blocks of a program from one run to the next too.
+type blockCache struct {
+	gen    uint32
+	blocks []*block
+	// code is the generation of the last current block that covered each
+	// byte of memory, a byte is cached code if it is the current one
+	code []uint32
+}
+
+func newBlockCache(size int) *blockCache {
+	return &blockCache{
+		gen:    1,
+		blocks: make([]*block, size),
+		code:   make([]uint32, size),
+	}
+}
+
+// flush makes all the blocks stale
+func (bc *blockCache) flush() {
+	bc.gen++
+	if bc.gen == 0 {
+		// The generations wrapped, older blocks could look current
+		for idx := range bc.blocks {
+			bc.blocks[idx] = nil
+			bc.code[idx] = 0
+		}
+		bc.gen = 1
+	}
+}
+
+// written is called when size bytes are written at addr
+func (bc *blockCache) written(addr uint16, size int) {
+	for k := 0; k < size; k++ {
+		if bc.code[addr+uint16(k)] == bc.gen {
+			bc.flush()
+			return
+		}
+	}
+}
+
+// cover makes blk current, and marks its bytes as cached code
+func (bc *blockCache) cover(blk *block) {
+	blk.gen = bc.gen
+	for k := range blk.code {
+		bc.code[blk.start+uint16(k)] = bc.gen
+	}
+}
+
+// block returns the block starting at addr, translated from the memory if
+// it is not cached or was written over
+func (bc *blockCache) block(cpu *Pep8CPU, addr uint16) *block {
+	if blk := bc.blocks[addr]; blk != nil && blk.gen == bc.gen {
+		return blk
+	}
+	return bc.load(cpu, addr)
+}
+
+// load returns the stale block starting at addr if its bytes are unchanged,
+// or translates a new one
+func (bc *blockCache) load(cpu *Pep8CPU, addr uint16) *block {
+	if blk := bc.blocks[addr]; blk != nil && blk.unchanged(cpu) {
+		bc.cover(blk)
+		return blk
+	}
+
+	blk := &block{start: addr}
+	for len(blk.steps) < maxBlockLen {
+		op := &decodeTable[cpu.RAM[addr]]
+		for k := uint16(0); k < op.length; k++ {
+			blk.code = append(blk.code, cpu.RAM[addr+k])
+		}
+		blk.steps = append(blk.steps, translate(cpu, addr))
+
+		next := addr + op.length
+		if op.jumps || op.exec == nil || op.modeErr != nil || next < addr {
+			break
+		}
+		addr = next
+	}
+	bc.cover(blk)
+	bc.blocks[blk.start] = blk
+	return blk
+}
+
+// unchanged reports whether the memory still holds the bytes the block was
+// translated from
+func (blk *block) unchanged(cpu *Pep8CPU) bool {
+	for k, b := range blk.code {
+		if cpu.RAM[blk.start+uint16(k)] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// run executes the block, it returns false when the program stopped, or
+// reached limit steps
+func (blk *block) run(cpu *Pep8CPU, bc *blockCache, limit uint64) bool {
+	steps := blk.steps
+	if left := limit - cpu.Steps; left < uint64(len(steps)) {
+		// The limit is reached within the block, only the steps up to it
+		// are run
+		steps = steps[:left]
+	}
+	for _, st := range steps {
+		if !st(cpu) {
+			return false
+		}
+		// The instruction wrote over cached code, what follows may be stale
+		if blk.gen != bc.gen {
+			return true
+		}
+	}
+	if len(steps) < len(blk.steps) {
+		cpu.Fault = ErrStepLimit
+		return false
+	}
+	return true
+}
+
+// translate translates the instruction at addr, as DoNextCycle would
+// execute it
+func translate(cpu *Pep8CPU, addr uint16) step {
+	oc := opcode(cpu.RAM[addr])
+	op := &decodeTable[oc]
+	spec := uint16(0)
+	if op.length > 1 {
+		spec = cpu.peek16(addr + 1)
+	}
+	next := addr + op.length
+
+	if op.modeErr != nil {
+		return func(cpu *Pep8CPU) bool {
+			cpu.insAddr, cpu.opcode, cpu.Spec = addr, oc, spec
+			cpu.Fault = op.modeErr
+			return false
+		}
+	}
+	if op.exec == nil {
+		return func(cpu *Pep8CPU) bool {
+			cpu.insAddr, cpu.opcode, cpu.Spec = addr, oc, spec
+			cpu.PC = next
+			cpu.Steps++
+			return false
+		}
+	}
+	if st := specialize(oc, addr, spec, next); st != nil {
+		return st
+	}
+
+	exec := op.exec
+	if op.length == 1 {
+		return func(cpu *Pep8CPU) bool {
+			cpu.insAddr, cpu.opcode, cpu.Spec = addr, oc, spec
+			cpu.PC = next
+			exec(cpu)
+			if cpu.Fault != nil {
+				cpu.PC = addr
+				return false
+			}
+			cpu.Steps++
+			return true
+		}
+	}
+
+	mode, operand := op.mode, op.operand
+	if mode == i && operand != opAddr {
+		return func(cpu *Pep8CPU) bool {
+			cpu.insAddr, cpu.opcode, cpu.Spec = addr, oc, spec
+			cpu.AddrMode = i
+			cpu.Operand = spec
+			cpu.PC = next
+			exec(cpu)
+			if cpu.Fault != nil {
+				cpu.PC = addr
+				return false
+			}
+			cpu.Steps++
+			return true
+		}
+	}
+	return func(cpu *Pep8CPU) bool {
+		cpu.insAddr, cpu.opcode, cpu.Spec = addr, oc, spec
+		cpu.AddrMode = mode
+		cpu.loadOperand(operand)
+		cpu.PC = next
+		exec(cpu)
+		if cpu.Fault != nil {
+			cpu.PC = addr
+			return false
+		}
+		cpu.Steps++
+		return true
+	}
+}
+
+// specialize translates the instructions that cannot fault, which are most
+// of those executed, to closures that update the registers directly, or
+// returns nil
+//
+// Unlike exec, they leave the decoded instruction (Spec, Operand, AddrMode)
+// of the CPU as it was, and read the memory without notifying the
+// observers: RunFast has none.
+func specialize(oc opcode, addr, spec, next uint16) step {
+	op := &decodeTable[oc]
+	reg := op.reg
+	switch op.base {
+	case "LD", "LDBYTE", "ADD", "SUB", "AND", "OR", "CP", "ADDSP", "SUBSP":
+		val := operandFunc(op.mode, op.operand, spec)
+		switch op.base {
+		case "LD":
+			return func(cpu *Pep8CPU) bool {
+				*cpu.regPtr(reg) = cpu.Ld(val(cpu))
+				cpu.PC = next
+				cpu.Steps++
+				return true
+			}
+		case "LDBYTE":
+			return func(cpu *Pep8CPU) bool {
+				r := cpu.regPtr(reg)
+				*r = cpu.LdByte(*r, val(cpu))
+				cpu.PC = next
+				cpu.Steps++
+				return true
+			}
+		case "ADD":
+			return func(cpu *Pep8CPU) bool {
+				r := cpu.regPtr(reg)
+				*r = cpu.Add(*r, val(cpu))
+				cpu.PC = next
+				cpu.Steps++
+				return true
+			}
+		case "SUB":
+			return func(cpu *Pep8CPU) bool {
+				r := cpu.regPtr(reg)
+				*r = cpu.Sub(*r, val(cpu))
+				cpu.PC = next
+				cpu.Steps++
+				return true
+			}
+		case "AND":
+			return func(cpu *Pep8CPU) bool {
+				r := cpu.regPtr(reg)
+				*r = cpu.And(*r, val(cpu))
+				cpu.PC = next
+				cpu.Steps++
+				return true
+			}
+		case "OR":
+			return func(cpu *Pep8CPU) bool {
+				r := cpu.regPtr(reg)
+				*r = cpu.Or(*r, val(cpu))
+				cpu.PC = next
+				cpu.Steps++
+				return true
+			}
+		case "CP":
+			return func(cpu *Pep8CPU) bool {
+				cpu.Sub(*cpu.regPtr(reg), val(cpu))
+				cpu.PC = next
+				cpu.Steps++
+				return true
+			}
+		case "ADDSP":
+			return func(cpu *Pep8CPU) bool {
+				cpu.SP = cpu.Add(cpu.SP, val(cpu))
+				cpu.PC = next
+				cpu.Steps++
+				return true
+			}
+		case "SUBSP":
+			return func(cpu *Pep8CPU) bool {
+				cpu.SP = cpu.Sub(cpu.SP, val(cpu))
+				cpu.PC = next
+				cpu.Steps++
+				return true
+			}
+		}
+
+	case "ST":
+		to := addrFunc(op.mode, spec)
+		return func(cpu *Pep8CPU) bool {
+			cpu.write16(*cpu.regPtr(reg), to(cpu))
+			cpu.PC = next
+			cpu.Steps++
+			return true
+		}
+	case "STBYTE":
+		to := addrFunc(op.mode, spec)
+		return func(cpu *Pep8CPU) bool {
+			cpu.write8(uint8(*cpu.regPtr(reg)), to(cpu))
+			cpu.PC = next
+			cpu.Steps++
+			return true
+		}
+
+	case "BR", "BRLE", "BRLT", "BREQ", "BRNE", "BRGE", "BRGT", "BRV", "BRC":
+		// Jump tables, in mode x, are left to exec
+		if op.mode != i {
+			return nil
+		}
+		taken := branchTable(op.exec)
+		return func(cpu *Pep8CPU) bool {
+			cpu.PC = next
+			if taken[cpu.Flags()] {
+				cpu.PC = spec
+			}
+			cpu.Steps++
+			return true
+		}
+	case "CALL":
+		target := operandFunc(op.mode, op.operand, spec)
+		return func(cpu *Pep8CPU) bool {
+			cpu.PC = next
+			cpu.Call(addr, target(cpu))
+			cpu.Steps++
+			return true
+		}
+	case "RET":
+		locals := uint16(oc & 0x7)
+		return func(cpu *Pep8CPU) bool {
+			cpu.PC = next
+			cpu.Ret(addr, locals)
+			cpu.Steps++
+			return true
+		}
+	}
+	return nil
+}
+
+// branchTable returns whether a branch jumps for each value of the flags,
+// as Flags returns them, by executing it
+func branchTable(exec func(cpu *Pep8CPU)) (taken [16]bool) {
+	cpu := &Pep8CPU{}
+	for flags := range taken {
+		cpu.N, cpu.Z, cpu.V, cpu.C = flags&8 != 0, flags&4 != 0, flags&2 != 0, flags&1 != 0
+		cpu.PC, cpu.Operand = 0, 1
+		exec(cpu)
+		taken[flags] = cpu.PC == 1
+	}
+	return taken
+}
+
+// regPtr returns the register r of the CPU
+func (cpu *Pep8CPU) regPtr(r register) *uint16 {
+	if r == X {
+		return &cpu.X
+	}
+	return &cpu.A
+}
+
+// operandFunc returns a function reading the operand of an instruction, as
+// loadOperand does
+func operandFunc(mode AddrMode, class operandClass, spec uint16) func(cpu *Pep8CPU) uint16 {
+	switch {
+	case mode == i:
+		return func(*Pep8CPU) uint16 { return spec }
+	case mode == d && class == opByte:
+		return func(cpu *Pep8CPU) uint16 { return uint16(cpu.RAM[spec]) }
+	case mode == d:
+		return func(cpu *Pep8CPU) uint16 { return cpu.peek16(spec) }
+	}
+	at := addrFunc(mode, spec)
+	if class == opByte {
+		return func(cpu *Pep8CPU) uint16 { return uint16(cpu.RAM[at(cpu)]) }
+	}
+	return func(cpu *Pep8CPU) uint16 { return cpu.peek16(at(cpu)) }
+}
+
+// addrFunc returns a function computing the address of the operand of an
+// instruction, as operandAddr does
+func addrFunc(mode AddrMode, spec uint16) func(cpu *Pep8CPU) uint16 {
+	switch mode {
+	case x:
+		return func(cpu *Pep8CPU) uint16 { return spec + cpu.X }
+	case n:
+		return func(cpu *Pep8CPU) uint16 { return cpu.peek16(spec) }
+	case s:
+		return func(cpu *Pep8CPU) uint16 { return spec + cpu.SP }
+	case sx:
+		return func(cpu *Pep8CPU) uint16 { return spec + cpu.SP + cpu.X }
+	case sf:
+		return func(cpu *Pep8CPU) uint16 { return cpu.peek16(cpu.SP + spec) }
+	case sxf:
+		return func(cpu *Pep8CPU) uint16 { return cpu.peek16(cpu.SP+spec) + cpu.X }
+	}
+	return func(*Pep8CPU) uint16 { return spec }
+}
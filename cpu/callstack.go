@@ -0,0 +1,143 @@
+package cpu
+
+import (
+	"fmt"
+	"io"
+)
+
+// Frame is a subroutine call that has not returned yet
+type Frame struct {
+	// Site is the address of the CALL instruction
+	Site uint16
+	// Callee is the address of the called subroutine
+	Callee uint16
+	// SP is the stack pointer after the CALL, i.e. where the return address is
+	SP uint16
+}
+
+// ReturnAddr is the address the subroutine is expected to return to
+func (fr Frame) ReturnAddr() uint16 {
+	return fr.Site + 3
+}
+
+// BadReturn is a RET that did not return to the instruction following the
+// CALL of its frame
+//
+// The usual cause is a subroutine that does not release its locals before
+// returning, the RET then pops a local instead of the return address.
+type BadReturn struct {
+	// Site is the address of the RET instruction
+	Site uint16
+	// Target is the address the RET jumped to
+	Target uint16
+	// Frame is the frame the RET was expected to return from
+	Frame Frame
+	// SP is the address the return address was popped from
+	SP uint16
+}
+
+func (br BadReturn) String() string {
+	msg := fmt.Sprintf("RET at %04x returned to %04x", br.Site, br.Target)
+	if br.Target != br.Frame.ReturnAddr() {
+		msg += fmt.Sprintf(" instead of %04x", br.Frame.ReturnAddr())
+	}
+	msg += fmt.Sprintf(" (CALL at %04x)", br.Frame.Site)
+
+	switch {
+	case br.SP < br.Frame.SP:
+		msg += fmt.Sprintf(", the return address was popped from %04x instead of %04x: %d bytes of locals were not released",
+			br.SP, br.Frame.SP, br.Frame.SP-br.SP)
+	case br.SP > br.Frame.SP:
+		msg += fmt.Sprintf(", the return address was popped from %04x instead of %04x: %d bytes too many were released",
+			br.SP, br.Frame.SP, br.SP-br.Frame.SP)
+	}
+	return msg
+}
+
+// CallStack is an Observer that keeps a shadow call stack of the program,
+// from its CALLs and RETs
+type CallStack struct {
+	NopObserver
+
+	// Frames are the active calls, the innermost one last
+	Frames []Frame
+	// BadReturns are all the mismatched RETs seen so far
+	BadReturns []BadReturn
+	// OnBadReturn is called when a RET does not match its CALL, if set
+	OnBadReturn func(br BadReturn)
+	// Symbols names the subroutines in backtraces, if set
+	Symbols *Listing
+}
+
+func (cs *CallStack) Call(cpu *Pep8CPU, site, target, sp uint16) {
+	cs.Frames = append(cs.Frames, Frame{
+		Site:   site,
+		Callee: target,
+		SP:     sp,
+	})
+}
+
+func (cs *CallStack) Return(cpu *Pep8CPU, site, target, sp uint16) {
+	if len(cs.Frames) == 0 {
+		return
+	}
+
+	// A RET pops the return address, which was at sp - 2
+	popped := sp - 2
+	for idx := len(cs.Frames) - 1; idx >= 0; idx-- {
+		fr := cs.Frames[idx]
+		if fr.ReturnAddr() == target && fr.SP == popped {
+			cs.Frames = cs.Frames[:idx]
+			return
+		}
+	}
+
+	br := BadReturn{
+		Site:   site,
+		Target: target,
+		Frame:  cs.Frames[len(cs.Frames)-1],
+		SP:     popped,
+	}
+	cs.BadReturns = append(cs.BadReturns, br)
+	cs.Frames = cs.Frames[:len(cs.Frames)-1]
+	if cs.OnBadReturn != nil {
+		cs.OnBadReturn(br)
+	}
+}
+
+// Name returns the symbol for a subroutine, or its address if unknown
+func (cs *CallStack) Name(addr uint16) string {
+	if cs.Symbols != nil {
+		if sym, ok := cs.Symbols.SymbolAt(addr); ok {
+			return sym
+		}
+	}
+	return fmt.Sprintf("0x%04x", addr)
+}
+
+// Backtrace returns the active calls, with pc the current location in
+// the innermost one, e.g.:
+//
+//	#0  0010 in incr
+//	#1  0003 in main
+func (cs *CallStack) Backtrace(pc uint16) []string {
+	bt := []string{}
+	for idx := len(cs.Frames); idx >= 0; idx-- {
+		name := "main"
+		if idx > 0 {
+			name = cs.Name(cs.Frames[idx-1].Callee)
+		}
+		bt = append(bt, fmt.Sprintf("#%-2d %04x in %s", len(cs.Frames)-idx, pc, name))
+		if idx > 0 {
+			pc = cs.Frames[idx-1].Site
+		}
+	}
+	return bt
+}
+
+// WriteBacktrace writes the backtrace from pc to w, one frame per line
+func (cs *CallStack) WriteBacktrace(w io.Writer, pc uint16) {
+	for _, ln := range cs.Backtrace(pc) {
+		fmt.Fprintln(w, ln)
+	}
+}
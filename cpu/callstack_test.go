@@ -0,0 +1,109 @@
+package cpu
+
+import (
+	"strings"
+	"testing"
+)
+
+// leakProgram calls outer, which calls inner, which returns to the STOP
+// of main without releasing its local
+var leakProgram = []byte{
+	0x16, 0x00, 0x04, // 0000 CALL outer,i
+	0x00,             // 0003 STOP
+	0x16, 0x00, 0x08, // 0004 outer: CALL inner,i
+	0x58,             // 0007 RET0
+	0x68, 0x00, 0x02, // 0008 inner: SUBSP 2,i
+	0xC0, 0x00, 0x03, // 000B LDA 3,i
+	0xE3, 0x00, 0x00, // 000E STA 0,s
+	0x58, // 0011 RET0
+}
+
+func TestCallStack(t *testing.T) {
+	cs := &CallStack{}
+	cpu := NewPep8Cpu()
+	cpu.Load(leakProgram)
+	cpu.Observers = []Observer{cs}
+	// Stop before the RET of inner
+	cpu.MaxSteps = 5
+	if err := cpu.Run(); err != ErrStepLimit {
+		t.Fatalf("run: %v, want %v", err, ErrStepLimit)
+	}
+
+	want := []Frame{{Site: 0x0000, Callee: 0x0004, SP: 0xFFFD}, {Site: 0x0004, Callee: 0x0008, SP: 0xFFFB}}
+	if len(cs.Frames) != len(want) || cs.Frames[0] != want[0] || cs.Frames[1] != want[1] {
+		t.Fatalf("frames %+v, want %+v", cs.Frames, want)
+	}
+	bt := strings.Join(cs.Backtrace(cpu.PC), "\n")
+	wantBt := "#0  0011 in 0x0008\n#1  0004 in 0x0004\n#2  0000 in main"
+	if bt != wantBt {
+		t.Errorf("backtrace:\n%s\nwant:\n%s", bt, wantBt)
+	}
+	if len(cs.BadReturns) != 0 {
+		t.Errorf("bad returns %v before any RET", cs.BadReturns)
+	}
+}
+
+func TestBadReturn(t *testing.T) {
+	reported := []BadReturn{}
+	cs := &CallStack{OnBadReturn: func(br BadReturn) { reported = append(reported, br) }}
+	observe(leakProgram, "", cs)
+
+	want := BadReturn{
+		Site:   0x0011,
+		Target: 0x0003,
+		Frame:  Frame{Site: 0x0004, Callee: 0x0008, SP: 0xFFFB},
+		SP:     0xFFF9,
+	}
+	if len(cs.BadReturns) != 1 || cs.BadReturns[0] != want {
+		t.Fatalf("bad returns %+v, want %+v", cs.BadReturns, want)
+	}
+	if len(reported) != 1 || reported[0] != want {
+		t.Errorf("reported %+v, want %+v", reported, want)
+	}
+	msg := "RET at 0011 returned to 0003 instead of 0007 (CALL at 0004), " +
+		"the return address was popped from fff9 instead of fffb: 2 bytes of locals were not released"
+	if want.String() != msg {
+		t.Errorf("message %q, want %q", want.String(), msg)
+	}
+
+	// The frame of inner is dropped, outer never returned
+	if len(cs.Frames) != 1 || cs.Frames[0].Callee != 0x0004 {
+		t.Errorf("frames %+v, want the one of outer", cs.Frames)
+	}
+}
+
+func TestBadReturnMessages(t *testing.T) {
+	fr := Frame{Site: 0x0010, Callee: 0x0020, SP: 0xFFF0}
+	for _, tc := range []struct {
+		br   BadReturn
+		want string
+	}{
+		{
+			BadReturn{Site: 0x0030, Target: 0x0013, Frame: fr, SP: 0xFFF4},
+			"RET at 0030 returned to 0013 (CALL at 0010), the return address was popped from fff4 instead of fff0: 4 bytes too many were released",
+		},
+		{
+			BadReturn{Site: 0x0030, Target: 0x0040, Frame: fr, SP: 0xFFF0},
+			"RET at 0030 returned to 0040 instead of 0013 (CALL at 0010)",
+		},
+	} {
+		if got := tc.br.String(); got != tc.want {
+			t.Errorf("message %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestCallStackNames(t *testing.T) {
+	lst, err := ParseListing(strings.NewReader(testListing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &CallStack{Symbols: lst, Frames: []Frame{{Site: 0x0000, Callee: 0x000A, SP: 0xFFFD}}}
+	bt := strings.Join(cs.Backtrace(0x000D), "\n")
+	if want := "#0  000d in main\n#1  0000 in main"; bt != want {
+		t.Errorf("backtrace:\n%s\nwant:\n%s", bt, want)
+	}
+	if name := cs.Name(0x0009); name != "0x0009" {
+		t.Errorf("name of 0009 %q, want 0x0009", name)
+	}
+}
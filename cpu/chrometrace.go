@@ -0,0 +1,128 @@
+package cpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// chromeEvent is an event of the Chrome trace-event format, see
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+type chromeEvent struct {
+	Name  string                 `json:"name"`
+	Cat   string                 `json:"cat,omitempty"`
+	Phase string                 `json:"ph"`
+	Ts    uint64                 `json:"ts"`
+	Pid   int                    `json:"pid"`
+	Tid   int                    `json:"tid"`
+	Scope string                 `json:"s,omitempty"`
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+// ChromeTrace is an Observer that records the subroutine calls and the I/O
+// of a program as Chrome trace events, viewable in Perfetto or
+// chrome://tracing
+//
+// Time is measured in steps, an instruction lasts 1µs in the viewer.
+type ChromeTrace struct {
+	NopObserver
+
+	// Name is the name of the program, shown as the process name
+	Name string
+
+	calls  CallStack
+	events []chromeEvent
+	step   uint64
+	in     []byte
+	out    []byte
+}
+
+// NewChromeTrace creates an empty trace, subroutines are named after the
+// symbols of lst, which may be nil
+func NewChromeTrace(name string, lst *Listing) *ChromeTrace {
+	ct := &ChromeTrace{Name: name}
+	ct.calls.Symbols = lst
+	ct.events = append(ct.events,
+		chromeEvent{Name: "process_name", Phase: "M", Pid: 1, Args: map[string]interface{}{"name": name}},
+		chromeEvent{Name: "thread_name", Phase: "M", Pid: 1, Tid: 1, Args: map[string]interface{}{"name": "cpu"}},
+		chromeEvent{Name: "main", Cat: "call", Phase: "B", Pid: 1, Tid: 1},
+	)
+	return ct
+}
+
+func (ct *ChromeTrace) BeforeInstruction(cpu *Pep8CPU, ins Instruction) {
+	ct.in = ct.in[:0]
+	ct.out = ct.out[:0]
+}
+
+func (ct *ChromeTrace) Input(cpu *Pep8CPU, b byte) {
+	ct.in = append(ct.in, b)
+}
+
+func (ct *ChromeTrace) Output(cpu *Pep8CPU, b byte) {
+	ct.out = append(ct.out, b)
+}
+
+func (ct *ChromeTrace) AfterInstruction(cpu *Pep8CPU, ins Instruction) {
+	if len(ct.in) > 0 || len(ct.out) > 0 {
+		args := map[string]interface{}{"addr": fmt.Sprintf("%04x", ins.Addr)}
+		if len(ct.in) > 0 {
+			args["in"] = latin1(ct.in)
+		}
+		if len(ct.out) > 0 {
+			args["out"] = latin1(ct.out)
+		}
+		ct.events = append(ct.events, chromeEvent{
+			Name: ins.Mnemonic, Cat: "io", Phase: "i", Ts: ct.step, Pid: 1, Tid: 1, Scope: "t", Args: args,
+		})
+	}
+	ct.step++
+}
+
+func (ct *ChromeTrace) Call(cpu *Pep8CPU, site, target, sp uint16) {
+	ct.calls.Call(cpu, site, target, sp)
+	ct.events = append(ct.events, chromeEvent{
+		Name:  ct.calls.Name(target),
+		Cat:   "call",
+		Phase: "B",
+		Ts:    ct.step + 1,
+		Pid:   1,
+		Tid:   1,
+		Args:  map[string]interface{}{"site": fmt.Sprintf("%04x", site), "sp": fmt.Sprintf("%04x", sp)},
+	})
+}
+
+func (ct *ChromeTrace) Return(cpu *Pep8CPU, site, target, sp uint16) {
+	depth := len(ct.calls.Frames)
+	ct.calls.Return(cpu, site, target, sp)
+
+	// The RET is part of the subroutine, its span ends after it; a
+	// mismatched RET may end several spans
+	for n := len(ct.calls.Frames); n < depth; n++ {
+		ct.events = append(ct.events, chromeEvent{Phase: "E", Ts: ct.step + 1, Pid: 1, Tid: 1})
+	}
+}
+
+// WriteJSON writes the trace as a JSON object, the spans of the calls that
+// did not return end with the trace
+func (ct *ChromeTrace) WriteJSON(w io.Writer) error {
+	events := ct.events
+	for n := 0; n <= len(ct.calls.Frames); n++ {
+		events = append(events, chromeEvent{Phase: "E", Ts: ct.step, Pid: 1, Tid: 1})
+	}
+
+	enc := json.NewEncoder(w)
+	return enc.Encode(map[string]interface{}{
+		"traceEvents":     events,
+		"displayTimeUnit": "ms",
+	})
+}
+
+// latin1 decodes bytes as Latin-1, as they are not always valid UTF-8
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for idx, c := range b {
+		runes[idx] = rune(c)
+	}
+	return string(runes)
+}
@@ -0,0 +1,100 @@
+package cpu
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// chromeEvents runs a program with a Chrome trace, and returns its events
+// as name, phase and timestamp, with their arguments
+func chromeEvents(t *testing.T, program []byte, input string, lst *Listing) []string {
+	ct := NewChromeTrace("prog", lst)
+	observe(program, input, ct)
+	out := &bytes.Buffer{}
+	if err := ct.WriteJSON(out); err != nil {
+		t.Fatal(err)
+	}
+
+	trace := struct {
+		TraceEvents []struct {
+			Name  string            `json:"name"`
+			Phase string            `json:"ph"`
+			Ts    uint64            `json:"ts"`
+			Pid   int               `json:"pid"`
+			Tid   int               `json:"tid"`
+			Args  map[string]string `json:"args"`
+		} `json:"traceEvents"`
+		DisplayTimeUnit string `json:"displayTimeUnit"`
+	}{}
+	if err := json.Unmarshal(out.Bytes(), &trace); err != nil {
+		t.Fatalf("invalid JSON: %s\n%s", err, out)
+	}
+	if trace.DisplayTimeUnit != "ms" {
+		t.Errorf("display time unit %q", trace.DisplayTimeUnit)
+	}
+
+	events := []string{}
+	for _, ev := range trace.TraceEvents {
+		if ev.Pid != 1 {
+			t.Errorf("event %s in process %d", ev.Name, ev.Pid)
+		}
+		desc := fmt.Sprintf("%s %s %d", ev.Phase, ev.Name, ev.Ts)
+		for _, key := range []string{"name", "addr", "site", "sp", "in", "out"} {
+			if val, ok := ev.Args[key]; ok {
+				desc += fmt.Sprintf(" %s=%s", key, val)
+			}
+		}
+		events = append(events, strings.TrimSpace(desc))
+	}
+	return events
+}
+
+func TestChromeTrace(t *testing.T) {
+	lst, err := ParseListing(strings.NewReader(callListing))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An instruction lasts 1µs, a call span starts after its CALL and ends
+	// after its RET
+	want := []string{
+		"M process_name 0 name=prog",
+		"M thread_name 0 name=cpu",
+		"B main 0",
+		"B sub 1 site=0000 sp=fffd",
+		"i CHARI 1 addr=0007 in=z",
+		"E  3",
+		"i CHARO 3 addr=0003 out=A",
+		"E  5",
+	}
+	if got := chromeEvents(t, callProgram, "z", lst); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestChromeTraceUnfinished(t *testing.T) {
+	// inner reads characters until the end of the input, then faults, the
+	// spans of the calls that did not return end with the trace
+	program := append(append([]byte{}, leakProgram[:0x0008]...),
+		0x49, 0x00, 0x20, // 0008 inner: CHARI 0x0020,d
+		0x04, 0x00, 0x08, // 000B BR inner,i
+	)
+	want := []string{
+		"M process_name 0 name=prog",
+		"M thread_name 0 name=cpu",
+		"B main 0",
+		"B 0x0004 1 site=0000 sp=fffd",
+		"B 0x0008 2 site=0004 sp=fffb",
+		// The input is decoded as Latin-1
+		"i CHARI 2 addr=0008 in=é",
+		"E  5",
+		"E  5",
+		"E  5",
+	}
+	if got := chromeEvents(t, program, "\xE9", nil); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
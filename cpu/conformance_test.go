@@ -0,0 +1,500 @@
+package cpu
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// refMachine is a reference model of Pep/8, written from the specification
+// of the instruction set rather than from the emulator, one instruction at a
+// time. The memory is background() but for the bytes written.
+//
+// The traps, NOPn and NOP, do nothing as in the emulator, and RETTR faults.
+type refMachine struct {
+	A, X, SP, PC uint16
+	N, Z, V, C   bool
+	mem          map[uint16]byte
+	in           []byte
+	out          []byte
+	stopped      bool
+	fault        bool
+}
+
+// background is the content of the memory before a case
+func background(addr uint16) byte {
+	return byte(addr*37) ^ byte(addr>>8)*11 ^ 0x5A
+}
+
+func (m *refMachine) read8(addr uint16) byte {
+	if b, ok := m.mem[addr]; ok {
+		return b
+	}
+	return background(addr)
+}
+
+func (m *refMachine) read16(addr uint16) uint16 {
+	return uint16(m.read8(addr))<<8 | uint16(m.read8(addr+1))
+}
+
+func (m *refMachine) write8(addr uint16, b byte) {
+	m.mem[addr] = b
+}
+
+func (m *refMachine) write16(addr, w uint16) {
+	m.write8(addr, byte(w>>8))
+	m.write8(addr+1, byte(w))
+}
+
+func (m *refMachine) nz(r uint16) {
+	m.N, m.Z = r >= 0x8000, r == 0
+}
+
+// add is the adder of the ALU, setting NZVC
+func (m *refMachine) add(a, b uint16) uint16 {
+	r := a + b
+	m.nz(r)
+	m.C = uint32(a)+uint32(b) > 0xFFFF
+	m.V = a&0x8000 == b&0x8000 && r&0x8000 != a&0x8000
+	return r
+}
+
+// sub adds the two's complement of b, as specified
+func (m *refMachine) sub(a, b uint16) uint16 {
+	return m.add(a, -b)
+}
+
+// getc reads a character of the input, false at its end
+func (m *refMachine) getc() (byte, bool) {
+	if len(m.in) == 0 {
+		return 0, false
+	}
+	c := m.in[0]
+	m.in = m.in[1:]
+	return c, true
+}
+
+// deci reads a decimal number: spaces, an optional sign then digits, the
+// character that ends the number is consumed. Its value is stored modulo
+// 2^16, V tells whether it is out of the range of a word.
+func (m *refMachine) deci() (uint16, bool) {
+	c, ok := m.getc()
+	for ok && c <= ' ' {
+		c, ok = m.getc()
+	}
+	if !ok {
+		return 0, false
+	}
+	neg := c == '-'
+	if c == '-' || c == '+' {
+		if c, ok = m.getc(); !ok {
+			return 0, false
+		}
+	}
+	if c < '0' || c > '9' {
+		return 0, false
+	}
+	val, big := uint16(0), false
+	mag := 0
+	for ok && c >= '0' && c <= '9' {
+		val = val*10 + uint16(c-'0')
+		if mag <= 32768 {
+			mag = mag*10 + int(c-'0')
+		}
+		c, ok = m.getc()
+	}
+	if neg {
+		val = -val
+		big = mag > 32768
+	} else {
+		big = mag > 32767
+	}
+	m.nz(val)
+	m.V = big
+	return val, true
+}
+
+// step executes the instruction at PC
+func (m *refMachine) step() {
+	pc := m.PC
+	ir := m.read8(pc)
+	unary := ir < 0x04 || ir >= 0x18 && ir < 0x28 || ir >= 0x58 && ir < 0x60
+	spec := uint16(0)
+	m.PC = pc + 1
+	if !unary {
+		spec = m.read16(pc + 1)
+		m.PC = pc + 3
+	}
+
+	// The addressing mode is in bit 0 for the branches, i or x, in bits
+	// 0-2 for the others
+	mode := int(ir & 7)
+	if ir < 0x18 {
+		mode = 0
+		if ir&1 != 0 {
+			mode = 5
+		}
+	}
+	addr := func() uint16 {
+		switch mode {
+		case 1:
+			return spec
+		case 2:
+			return m.read16(spec)
+		case 3:
+			return m.SP + spec
+		case 4:
+			return m.read16(m.SP + spec)
+		case 5:
+			return spec + m.X
+		case 6:
+			return m.SP + spec + m.X
+		}
+		return m.read16(m.SP+spec) + m.X
+	}
+	word := func() uint16 {
+		if mode == 0 {
+			return spec
+		}
+		return m.read16(addr())
+	}
+	byt := func() byte {
+		if mode == 0 {
+			return byte(spec)
+		}
+		return m.read8(addr())
+	}
+
+	// The register is in bit 0 for the unary instructions, in bit 3 for the
+	// others
+	r := &m.A
+	if ir < 0x28 && ir&1 != 0 || ir >= 0x70 && ir&8 != 0 {
+		r = &m.X
+	}
+
+	fault := func() {
+		m.PC = pc
+		m.fault = true
+	}
+	// noImm are the instructions that need an address
+	noImm := ir >= 0x30 && ir < 0x38 || ir >= 0x40 && ir < 0x50 || ir >= 0xE0
+	strModes := mode == 1 || mode == 2 || mode == 4
+	if noImm && mode == 0 || ir >= 0x28 && ir < 0x30 && mode != 0 || ir >= 0x40 && ir < 0x48 && !strModes {
+		fault()
+		return
+	}
+
+	switch {
+	case ir == 0x00:
+		m.stopped = true
+	case ir == 0x01:
+		fault()
+	case ir == 0x02:
+		m.A = m.SP
+	case ir == 0x03:
+		m.A = 0
+		for k, f := range []bool{m.C, m.V, m.Z, m.N} {
+			if f {
+				m.A |= 1 << k
+			}
+		}
+	case ir < 0x16:
+		conds := []bool{true, m.N || m.Z, m.N, m.Z, !m.Z, !m.N, !m.N && !m.Z, m.V, m.C}
+		target := word()
+		if conds[(ir-0x04)/2] {
+			m.PC = target
+		}
+	case ir < 0x18:
+		target := word()
+		m.SP -= 2
+		m.write16(m.SP, m.PC)
+		m.PC = target
+	case ir < 0x1A:
+		*r = ^*r
+		m.nz(*r)
+	case ir < 0x1C:
+		m.V = *r == 0x8000
+		*r = -*r
+		m.nz(*r)
+	case ir < 0x1E:
+		m.C = *r&0x8000 != 0
+		res := *r << 1
+		m.V = res&0x8000 != *r&0x8000
+		*r = res
+		m.nz(*r)
+	case ir < 0x20:
+		m.C = *r&1 != 0
+		*r = *r>>1 | *r&0x8000
+		m.nz(*r)
+	case ir < 0x22:
+		c := *r&0x8000 != 0
+		*r <<= 1
+		if m.C {
+			*r |= 1
+		}
+		m.C = c
+	case ir < 0x24:
+		c := *r&1 != 0
+		*r >>= 1
+		if m.C {
+			*r |= 0x8000
+		}
+		m.C = c
+	case ir < 0x30:
+		// NOPn and NOP
+	case ir < 0x38:
+		val, ok := m.deci()
+		if !ok {
+			fault()
+			return
+		}
+		m.write16(addr(), val)
+	case ir < 0x40:
+		m.out = append(m.out, fmt.Sprint(int16(word()))...)
+	case ir < 0x48:
+		for a := addr(); m.read8(a) != 0; a++ {
+			m.out = append(m.out, m.read8(a))
+		}
+	case ir < 0x50:
+		c, ok := m.getc()
+		if !ok {
+			fault()
+			return
+		}
+		m.write8(addr(), c)
+	case ir < 0x58:
+		m.out = append(m.out, byt())
+	case ir < 0x60:
+		m.SP += uint16(ir - 0x58)
+		m.PC = m.read16(m.SP)
+		m.SP += 2
+	case ir < 0x68:
+		m.SP = m.add(m.SP, word())
+	case ir < 0x70:
+		m.SP = m.sub(m.SP, word())
+	case ir < 0x80:
+		*r = m.add(*r, word())
+	case ir < 0x90:
+		*r = m.sub(*r, word())
+	case ir < 0xA0:
+		*r &= word()
+		m.nz(*r)
+	case ir < 0xB0:
+		*r |= word()
+		m.nz(*r)
+	case ir < 0xC0:
+		m.sub(*r, word())
+	case ir < 0xD0:
+		*r = word()
+		m.nz(*r)
+	case ir < 0xE0:
+		*r = *r&0xFF00 | uint16(byt())
+		m.nz(*r)
+	case ir < 0xF0:
+		m.write16(addr(), *r)
+	default:
+		m.write8(addr(), byte(*r))
+	}
+}
+
+// conformanceCase is an instruction, at conformancePC, and the state it
+// executes in
+type conformanceCase struct {
+	ins        [3]byte
+	A, X, SP   uint16
+	N, Z, V, C bool
+	input      string
+}
+
+const conformancePC = 0x1000
+
+func (cc conformanceCase) String() string {
+	op := &decodeTable[cc.ins[0]]
+	return fmt.Sprintf("%s (%02X) spec %02X%02X, A %04X X %04X SP %04X NZVC %d%d%d%d, input %q",
+		op.mnemonic, cc.ins[0], cc.ins[1], cc.ins[2], cc.A, cc.X, cc.SP,
+		booltoInt(cc.N), booltoInt(cc.Z), booltoInt(cc.V), booltoInt(cc.C), cc.input)
+}
+
+// writeLog records the addresses written
+type writeLog struct {
+	NopObserver
+	addrs []uint16
+}
+
+func (wl *writeLog) MemoryWrite(cpu *Pep8CPU, addr uint16, size int, val uint16) {
+	for k := 0; k < size; k++ {
+		wl.addrs = append(wl.addrs, addr+uint16(k))
+	}
+}
+
+// conformance executes cases on a CPU and on the reference model
+type conformance struct {
+	cpu *Pep8CPU
+	log *writeLog
+	out *bytes.Buffer
+}
+
+func newConformance() *conformance {
+	cf := &conformance{cpu: NewPep8Cpu(), log: &writeLog{}, out: &bytes.Buffer{}}
+	for addr := range cf.cpu.RAM {
+		cf.cpu.RAM[addr] = background(uint16(addr))
+	}
+	cf.cpu.Observers = []Observer{cf.log}
+	cf.cpu.Out = cf.out
+	return cf
+}
+
+// check executes the case with the interpreter, or with the translation of
+// RunFast if fast is set, and compares the results to the reference model
+func (cf *conformance) check(cc conformanceCase, fast bool) error {
+	ref := &refMachine{
+		A: cc.A, X: cc.X, SP: cc.SP, PC: conformancePC,
+		N: cc.N, Z: cc.Z, V: cc.V, C: cc.C,
+		mem: map[uint16]byte{},
+		in:  []byte(cc.input),
+	}
+	for k, b := range cc.ins {
+		ref.write8(conformancePC+uint16(k), b)
+	}
+	ref.step()
+
+	cpu := cf.cpu
+	copy(cpu.RAM[conformancePC:], cc.ins[:])
+	cpu.A, cpu.X, cpu.SP, cpu.PC = cc.A, cc.X, cc.SP, conformancePC
+	cpu.N, cpu.Z, cpu.V, cpu.C = cc.N, cc.Z, cc.V, cc.C
+	cpu.In = bytes.NewReader([]byte(cc.input))
+	cpu.Fault = nil
+	cf.out.Reset()
+	cf.log.addrs = cf.log.addrs[:0]
+	if fast {
+		translate(cpu, conformancePC)(cpu)
+	} else {
+		cpu.DoNextCycle()
+	}
+
+	// The memory is compared where either wrote, then restored
+	errs := []string{}
+	diff := func(name string, got, want interface{}) {
+		if got != want {
+			errs = append(errs, fmt.Sprintf("%s %v, want %v", name, got, want))
+		}
+	}
+	diff("fault", cpu.Fault != nil, ref.fault)
+	diff("PC", cpu.PC, ref.PC)
+	diff("SP", cpu.SP, ref.SP)
+	diff("A", cpu.A, ref.A)
+	diff("X", cpu.X, ref.X)
+	diff("N", cpu.N, ref.N)
+	diff("Z", cpu.Z, ref.Z)
+	diff("V", cpu.V, ref.V)
+	diff("C", cpu.C, ref.C)
+	diff("output", cf.out.String(), string(ref.out))
+	for addr := range ref.mem {
+		cf.log.addrs = append(cf.log.addrs, addr)
+	}
+	for _, addr := range cf.log.addrs {
+		diff(fmt.Sprintf("memory at %04X", addr), cpu.RAM[addr], ref.read8(addr))
+	}
+	for _, addr := range cf.log.addrs {
+		cpu.RAM[addr] = background(addr)
+	}
+	for k := range cc.ins {
+		cpu.RAM[conformancePC+k] = background(uint16(conformancePC + k))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: %v", cc, errs)
+	}
+	return nil
+}
+
+// The values the registers and operand specifiers take in the cases, at
+// the edges of the signed and unsigned ranges, and of bytes
+var (
+	conformanceWords = []uint16{0x0000, 0x0001, 0x00FF, 0x0100, 0x7FFF, 0x8000, 0x8001, 0xFF00, 0xFFFF}
+	conformanceSpecs = []uint16{0x0000, 0x0001, 0x007F, 0x0080, 0x00FF, 0x7FFF, 0x8000, 0xFFFF, 0x0FFF}
+	conformanceX     = []uint16{0x0000, 0x0002, 0xFFFF}
+	conformanceSP    = []uint16{0xFB8F, 0x0001}
+	conformanceFlags = []uint8{0x0, 0xF, 0x9, 0x6, 0x8, 0x4, 0x2, 0x1}
+)
+
+// TestConformance checks every opcode, in every addressing mode, against
+// the reference model, with the interpreter and the translation of RunFast
+func TestConformance(t *testing.T) {
+	cf := newConformance()
+	for oc := 0; oc < 256; oc++ {
+		op := &decodeTable[oc]
+		t.Run(fmt.Sprintf("%02X-%s", oc, op.mnemonic), func(t *testing.T) {
+			failures := 0
+			for _, spec := range conformanceSpecs {
+				for _, a := range conformanceWords {
+					for _, x := range conformanceX {
+						for _, sp := range conformanceSP {
+							for _, flags := range conformanceFlags {
+								cc := conformanceCase{
+									ins: [3]byte{byte(oc), byte(spec >> 8), byte(spec)},
+									A:   a, X: x, SP: sp,
+									N: flags&8 != 0, Z: flags&4 != 0, V: flags&2 != 0, C: flags&1 != 0,
+									input: "-123 x",
+								}
+								for _, fast := range []bool{false, true} {
+									if err := cf.check(cc, fast); err != nil {
+										t.Errorf("fast %v: %s", fast, err)
+										if failures++; failures == 5 {
+											t.FailNow()
+										}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestConformanceDECI checks the numbers read by DECI, and their flags
+func TestConformanceDECI(t *testing.T) {
+	cf := newConformance()
+	for _, input := range []string{
+		"0", "1", "-1", "+7", "-0", "  \n\t42\n", "007",
+		"32767", "32768", "-32768", "-32769", "65535", "65536", "-65536",
+		"100000", "99999999999999999999999", "-99999999999999999999999",
+		"12abc", "", " ", "-", "+", "- 1", "abc", "--1",
+	} {
+		for _, flags := range []uint8{0x0, 0xF} {
+			cc := conformanceCase{
+				ins: [3]byte{DECId, 0x20, 0x00},
+				SP:  0xFB8F,
+				N:   flags&8 != 0, Z: flags&4 != 0, V: flags&2 != 0, C: flags&1 != 0,
+				input: input,
+			}
+			if err := cf.check(cc, false); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+// TestConformanceIO checks the input and output instructions on strings
+// and characters
+func TestConformanceIO(t *testing.T) {
+	cf := newConformance()
+	for _, cc := range []conformanceCase{
+		{ins: [3]byte{CHARIs, 0x00, 0x02}, SP: 0xFB8F, input: "\xE9"},
+		{ins: [3]byte{CHARIs, 0x00, 0x02}, SP: 0xFB8F},
+		{ins: [3]byte{CHAROi, 0x00, 0x00}},
+		{ins: [3]byte{CHAROi, 0x12, 0xFF}},
+		{ins: [3]byte{DECOi, 0x80, 0x00}},
+		{ins: [3]byte{DECOi, 0xFF, 0xFF}},
+		// The string at 0x1000 is the STRO itself, followed by the
+		// background
+		{ins: [3]byte{STROd, 0x10, 0x00}},
+		{ins: [3]byte{STROd, 0xFF, 0xFF}},
+	} {
+		if err := cf.check(cc, false); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package cpu
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Branch counts the outcomes of a conditional branch
+type Branch struct {
+	Taken    uint64
+	NotTaken uint64
+}
+
+// Coverage is an Observer that records which instructions were executed,
+// and for every conditional branch whether it was taken
+type Coverage struct {
+	NopObserver
+
+	// Hits is the number of times the instruction at each address executed
+	Hits [0x10000]uint64
+	// Branches are the conditional branches executed, by address
+	Branches map[uint16]*Branch
+}
+
+// NewCoverage creates an empty coverage
+func NewCoverage() *Coverage {
+	return &Coverage{Branches: map[uint16]*Branch{}}
+}
+
+// isConditionalBranch is true for the BRxx instructions, BR excepted
+func isConditionalBranch(baseOp string) bool {
+	switch baseOp {
+	case "BRLE", "BRLT", "BREQ", "BRNE", "BRGE", "BRGT", "BRV", "BRC":
+		return true
+	}
+	return false
+}
+
+func (cov *Coverage) BeforeInstruction(cpu *Pep8CPU, ins Instruction) {
+	cov.Hits[ins.Addr]++
+}
+
+func (cov *Coverage) AfterInstruction(cpu *Pep8CPU, ins Instruction) {
+	if cpu.Fault != nil || !isConditionalBranch(ins.BaseOp) {
+		return
+	}
+
+	br := cov.Branches[ins.Addr]
+	if br == nil {
+		br = &Branch{}
+		cov.Branches[ins.Addr] = br
+	}
+	if cpu.PC != ins.Next() {
+		br.Taken++
+	} else {
+		br.NotTaken++
+	}
+}
+
+// coveredLine is an instruction of a listing, with its coverage
+type coveredLine struct {
+	ListingLine
+	hits uint64
+	// cond is true for conditional branches, br is nil if never executed
+	cond bool
+	br   *Branch
+}
+
+func (cov *Coverage) lines(lst *Listing) []coveredLine {
+	lines := []coveredLine{}
+	for _, ll := range lst.Lines {
+		if !ll.IsInstruction() {
+			continue
+		}
+		cl := coveredLine{ListingLine: ll, hits: cov.Hits[ll.Addr]}
+		if len(ll.Code) > 0 {
+			cl.cond = isConditionalBranch(opcode(ll.Code[0]).BaseOp())
+			cl.br = cov.Branches[ll.Addr]
+		}
+		lines = append(lines, cl)
+	}
+	return lines
+}
+
+// WriteLcov writes the coverage of the instructions of lst in the lcov
+// tracefile format, with the listing as the source file, lst must have a
+// Path for lcov tools to show it
+//
+// Every conditional branch has two lcov branches, taken and not taken.
+func (cov *Coverage) WriteLcov(w io.Writer, lst *Listing) error {
+	if lst.Path == "" {
+		return fmt.Errorf("the listing has no file to be the lcov source")
+	}
+
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "TN:\nSF:%s\n", lst.Path)
+
+	found, hit := 0, 0
+	brFound, brHit := 0, 0
+	for _, cl := range cov.lines(lst) {
+		found++
+		if cl.hits > 0 {
+			hit++
+		}
+		fmt.Fprintf(&sb, "DA:%d,%d\n", cl.Num, cl.hits)
+
+		if !cl.cond {
+			continue
+		}
+		brFound += 2
+		if cl.br == nil {
+			fmt.Fprintf(&sb, "BRDA:%d,0,0,-\nBRDA:%d,0,1,-\n", cl.Num, cl.Num)
+			continue
+		}
+		fmt.Fprintf(&sb, "BRDA:%d,0,0,%d\nBRDA:%d,0,1,%d\n", cl.Num, cl.br.Taken, cl.Num, cl.br.NotTaken)
+		if cl.br.Taken > 0 {
+			brHit++
+		}
+		if cl.br.NotTaken > 0 {
+			brHit++
+		}
+	}
+
+	fmt.Fprintf(&sb, "BRF:%d\nBRH:%d\nLF:%d\nLH:%d\nend_of_record\n", brFound, brHit, found, hit)
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// WriteSummary writes the coverage of the instructions of lst for humans,
+// with the lines never executed and the branches that went only one way
+func (cov *Coverage) WriteSummary(w io.Writer, lst *Listing) {
+	found, hit := 0, 0
+	brFound, brHit := 0, 0
+	missed := []string{}
+	for _, cl := range cov.lines(lst) {
+		text := strings.TrimRight(cl.Text, " ")
+		found++
+		if cl.hits > 0 {
+			hit++
+		} else {
+			missed = append(missed, fmt.Sprintf("%5d: %s  (never executed)", cl.Num, text))
+		}
+
+		if !cl.cond {
+			continue
+		}
+		brFound += 2
+		switch {
+		case cl.br == nil:
+		case cl.br.Taken == 0:
+			brHit++
+			missed = append(missed, fmt.Sprintf("%5d: %s  (never taken)", cl.Num, text))
+		case cl.br.NotTaken == 0:
+			brHit++
+			missed = append(missed, fmt.Sprintf("%5d: %s  (always taken)", cl.Num, text))
+		default:
+			brHit += 2
+		}
+	}
+
+	fmt.Fprintf(w, "instructions: %d/%d executed (%s)\n", hit, found, percent(hit, found))
+	fmt.Fprintf(w, "branches:     %d/%d outcomes (%s)\n", brHit, brFound, percent(brHit, brFound))
+	for _, ln := range missed {
+		fmt.Fprintln(w, ln)
+	}
+}
+
+func percent(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
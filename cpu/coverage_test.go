@@ -0,0 +1,104 @@
+package cpu
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// storeLoopListing is the listing of storeLoopProgram, with code never
+// executed after its STOP
+const storeLoopListing = `-------------------------------------------------------------------------------
+      Object
+Addr  code   Symbol   Mnemon  Operand     Comment
+-------------------------------------------------------------------------------
+0000  C00003          LDA     3,i
+0003  E10020 loop:    STA     0x0020,d
+0006  500078          CHARO   'x',i
+0009  800001          SUBA    1,i
+000C  0C0003          BRNE    loop,i
+000F  00              STOP
+0010  0A0000          BREQ    0,i
+0013                  .END
+-------------------------------------------------------------------------------
+`
+
+func storeLoopCoverage(t *testing.T) (*Coverage, *Listing) {
+	lst, err := ParseListing(strings.NewReader(storeLoopListing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cov := NewCoverage()
+	observe(storeLoopProgram, "", cov)
+	return cov, lst
+}
+
+func TestCoverage(t *testing.T) {
+	cov, _ := storeLoopCoverage(t)
+	for addr, want := range map[uint16]uint64{0x0000: 1, 0x0003: 3, 0x000C: 3, 0x000F: 1, 0x0010: 0} {
+		if cov.Hits[addr] != want {
+			t.Errorf("%d hits at %04x, want %d", cov.Hits[addr], addr, want)
+		}
+	}
+	if len(cov.Branches) != 1 || *cov.Branches[0x000C] != (Branch{Taken: 2, NotTaken: 1}) {
+		t.Errorf("branches %v, want BRNE taken twice and not once", cov.Branches)
+	}
+}
+
+func TestWriteLcov(t *testing.T) {
+	cov, lst := storeLoopCoverage(t)
+	out := &bytes.Buffer{}
+	if err := cov.WriteLcov(out, lst); err == nil {
+		t.Errorf("lcov written without a source file:\n%s", out)
+	}
+
+	// The source file is the listing, lines are its lines
+	path := filepath.Join(t.TempDir(), "loop.pepl")
+	if err := lst.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := os.ReadFile(path); err != nil || string(saved) != storeLoopListing {
+		t.Fatalf("saved listing %q, %v", saved, err)
+	}
+
+	out.Reset()
+	if err := cov.WriteLcov(out, lst); err != nil {
+		t.Fatal(err)
+	}
+	want := "TN:\nSF:" + path + `
+DA:5,1
+DA:6,3
+DA:7,3
+DA:8,3
+DA:9,3
+BRDA:9,0,0,2
+BRDA:9,0,1,1
+DA:10,1
+DA:11,0
+BRDA:11,0,0,-
+BRDA:11,0,1,-
+BRF:4
+BRH:2
+LF:7
+LH:6
+end_of_record
+`
+	if out.String() != want {
+		t.Errorf("lcov:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestCoverageSummary(t *testing.T) {
+	cov, lst := storeLoopCoverage(t)
+	out := &bytes.Buffer{}
+	cov.WriteSummary(out, lst)
+	want := `instructions: 6/7 executed (85.7%)
+branches:     2/4 outcomes (50.0%)
+   11: 0010  0A0000          BREQ    0,i  (never executed)
+`
+	if out.String() != want {
+		t.Errorf("summary:\n%s\nwant:\n%s", out, want)
+	}
+}
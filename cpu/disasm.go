@@ -0,0 +1,92 @@
+package cpu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Instruction is an instruction decoded from memory, without executing it
+type Instruction struct {
+	// Addr is the address of the instruction specifier in memory
+	Addr uint16
+	// Opcode is the instruction specifier
+	Opcode uint8
+	// BaseOp is the operation, regardless of register or addressing mode
+	BaseOp string
+	// Mnemonic is the instruction as written in a Pep/8 assembly source
+	Mnemonic string
+	// HasSpec is true when the instruction has an operand specifier
+	HasSpec bool
+	// Spec is the operand specifier, if any
+	Spec uint16
+	// Mode is the addressing mode of the operand, if any
+	Mode AddrMode
+	// Err is set when the addressing mode is invalid for the instruction
+	Err error
+}
+
+// Decode decodes the instruction at addr
+func (cpu *Pep8CPU) Decode(addr uint16) Instruction {
+	op := &decodeTable[cpu.RAM[addr]]
+	ins := Instruction{
+		Addr:     addr,
+		Opcode:   cpu.RAM[addr],
+		BaseOp:   op.base,
+		Mnemonic: op.mnemonic,
+		HasSpec:  op.length > 1,
+	}
+
+	if ins.HasSpec {
+		ins.Spec = cpu.peek16(addr + 1)
+		ins.Mode, ins.Err = op.mode, op.modeErr
+	}
+
+	return ins
+}
+
+// Len is the size in bytes of the instruction
+func (ins Instruction) Len() uint16 {
+	if ins.HasSpec {
+		return 3
+	}
+	return 1
+}
+
+// Next is the address of the instruction following this one in memory
+func (ins Instruction) Next() uint16 {
+	return ins.Addr + ins.Len()
+}
+
+// String returns the instruction in Pep/8 assembly form, e.g. `LDA 0x0009,d`
+func (ins Instruction) String() string {
+	if !ins.HasSpec {
+		return ins.Mnemonic
+	}
+	return fmt.Sprintf("%-7s 0x%04X,%s", ins.Mnemonic, ins.Spec, ins.Mode)
+}
+
+// Disassemble decodes the instructions in [start, end) as a listing, end
+// is clamped to the size of the memory, 0x10000 to decode it all
+//
+// Memory is decoded linearly, data within the range will be shown as
+// the instructions its bytes would decode to.
+func (cpu *Pep8CPU) Disassemble(start uint16, end int) *Listing {
+	if end > len(cpu.RAM) {
+		end = len(cpu.RAM)
+	}
+	text := strings.Builder{}
+	text.WriteString(listingHeader)
+	for addr := int(start); addr < end; {
+		ins := cpu.Decode(uint16(addr))
+		code := fmt.Sprintf("%02X", ins.Opcode)
+		if ins.HasSpec {
+			code += fmt.Sprintf("%04X", ins.Spec)
+		}
+		fmt.Fprintf(&text, "%04X  %-6s          %s\n", ins.Addr, code, ins)
+		addr += int(ins.Len())
+	}
+	text.WriteString(listingRule)
+
+	lst, _ := ParseListing(strings.NewReader(text.String()))
+	return lst
+}
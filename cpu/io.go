@@ -0,0 +1,111 @@
+package cpu
+
+import (
+	"bufio"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Encoding is how the characters output by a program are written
+type Encoding int
+
+const (
+	// EncodingRaw writes the bytes output by the program as they are
+	EncodingRaw Encoding = iota
+	// EncodingLatin1 reads the characters as Latin-1 and writes them UTF-8
+	// encoded, the bytes from 0x80 take two bytes
+	EncodingLatin1
+)
+
+// ParseEncoding parses an encoding name: raw or latin1
+func ParseEncoding(name string) (Encoding, error) {
+	switch name {
+	case "raw":
+		return EncodingRaw, nil
+	case "latin1":
+		return EncodingLatin1, nil
+	}
+	return EncodingRaw, fmt.Errorf("unknown encoding %q, expected raw or latin1", name)
+}
+
+func (enc Encoding) String() string {
+	if enc == EncodingLatin1 {
+		return "latin1"
+	}
+	return "raw"
+}
+
+// bufferIO buffers the input and output streams for a run, the returned
+// function flushes the output and restores the streams, it returns the
+// fault of the program, or else the error writing the output
+func (cpu *Pep8CPU) bufferIO() func() error {
+	in, out := cpu.In, cpu.Out
+	cpu.bout = bufio.NewWriter(out)
+	cpu.In = &flushingReader{r: bufio.NewReader(in), w: cpu.bout}
+	cpu.Out = cpu.bout
+	return func() error {
+		err := cpu.bout.Flush()
+		cpu.In, cpu.Out, cpu.bout = in, out, nil
+		if cpu.Fault != nil {
+			return cpu.Fault
+		}
+		if err != nil {
+			return fmt.Errorf("output error: %s", err)
+		}
+		return nil
+	}
+}
+
+// flushOutput writes the buffered output, during a run
+func (cpu *Pep8CPU) flushOutput() {
+	if cpu.bout != nil {
+		cpu.bout.Flush()
+	}
+}
+
+// flushingReader flushes the output before waiting for input, so that
+// interactive programs show their prompts
+type flushingReader struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (fr *flushingReader) Read(p []byte) (int, error) {
+	if fr.r.Buffered() == 0 {
+		fr.w.Flush()
+	}
+	return fr.r.Read(p)
+}
+
+// readChar consumes one byte from the input stream
+func (cpu *Pep8CPU) readChar() (byte, error) {
+	b, err := chari(cpu.In, cpu.inBuf[:])
+	if err != nil {
+		return b, err
+	}
+	for _, obs := range cpu.Observers {
+		obs.Input(cpu, b)
+	}
+	return b, nil
+}
+
+// output writes b to the output stream
+func (cpu *Pep8CPU) output(b []byte) {
+	cpu.Out.Write(b)
+	for _, obs := range cpu.Observers {
+		for idx := 0; idx < len(b); idx++ {
+			obs.Output(cpu, b[idx])
+		}
+	}
+}
+
+// outputChar writes a character to the output stream, in the encoding of
+// the cpu
+func (cpu *Pep8CPU) outputChar(chr byte) {
+	if cpu.Encoding == EncodingLatin1 && chr >= utf8.RuneSelf {
+		cpu.output(utf8.AppendRune(cpu.outBuf[:0], rune(chr)))
+		return
+	}
+	cpu.outBuf[0] = chr
+	cpu.output(cpu.outBuf[:1])
+}
@@ -0,0 +1,108 @@
+package cpu
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// helloProgram outputs "hé" one character at a time, then faults on a CHARI
+// without input
+var helloProgram = []byte{
+	0x50, 0x00, 0x68, // CHARO 'h',i
+	0x50, 0x00, 0xE9, // CHARO 0xE9,i
+	0x49, 0x00, 0x0A, // CHARI 0x000A,d
+	0x00, // STOP
+}
+
+// countingWriter counts the writes
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.writes++
+	return cw.Buffer.Write(p)
+}
+
+func TestOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		enc  Encoding
+		want string
+	}{
+		{"raw", EncodingRaw, "h\xE9"},
+		{"latin1", EncodingLatin1, "hé"},
+	} {
+		for _, run := range []struct {
+			name string
+			run  func(cpu *Pep8CPU) error
+		}{
+			{"Run", (*Pep8CPU).Run},
+			{"RunFast", (*Pep8CPU).RunFast},
+		} {
+			t.Run(tc.name+"/"+run.name, func(t *testing.T) {
+				cpu := NewPep8Cpu()
+				cpu.Load(helloProgram)
+				out := &countingWriter{}
+				cpu.In = strings.NewReader("")
+				cpu.Out = out
+				cpu.Encoding = tc.enc
+				if err := run.run(cpu); err == nil {
+					t.Fatal("no fault at the end of the input")
+				}
+				// The output is flushed at the fault, in a single write
+				if out.String() != tc.want {
+					t.Errorf("output %q, want %q", out.String(), tc.want)
+				}
+				if out.writes != 1 {
+					t.Errorf("output in %d writes, want 1", out.writes)
+				}
+				if cpu.Out != out {
+					t.Errorf("output stream not restored")
+				}
+			})
+		}
+	}
+}
+
+func TestOutputTraced(t *testing.T) {
+	cpu := NewPep8Cpu()
+	cpu.Load(helloProgram)
+	out := &bytes.Buffer{}
+	cpu.In = strings.NewReader("")
+	cpu.Out = out
+	cpu.Trace = true
+	cpu.TraceOut = out
+	cpu.Run()
+
+	// The output of an instruction comes before its trace line
+	lines := strings.SplitAfter(out.String(), "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "hPC = ") || !strings.HasPrefix(lines[1], "\xE9PC = ") {
+		t.Errorf("output and trace out of order:\n%s", out.String())
+	}
+}
+
+func TestOutputObserved(t *testing.T) {
+	for _, tc := range []struct {
+		interleave bool
+		writes     int
+	}{
+		// Observers alone do not flush the output after every instruction
+		{false, 1},
+		{true, 2},
+	} {
+		cpu := NewPep8Cpu()
+		cpu.Load(helloProgram)
+		out := &countingWriter{}
+		cpu.In = strings.NewReader("")
+		cpu.Out = out
+		cpu.Observers = []Observer{NopObserver{}}
+		cpu.Interleave = tc.interleave
+		cpu.Run()
+		if out.String() != "h\xE9" || out.writes != tc.writes {
+			t.Errorf("interleave %t: output %q in %d writes, want %d", tc.interleave, out.String(), out.writes, tc.writes)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package cpu
+
+import "fmt"
+
+// encoding is how the low bits of an opcode are used by an instruction
+type encoding int
+
+const (
+	// encNone is a single opcode, without operand
+	encNone encoding = iota
+	// encReg has the register in bit 0, e.g. NOTA and NOTX
+	encReg
+	// encBranch has the addressing mode in bit 0, i or x
+	encBranch
+	// encMode has the addressing mode in bits 0-2
+	encMode
+	// encRegMode has the register in bit 3 and the addressing mode in bits 0-2
+	encRegMode
+	// encNum2 has a number in bits 0-1, part of the mnemonic, e.g. NOP0
+	encNum2
+	// encNum3 has a number in bits 0-2, part of the mnemonic, e.g. RET0
+	encNum3
+)
+
+// count is the number of opcodes of an encoding
+func (enc encoding) count() int {
+	switch enc {
+	case encReg, encBranch:
+		return 2
+	case encNum2:
+		return 4
+	case encMode, encNum3:
+		return 8
+	case encRegMode:
+		return 16
+	}
+	return 1
+}
+
+// modeSet is a set of addressing modes, one bit per mode
+type modeSet uint8
+
+const (
+	allModes modeSet = 0xFF
+	// memModes are the modes of the operands in memory, for the
+	// instructions that need an address
+	memModes = allModes &^ (1 << i)
+	// strModes are the modes of STRO, whose operand is a string in memory
+	strModes modeSet = 1<<d | 1<<n | 1<<sf
+	// immModes only allows immediate operands
+	immModes modeSet = 1 << i
+)
+
+func (ms modeSet) has(am AddrMode) bool {
+	return ms&(1<<am) != 0
+}
+
+// operandClass is what an instruction does with its operand
+type operandClass int
+
+const (
+	// opNone has no operand specifier
+	opNone operandClass = iota
+	// opWord reads the word designated by the operand specifier
+	opWord
+	// opByte reads the byte designated by the operand specifier
+	opByte
+	// opAddr uses the address designated by the operand specifier, e.g. to
+	// store to it
+	opAddr
+)
+
+// isaOp describes a group of opcodes sharing an operation
+type isaOp struct {
+	// base is the operation, regardless of register or addressing mode
+	base string
+	// first is the first opcode of the group
+	first opcode
+	enc   encoding
+	// modes are the valid addressing modes, for the encodings with one
+	modes   modeSet
+	operand operandClass
+	// exec executes the instruction, nil for STOP which ends the program
+	exec func(cpu *Pep8CPU)
+}
+
+// isa is the Pep/8 instruction set, in the order of the opcodes
+var isa = []isaOp{
+	{"STOP", STOP, encNone, 0, opNone, nil},
+	{"RETTR", RETTR, encNone, 0, opNone, (*Pep8CPU).rettr},
+	{"MOVSPA", MOVSPA, encNone, 0, opNone, (*Pep8CPU).movspa},
+	{"MOVFLGA", MOVFLGA, encNone, 0, opNone, (*Pep8CPU).movflga},
+	{"BR", BRi, encBranch, allModes, opWord, (*Pep8CPU).br},
+	{"BRLE", BRLEi, encBranch, allModes, opWord, (*Pep8CPU).brle},
+	{"BRLT", BRLTi, encBranch, allModes, opWord, (*Pep8CPU).brlt},
+	{"BREQ", BREQi, encBranch, allModes, opWord, (*Pep8CPU).breq},
+	{"BRNE", BRNEi, encBranch, allModes, opWord, (*Pep8CPU).brne},
+	{"BRGE", BRGEi, encBranch, allModes, opWord, (*Pep8CPU).brge},
+	{"BRGT", BRGTi, encBranch, allModes, opWord, (*Pep8CPU).brgt},
+	{"BRV", BRVi, encBranch, allModes, opWord, (*Pep8CPU).brv},
+	{"BRC", BRCi, encBranch, allModes, opWord, (*Pep8CPU).brc},
+	{"CALL", CALLi, encBranch, allModes, opWord, (*Pep8CPU).call},
+	{"NOT", NOTA, encReg, 0, opNone, (*Pep8CPU).not},
+	{"NEG", NEGA, encReg, 0, opNone, (*Pep8CPU).neg},
+	{"ASL", ASLA, encReg, 0, opNone, (*Pep8CPU).asl},
+	{"ASR", ASRA, encReg, 0, opNone, (*Pep8CPU).asr},
+	{"ROL", ROLA, encReg, 0, opNone, (*Pep8CPU).rol},
+	{"ROR", RORA, encReg, 0, opNone, (*Pep8CPU).ror},
+	{"NOP", NOP0, encNum2, 0, opNone, (*Pep8CPU).nop},
+	{"NOP", NOPi, encMode, immModes, opWord, (*Pep8CPU).nop},
+	{"DECI", DECIi, encMode, memModes, opAddr, (*Pep8CPU).deci},
+	{"DECO", DECOi, encMode, allModes, opWord, (*Pep8CPU).deco},
+	{"STRO", STROi, encMode, strModes, opAddr, (*Pep8CPU).stro},
+	{"CHARI", CHARIi, encMode, memModes, opAddr, (*Pep8CPU).chari},
+	{"CHARO", CHAROi, encMode, allModes, opByte, (*Pep8CPU).charo},
+	{"RET", RET0, encNum3, 0, opNone, (*Pep8CPU).ret},
+	{"ADDSP", ADDSPi, encMode, allModes, opWord, (*Pep8CPU).addsp},
+	{"SUBSP", SUBSPi, encMode, allModes, opWord, (*Pep8CPU).subsp},
+	{"ADD", ADDAi, encRegMode, allModes, opWord, (*Pep8CPU).add},
+	{"SUB", SUBAi, encRegMode, allModes, opWord, (*Pep8CPU).sub},
+	{"AND", ANDAi, encRegMode, allModes, opWord, (*Pep8CPU).and},
+	{"OR", ORAi, encRegMode, allModes, opWord, (*Pep8CPU).or},
+	{"CP", CPAi, encRegMode, allModes, opWord, (*Pep8CPU).cp},
+	{"LD", LDAi, encRegMode, allModes, opWord, (*Pep8CPU).ld},
+	{"LDBYTE", LDBYTEAi, encRegMode, allModes, opByte, (*Pep8CPU).ldbyte},
+	{"ST", STAi, encRegMode, memModes, opAddr, (*Pep8CPU).st},
+	{"STBYTE", STBYTEAi, encRegMode, memModes, opAddr, (*Pep8CPU).stbyte},
+}
+
+// opInfo is an entry of the decode table, everything known about an opcode
+type opInfo struct {
+	base     string
+	mnemonic string
+	hasReg   bool
+	reg      register
+	hasMode  bool
+	mode     AddrMode
+	// modeErr is set when the addressing mode is invalid for the instruction
+	modeErr error
+	// length is the size in bytes of the instruction
+	length  uint16
+	operand operandClass
+	// jumps is true for the branches, CALL and RET, which may go elsewhere
+	// than the next instruction
+	jumps bool
+	exec  func(cpu *Pep8CPU)
+}
+
+// decodeTable is indexed by opcode, it is built from isa
+var decodeTable [256]opInfo
+
+func init() {
+	next := 0
+	for _, op := range isa {
+		if int(op.first) != next {
+			panic(fmt.Sprintf("isa: %s starts at opcode %d, expected %d", op.base, op.first, next))
+		}
+		for k := 0; k < op.enc.count(); k++ {
+			decodeTable[next] = op.decode(opcode(next))
+			next++
+		}
+	}
+	if next != len(decodeTable) {
+		panic(fmt.Sprintf("isa: %d opcodes declared, expected %d", next, len(decodeTable)))
+	}
+}
+
+// decode computes the decode table entry of an opcode of the group
+func (op isaOp) decode(oc opcode) opInfo {
+	info := opInfo{
+		base:     op.base,
+		mnemonic: op.base,
+		length:   1,
+		operand:  op.operand,
+		exec:     op.exec,
+	}
+
+	switch op.enc {
+	case encReg:
+		info.hasReg, info.reg = true, register(oc&0x1)
+	case encRegMode:
+		info.hasReg, info.reg = true, register((oc&0x8)>>3)
+	case encNum2:
+		info.mnemonic += fmt.Sprint(oc & 0x3)
+	case encNum3:
+		info.mnemonic += fmt.Sprint(oc & 0x7)
+		info.jumps = op.base == "RET"
+	}
+	if info.hasReg {
+		info.mnemonic += info.reg.String()
+	}
+
+	switch op.enc {
+	case encBranch:
+		info.hasMode, info.mode, info.jumps = true, i, true
+		if oc&0x1 != 0 {
+			info.mode = x
+		}
+	case encMode, encRegMode:
+		info.hasMode, info.mode = true, AddrMode(oc&0x7)
+	}
+	if info.hasMode {
+		info.length = 3
+		if !op.modes.has(info.mode) {
+			info.modeErr = fmt.Errorf("invalid addressing mode %s for %s", info.mode, op.base)
+		}
+	}
+
+	return info
+}
+
+// BaseOp is the operation of the opcode, regardless of register or
+// addressing mode
+func (oc opcode) BaseOp() string {
+	return decodeTable[oc].base
+}
+
+func (oc opcode) register() register {
+	return decodeTable[oc].reg
+}
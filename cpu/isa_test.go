@@ -0,0 +1,104 @@
+package cpu
+
+import (
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	for _, tc := range []struct {
+		code    []byte
+		base    string
+		str     string
+		invalid bool
+	}{
+		{[]byte{0x00}, "STOP", "STOP", false},
+		{[]byte{0x03}, "MOVFLGA", "MOVFLGA", false},
+		{[]byte{0x04, 0x00, 0x10}, "BR", "BR      0x0010,i", false},
+		{[]byte{0x05, 0x00, 0x10}, "BR", "BR      0x0010,x", false},
+		{[]byte{0x17, 0xAB, 0xCD}, "CALL", "CALL    0xABCD,x", false},
+		{[]byte{0x19}, "NOT", "NOTX", false},
+		{[]byte{0x1E}, "ASR", "ASRA", false},
+		{[]byte{0x27}, "NOP", "NOP3", false},
+		{[]byte{0x28, 0x00, 0x01}, "NOP", "NOP     0x0001,i", false},
+		{[]byte{0x29, 0x00, 0x01}, "NOP", "NOP     0x0001,d", true},
+		{[]byte{0x30, 0x00, 0x01}, "DECI", "DECI    0x0001,i", true},
+		{[]byte{0x37, 0x00, 0x01}, "DECI", "DECI    0x0001,sxf", false},
+		{[]byte{0x40, 0x00, 0x01}, "STRO", "STRO    0x0001,i", true},
+		{[]byte{0x41, 0x00, 0x01}, "STRO", "STRO    0x0001,d", false},
+		{[]byte{0x43, 0x00, 0x01}, "STRO", "STRO    0x0001,s", true},
+		{[]byte{0x44, 0x00, 0x01}, "STRO", "STRO    0x0001,sf", false},
+		{[]byte{0x50, 0x00, 0x41}, "CHARO", "CHARO   0x0041,i", false},
+		{[]byte{0x58}, "RET", "RET0", false},
+		{[]byte{0x5F}, "RET", "RET7", false},
+		{[]byte{0x60, 0x00, 0x02}, "ADDSP", "ADDSP   0x0002,i", false},
+		{[]byte{0x7E, 0x00, 0x02}, "ADD", "ADDX    0x0002,sx", false},
+		{[]byte{0xC0, 0x00, 0x02}, "LD", "LDA     0x0002,i", false},
+		{[]byte{0xD9, 0x00, 0x02}, "LDBYTE", "LDBYTEX 0x0002,d", false},
+		{[]byte{0xE0, 0x00, 0x02}, "ST", "STA     0x0002,i", true},
+		{[]byte{0xFF, 0x00, 0x02}, "STBYTE", "STBYTEX 0x0002,sxf", false},
+	} {
+		cpu := NewPep8Cpu()
+		copy(cpu.RAM[0x0100:], tc.code)
+		ins := cpu.Decode(0x0100)
+		if ins.BaseOp != tc.base || ins.String() != tc.str || (ins.Err != nil) != tc.invalid {
+			t.Errorf("% x decoded as %s %q, error %v, want %s %q, invalid %t",
+				tc.code, ins.BaseOp, ins, ins.Err, tc.base, tc.str, tc.invalid)
+		}
+		if ins.Len() != uint16(len(tc.code)) || ins.Next() != 0x0100+uint16(len(tc.code)) {
+			t.Errorf("% x decoded as %d bytes", tc.code, ins.Len())
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	// Every opcode, with its operand specifier if any, disassembles to a
+	// listing line of the same object code
+	cpu := NewPep8Cpu()
+	addr := 0
+	for oc := 0; oc < 256; oc++ {
+		cpu.RAM[addr] = byte(oc)
+		addr++
+		if decodeTable[oc].length == 3 {
+			cpu.RAM[addr], cpu.RAM[addr+1] = byte(oc), 0x5A
+			addr += 2
+		}
+	}
+
+	lst := cpu.Disassemble(0, addr)
+	oc := 0
+	for _, ll := range lst.Lines {
+		if !ll.HasAddr {
+			continue
+		}
+		if oc == 256 {
+			t.Fatalf("line %d past the last opcode: %q", ll.Num, ll.Text)
+		}
+		ins := cpu.Decode(ll.Addr)
+		if int(ins.Opcode) != oc || string(ll.Code) != string(cpu.RAM[ll.Addr:ins.Next()]) || ll.Mnemonic != ins.Mnemonic {
+			t.Errorf("line %d %q, want opcode %02x", ll.Num, ll.Text, oc)
+		}
+		if num, ok := lst.LineAt(ll.Addr); !ok || num != ll.Num {
+			t.Errorf("line of %04x: %d, want %d", ll.Addr, num, ll.Num)
+		}
+		oc++
+	}
+	if oc != 256 {
+		t.Errorf("%d opcodes disassembled, want 256", oc)
+	}
+}
+
+func TestDisassembleAll(t *testing.T) {
+	// A program filling the memory is decoded to its last byte, as STOPs
+	cpu := NewPep8Cpu()
+	for _, end := range []int{0x10000, 0x10001} {
+		count := 0
+		for _, ll := range cpu.Disassemble(0, end).Lines {
+			if ll.HasAddr {
+				count++
+			}
+		}
+		if count != 0x10000 {
+			t.Errorf("Disassemble(0, %#x): %d instructions, want 0x10000", end, count)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package cpu
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const listingRule = "-------------------------------------------------------------------------------\n"
+
+const listingHeader = listingRule +
+	"      Object\n" +
+	"Addr  code   Symbol   Mnemon  Operand     Comment\n" +
+	listingRule
+
+// ListingLine is one line of an assembler listing
+type ListingLine struct {
+	// Num is the line number in the listing, starting at 1
+	Num int
+	// Text is the line as found in the listing
+	Text string
+	// HasAddr is true if the line is attached to an address in memory
+	HasAddr bool
+	// Addr is the address of the first byte of object code for the line
+	Addr uint16
+	// Code is the object code produced by the line
+	Code []byte
+	// Symbol is the symbol defined on the line, without the trailing ':'
+	Symbol string
+	// Mnemonic is the instruction or dot command on the line
+	Mnemonic string
+	// Operand is the operand of the instruction or dot command
+	Operand string
+	// Comment is the comment on the line, without the leading ';'
+	Comment string
+}
+
+// IsInstruction is true when the line assembles to an instruction
+func (ll ListingLine) IsInstruction() bool {
+	return ll.HasAddr && ll.Mnemonic != "" && !strings.HasPrefix(ll.Mnemonic, ".")
+}
+
+// Listing is an assembler listing, as produced by the Pep/8 assembler
+//
+// It is used as a source map between the memory addresses of a program
+// and the lines of its source, and as a symbol table.
+type Listing struct {
+	// Lines are all the lines of the listing, including headers
+	Lines []ListingLine
+	// Symbols maps every symbol defined on an addressed line to its address
+	Symbols map[string]uint16
+	// Path is the file the listing was loaded from, if any
+	Path string
+
+	byAddr  map[uint16]int
+	symbols []ListingLine
+}
+
+// LoadListing reads an assembler listing from a file
+func LoadListing(path string) (*Listing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lst, err := ParseListing(f)
+	if err != nil {
+		return nil, err
+	}
+	lst.Path = path
+	return lst, nil
+}
+
+// Save writes the listing to a file, which becomes its Path
+func (lst *Listing) Save(path string) error {
+	text := strings.Builder{}
+	for _, ll := range lst.Lines {
+		text.WriteString(ll.Text)
+		text.WriteByte('\n')
+	}
+	if err := os.WriteFile(path, []byte(text.String()), 0644); err != nil {
+		return err
+	}
+	lst.Path = path
+	return nil
+}
+
+// ParseListing reads an assembler listing
+func ParseListing(r io.Reader) (*Listing, error) {
+	lst := &Listing{
+		Symbols: map[string]uint16{},
+		byAddr:  map[uint16]int{},
+	}
+
+	scan := bufio.NewScanner(r)
+	num := 0
+	for scan.Scan() {
+		num++
+		ll := parseListingLine(scan.Text())
+		ll.Num = num
+		lst.Lines = append(lst.Lines, ll)
+
+		if !ll.HasAddr {
+			continue
+		}
+		if ll.IsInstruction() {
+			lst.byAddr[ll.Addr] = num
+		}
+		if ll.Symbol != "" {
+			lst.Symbols[ll.Symbol] = ll.Addr
+			lst.symbols = append(lst.symbols, ll)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(lst.symbols, func(i, j int) bool {
+		return lst.symbols[i].Addr < lst.symbols[j].Addr
+	})
+
+	return lst, nil
+}
+
+func parseListingLine(text string) ListingLine {
+	ll := ListingLine{Text: text}
+
+	if len(text) < 4 || (len(text) > 4 && text[4] != ' ') {
+		return ll
+	}
+	addr, err := strconv.ParseUint(text[:4], 16, 16)
+	if err != nil {
+		return ll
+	}
+	ll.HasAddr = true
+	ll.Addr = uint16(addr)
+
+	rest, comment := splitComment(text[4:])
+	ll.Comment = comment
+
+	fields := strings.Fields(rest)
+	if len(fields) > 0 && isObjectCode(fields[0]) {
+		ll.Code, _ = hex.DecodeString(fields[0])
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+		ll.Symbol = strings.TrimSuffix(fields[0], ":")
+		fields = fields[1:]
+	}
+	if len(fields) > 0 {
+		ll.Mnemonic = fields[0]
+		ll.Operand = strings.Join(fields[1:], " ")
+	}
+
+	return ll
+}
+
+// splitComment splits a line on the first ';' that is not within quotes
+func splitComment(text string) (string, string) {
+	var quote byte
+	escaped := false
+	for pos := 0; pos < len(text); pos++ {
+		c := text[pos]
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && c == '\\':
+			escaped = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ';':
+			return text[:pos], strings.TrimSpace(text[pos+1:])
+		}
+	}
+	return text, ""
+}
+
+func isObjectCode(field string) bool {
+	if len(field) == 0 || len(field) > 6 || len(field)%2 != 0 {
+		return false
+	}
+	_, err := hex.DecodeString(field)
+	return err == nil
+}
+
+// LineAt returns the line number of the instruction at addr
+func (lst *Listing) LineAt(addr uint16) (int, bool) {
+	num, ok := lst.byAddr[addr]
+	return num, ok
+}
+
+// InstructionAt returns the first instruction at or after line num
+//
+// This is where a breakpoint set on line num will be placed
+func (lst *Listing) InstructionAt(num int) (ListingLine, bool) {
+	if num < 1 {
+		num = 1
+	}
+	for ; num <= len(lst.Lines); num++ {
+		ll := lst.Lines[num-1]
+		if ll.IsInstruction() {
+			return ll, true
+		}
+	}
+	return ListingLine{}, false
+}
+
+// SymbolAt returns the symbol defined exactly at addr, if any
+func (lst *Listing) SymbolAt(addr uint16) (string, bool) {
+	for _, ll := range lst.symbols {
+		if ll.Addr == addr {
+			return ll.Symbol, true
+		}
+	}
+	return "", false
+}
+
+// Symbolize returns addr as the closest symbol before it and an offset,
+// e.g. `tab+4`, or as a hex address if no symbol precedes it
+func (lst *Listing) Symbolize(addr uint16) string {
+	idx := sort.Search(len(lst.symbols), func(i int) bool {
+		return lst.symbols[i].Addr > addr
+	})
+	if idx == 0 {
+		return fmt.Sprintf("0x%04x", addr)
+	}
+
+	ll := lst.symbols[idx-1]
+	if ll.Addr == addr {
+		return ll.Symbol
+	}
+	return ll.Symbol + "+" + strconv.Itoa(int(addr-ll.Addr))
+}
@@ -0,0 +1,110 @@
+package cpu
+
+import (
+	"strings"
+	"testing"
+)
+
+// testListing is a listing as written by the Pep/8 assembler
+const testListing = `-------------------------------------------------------------------------------
+      Object
+Addr  code   Symbol   Mnemon  Operand     Comment
+-------------------------------------------------------------------------------
+0000  04000A          BR      main        ;skip the data
+0003  0000   n:       .WORD   0
+0005  613B00 msg:     .ASCII  "a;\"\x00"  ;a ; in quotes
+             ;a line with only a comment
+000A  310003 main:    DECI    n,d
+000D  00              STOP
+000E                  .END
+-------------------------------------------------------------------------------
+`
+
+func TestParseListing(t *testing.T) {
+	lst, err := ParseListing(strings.NewReader(testListing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lst.Lines) != 12 {
+		t.Fatalf("%d lines, want 12", len(lst.Lines))
+	}
+
+	for _, tc := range []struct {
+		num      int
+		hasAddr  bool
+		addr     uint16
+		code     string
+		symbol   string
+		mnemonic string
+		operand  string
+		comment  string
+		isIns    bool
+	}{
+		{3, false, 0, "", "", "", "", "", false},
+		{5, true, 0x0000, "\x04\x00\x0A", "", "BR", "main", "skip the data", true},
+		{6, true, 0x0003, "\x00\x00", "n", ".WORD", "0", "", false},
+		{7, true, 0x0005, "a;\x00", "msg", ".ASCII", `"a;\"\x00"`, "a ; in quotes", false},
+		{8, false, 0, "", "", "", "", "", false},
+		{9, true, 0x000A, "\x31\x00\x03", "main", "DECI", "n,d", "", true},
+		{10, true, 0x000D, "\x00", "", "STOP", "", "", true},
+		{11, true, 0x000E, "", "", ".END", "", "", false},
+	} {
+		ll := lst.Lines[tc.num-1]
+		if ll.Num != tc.num || ll.HasAddr != tc.hasAddr || ll.Addr != tc.addr || string(ll.Code) != tc.code ||
+			ll.Symbol != tc.symbol || ll.Mnemonic != tc.mnemonic || ll.Operand != tc.operand ||
+			ll.Comment != tc.comment || ll.IsInstruction() != tc.isIns {
+			t.Errorf("line %d parsed as %+v", tc.num, ll)
+		}
+	}
+
+	if len(lst.Symbols) != 3 || lst.Symbols["n"] != 0x0003 || lst.Symbols["msg"] != 0x0005 || lst.Symbols["main"] != 0x000A {
+		t.Errorf("symbols %v", lst.Symbols)
+	}
+}
+
+func TestListingLookups(t *testing.T) {
+	lst, err := ParseListing(strings.NewReader(testListing))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, want := range map[uint16]int{0x0000: 5, 0x000A: 9, 0x000D: 10} {
+		if num, ok := lst.LineAt(addr); !ok || num != want {
+			t.Errorf("LineAt(%04x) = %d, %t, want %d", addr, num, ok, want)
+		}
+	}
+	// Data is not code
+	if num, ok := lst.LineAt(0x0003); ok {
+		t.Errorf("LineAt(0003) = %d, want none", num)
+	}
+
+	// Breakpoints move to the next instruction
+	for num, want := range map[int]uint16{-1: 0x0000, 5: 0x0000, 6: 0x000A, 8: 0x000A, 10: 0x000D} {
+		if ll, ok := lst.InstructionAt(num); !ok || ll.Addr != want {
+			t.Errorf("InstructionAt(%d) = %04x, %t, want %04x", num, ll.Addr, ok, want)
+		}
+	}
+	if ll, ok := lst.InstructionAt(11); ok {
+		t.Errorf("InstructionAt(11) = line %d, want none", ll.Num)
+	}
+
+	if sym, ok := lst.SymbolAt(0x000A); !ok || sym != "main" {
+		t.Errorf("SymbolAt(000a) = %q, %t, want main", sym, ok)
+	}
+	if sym, ok := lst.SymbolAt(0x0004); ok {
+		t.Errorf("SymbolAt(0004) = %q, want none", sym)
+	}
+
+	for addr, want := range map[uint16]string{
+		0x0000: "0x0000",
+		0x0003: "n",
+		0x0004: "n+1",
+		0x0008: "msg+3",
+		0x000D: "main+3",
+		0xFFFF: "main+65525",
+	} {
+		if got := lst.Symbolize(addr); got != want {
+			t.Errorf("Symbolize(%04x) = %q, want %q", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package cpu
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MemChange is a range of consecutive bytes that changed between two
+// snapshots of the memory
+type MemChange struct {
+	AddrRange
+	Old, New []byte
+}
+
+// Snapshot returns a copy of the memory
+func (cpu *Pep8CPU) Snapshot() []byte {
+	snap := make([]byte, len(cpu.RAM))
+	copy(snap, cpu.RAM)
+	return snap
+}
+
+// DiffMemory compares two snapshots of the memory, within the ranges, or
+// all of it if there are none
+func DiffMemory(old, new []byte, ranges []AddrRange) []MemChange {
+	if len(ranges) == 0 {
+		ranges = []AddrRange{{0, 0xFFFF}}
+	}
+
+	changes := []MemChange{}
+	for _, ar := range ranges {
+		start := -1
+		for addr := int(ar.Lo); addr <= int(ar.Hi)+1; addr++ {
+			differ := addr <= int(ar.Hi) && old[addr] != new[addr]
+			switch {
+			case differ && start < 0:
+				start = addr
+			case !differ && start >= 0:
+				changes = append(changes, MemChange{
+					AddrRange: AddrRange{uint16(start), uint16(addr - 1)},
+					Old:       append([]byte{}, old[start:addr]...),
+					New:       append([]byte{}, new[start:addr]...),
+				})
+				start = -1
+			}
+		}
+	}
+	return changes
+}
+
+// WriteMemDiff writes the changes to w, as words and characters, labelled
+// with the symbols of lst, which may be nil
+func WriteMemDiff(w io.Writer, changes []MemChange, lst *Listing) {
+	for _, mc := range changes {
+		label := fmt.Sprintf("%04x", mc.Lo)
+		if mc.Hi != mc.Lo {
+			label += fmt.Sprintf("-%04x", mc.Hi)
+		}
+		if sym, ok := dataSymbol(lst, mc.Lo); ok {
+			label += " " + sym
+		}
+
+		fmt.Fprintf(w, "%s (%d bytes)\n", label, len(mc.Old))
+		fmt.Fprintf(w, "  old: %s\n", memValues(mc.Old))
+		fmt.Fprintf(w, "  new: %s\n", memValues(mc.New))
+	}
+}
+
+// dataSymbol names addr after the symbol of the line whose object code
+// contains it, addresses out of the program such as the stack have none
+func dataSymbol(lst *Listing, addr uint16) (string, bool) {
+	if lst == nil {
+		return "", false
+	}
+	for _, ll := range lst.symbols {
+		if addr >= ll.Addr && int(addr) < int(ll.Addr)+len(ll.Code) {
+			return lst.Symbolize(addr), true
+		}
+	}
+	return "", false
+}
+
+// memValues shows bytes as words in hexadecimal and signed decimal, and as
+// characters
+func memValues(b []byte) string {
+	sb := strings.Builder{}
+	for idx := 0; idx < len(b); idx += 2 {
+		if idx+1 < len(b) {
+			word := uint16(b[idx])<<8 | uint16(b[idx+1])
+			fmt.Fprintf(&sb, "%04x (%d) ", word, int16(word))
+		} else {
+			fmt.Fprintf(&sb, "%02x (%d) ", b[idx], b[idx])
+		}
+	}
+
+	sb.WriteByte('"')
+	for _, c := range b {
+		if c >= ' ' && c < 0x7f {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteByte('.')
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// CallDiffer is an Observer that compares the memory before and after
+// every subroutine call, to see what a subroutine modified
+type CallDiffer struct {
+	NopObserver
+
+	// Ranges limits the comparison, all the memory is compared if empty
+	Ranges []AddrRange
+	// OnReturn is called when a subroutine returns, with the frame of the
+	// call and the changes since the CALL, the pushed return address aside
+	OnReturn func(fr Frame, changes []MemChange)
+
+	calls CallStack
+	snaps [][]byte
+}
+
+func (cd *CallDiffer) Call(cpu *Pep8CPU, site, target, sp uint16) {
+	cd.calls.Call(cpu, site, target, sp)
+	cd.snaps = append(cd.snaps, cpu.Snapshot())
+}
+
+func (cd *CallDiffer) Return(cpu *Pep8CPU, site, target, sp uint16) {
+	frames := cd.calls.Frames
+	cd.calls.Return(cpu, site, target, sp)
+
+	// A mismatched RET may return from several frames at once, the diff
+	// is from the outermost one
+	n := len(cd.calls.Frames)
+	if n == len(frames) {
+		return
+	}
+	snap := cd.snaps[n]
+	cd.snaps = cd.snaps[:n]
+	if cd.OnReturn != nil {
+		cd.OnReturn(frames[n], DiffMemory(snap, cpu.RAM, cd.Ranges))
+	}
+}
@@ -0,0 +1,90 @@
+package cpu
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDiffMemory(t *testing.T) {
+	old := make([]byte, 0x10000)
+	new := make([]byte, 0x10000)
+	new[0x0000] = 1
+	copy(new[0x0010:], "abc")
+	new[0x0014] = 2
+	new[0xFFFE], new[0xFFFF] = 0xFF, 0xFE
+
+	for _, tc := range []struct {
+		name   string
+		ranges []AddrRange
+		want   string
+	}{
+		{"all", nil, "0000-0000 [0]->[1] 0010-0012 [0 0 0]->[97 98 99] 0014-0014 [0]->[2] fffe-ffff [0 0]->[255 254]"},
+		// A change is cut at the bounds of the ranges
+		{"ranges", []AddrRange{{0x0011, 0x0014}, {0xFFFF, 0xFFFF}}, "0011-0012 [0 0]->[98 99] 0014-0014 [0]->[2] ffff-ffff [0]->[254]"},
+		{"unchanged", []AddrRange{{0x0001, 0x000F}}, ""},
+	} {
+		descs := []string{}
+		for _, mc := range DiffMemory(old, new, tc.ranges) {
+			descs = append(descs, fmt.Sprintf("%s %v->%v", mc.AddrRange, mc.Old, mc.New))
+		}
+		if got := strings.Join(descs, " "); got != tc.want {
+			t.Errorf("%s: changes %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWriteMemDiff(t *testing.T) {
+	lst, err := ParseListing(strings.NewReader(testListing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := []MemChange{
+		{AddrRange{0x0003, 0x0004}, []byte{0x00, 0x00}, []byte{0xFF, 0xFE}},
+		{AddrRange{0x0006, 0x0008}, []byte("a;\""), []byte("xyz")},
+		// The stack has no symbol
+		{AddrRange{0xFFFD, 0xFFFD}, []byte{0x00}, []byte{0x80}},
+	}
+	out := &bytes.Buffer{}
+	WriteMemDiff(out, changes, lst)
+	want := `0003-0004 n (2 bytes)
+  old: 0000 (0) ".."
+  new: fffe (-2) ".."
+0006-0008 msg+1 (3 bytes)
+  old: 613b (24891) 22 (34) "a;""
+  new: 7879 (30841) 7a (122) "xyz"
+fffd (1 bytes)
+  old: 00 (0) "."
+  new: 80 (128) "."
+`
+	if out.String() != want {
+		t.Errorf("diff:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestCallDiffer(t *testing.T) {
+	returns := []string{}
+	cd := &CallDiffer{OnReturn: func(fr Frame, changes []MemChange) {
+		desc := fmt.Sprintf("%04x:", fr.Callee)
+		for _, mc := range changes {
+			desc += fmt.Sprintf(" %s %q", mc.AddrRange, mc.New)
+		}
+		returns = append(returns, desc)
+	}}
+	// sub reads a character to 0x0010, the return address pushed by the
+	// CALL is not a change of sub
+	observe(callProgram, "z", cd)
+	if want := `0007: 0010-0010 "z"`; len(returns) != 1 || returns[0] != want {
+		t.Errorf("returns %q, want %q", returns, want)
+	}
+
+	// inner stores 0x0003 to its local, whose high byte was already 0, and
+	// returns without releasing it, from its own frame only
+	returns = returns[:0]
+	cd = &CallDiffer{OnReturn: cd.OnReturn}
+	observe(leakProgram, "", cd)
+	if want := `0008: fffa-fffa "\x03"`; len(returns) != 1 || returns[0] != want {
+		t.Errorf("returns %q, want %q", returns, want)
+	}
+}
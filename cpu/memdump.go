@@ -0,0 +1,107 @@
+package cpu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// DumpFormat is the format of a memory dump
+type DumpFormat int
+
+const (
+	// DumpHex shows bytes in hexadecimal and ASCII, as the Pep/8 memory pane
+	DumpHex DumpFormat = iota
+	// DumpSigned shows words as signed decimals
+	DumpSigned
+	// DumpUnsigned shows words as unsigned decimals
+	DumpUnsigned
+	// DumpRaw writes the bytes as they are
+	DumpRaw
+)
+
+// ParseDumpFormat parses a format name: hex, signed, unsigned or raw
+func ParseDumpFormat(name string) (DumpFormat, error) {
+	switch name {
+	case "hex":
+		return DumpHex, nil
+	case "signed":
+		return DumpSigned, nil
+	case "unsigned":
+		return DumpUnsigned, nil
+	case "raw":
+		return DumpRaw, nil
+	}
+	return DumpHex, fmt.Errorf("unknown dump format %q, expected hex, signed, unsigned or raw", name)
+}
+
+// Number of bytes shown per row by the hex dump, and of words by the
+// decimal dumps
+const (
+	dumpBytesPerRow = 8
+	dumpWordsPerRow = 8
+)
+
+// DumpMemory writes the memory in the ranges to w, all of it if there are
+// no ranges
+//
+// Rows start at the beginning of each range, words are read from the start
+// of the range, a trailing odd byte is read as the high byte of a word.
+func (cpu *Pep8CPU) DumpMemory(w io.Writer, ranges []AddrRange, format DumpFormat) error {
+	if len(ranges) == 0 {
+		ranges = []AddrRange{{0, 0xFFFF}}
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, ar := range ranges {
+		switch format {
+		case DumpHex:
+			cpu.dumpHex(bw, ar)
+		case DumpSigned, DumpUnsigned:
+			cpu.dumpWords(bw, ar, format == DumpSigned)
+		case DumpRaw:
+			bw.Write(cpu.RAM[ar.Lo : int(ar.Hi)+1])
+		}
+	}
+	return bw.Flush()
+}
+
+func (cpu *Pep8CPU) dumpHex(w io.Writer, ar AddrRange) {
+	for row := int(ar.Lo); row <= int(ar.Hi); row += dumpBytesPerRow {
+		hex := make([]byte, 0, dumpBytesPerRow*3)
+		ascii := make([]byte, 0, dumpBytesPerRow)
+		for addr := row; addr < row+dumpBytesPerRow; addr++ {
+			if addr > int(ar.Hi) {
+				hex = append(hex, "   "...)
+				continue
+			}
+			b := cpu.RAM[addr]
+			hex = append(hex, fmt.Sprintf(" %02x", b)...)
+			if b >= ' ' && b < 0x7f {
+				ascii = append(ascii, b)
+			} else {
+				ascii = append(ascii, '.')
+			}
+		}
+		fmt.Fprintf(w, "%04x |%s | %s\n", row, hex, ascii)
+	}
+}
+
+func (cpu *Pep8CPU) dumpWords(w io.Writer, ar AddrRange, signed bool) {
+	rowBytes := 2 * dumpWordsPerRow
+	for row := int(ar.Lo); row <= int(ar.Hi); row += rowBytes {
+		fmt.Fprintf(w, "%04x |", row)
+		for addr := row; addr < row+rowBytes && addr <= int(ar.Hi); addr += 2 {
+			word := uint16(cpu.RAM[addr]) << 8
+			if addr < int(ar.Hi) {
+				word |= uint16(cpu.RAM[addr+1])
+			}
+			if signed {
+				fmt.Fprintf(w, " %6d", int16(word))
+			} else {
+				fmt.Fprintf(w, " %5d", word)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
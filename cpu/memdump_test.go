@@ -0,0 +1,72 @@
+package cpu
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseDumpFormat(t *testing.T) {
+	for name, want := range map[string]DumpFormat{"hex": DumpHex, "signed": DumpSigned, "unsigned": DumpUnsigned, "raw": DumpRaw} {
+		if got, err := ParseDumpFormat(name); err != nil || got != want {
+			t.Errorf("ParseDumpFormat(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseDumpFormat("octal"); err == nil {
+		t.Errorf("unknown format accepted")
+	}
+}
+
+func TestDumpMemory(t *testing.T) {
+	cpu := NewPep8Cpu()
+	copy(cpu.RAM[0x0010:], "Hello, W\x00\xff\x80")
+	cpu.RAM[0xFFFF] = 0x41
+
+	for _, tc := range []struct {
+		name   string
+		ranges []AddrRange
+		format DumpFormat
+		want   string
+	}{
+		{"hex", []AddrRange{{0x0010, 0x001A}}, DumpHex,
+			"0010 | 48 65 6c 6c 6f 2c 20 57 | Hello, W\n" +
+				"0018 | 00 ff 80                | ...\n"},
+		// Rows start at the beginning of the range
+		{"hex unaligned", []AddrRange{{0x0013, 0x0014}, {0xFFFF, 0xFFFF}}, DumpHex,
+			"0013 | 6c 6f                   | lo\n" +
+				"ffff | 41                      | A\n"},
+		// A trailing odd byte is the high byte of a word
+		{"unsigned", []AddrRange{{0x0010, 0x0014}}, DumpUnsigned,
+			"0010 | 18533 27756 28416\n"},
+		{"signed", []AddrRange{{0x0019, 0x001A}, {0xFFFF, 0xFFFF}}, DumpSigned,
+			"0019 |   -128\n" +
+				"ffff |  16640\n"},
+		{"rows of words", []AddrRange{{0x0010, 0x0021}}, DumpUnsigned,
+			"0010 | 18533 27756 28460  8279   255 32768     0     0\n" +
+				"0020 |     0\n"},
+		{"raw", []AddrRange{{0x0010, 0x0014}, {0x001A, 0x001A}}, DumpRaw, "Hello\x80"},
+	} {
+		out := &bytes.Buffer{}
+		if err := cpu.DumpMemory(out, tc.ranges, tc.format); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tc.want {
+			t.Errorf("%s dump:\n%q\nwant:\n%q", tc.name, out, tc.want)
+		}
+	}
+
+	// Without ranges, all the memory is dumped
+	out := &bytes.Buffer{}
+	if err := cpu.DumpMemory(out, nil, DumpHex); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 0x10000/8 || !strings.HasPrefix(lines[len(lines)-1], "fff8 |") {
+		t.Errorf("full dump of %d lines, ending with %q", len(lines), lines[len(lines)-1])
+	}
+	out.Reset()
+	cpu.DumpMemory(out, nil, DumpRaw)
+	if !bytes.Equal(out.Bytes(), cpu.RAM) {
+		t.Errorf("raw dump of %d bytes, not the memory", out.Len())
+	}
+}
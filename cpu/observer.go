@@ -0,0 +1,42 @@
+package cpu
+
+// Observer is notified of everything a program does while it runs
+//
+// Observers are registered in Pep8CPU.Observers, they are called in order,
+// synchronously, from DoNextCycle. They must not modify the cpu.
+type Observer interface {
+	// BeforeInstruction is called once an instruction is fetched, before
+	// its operand is read and it executes
+	BeforeInstruction(cpu *Pep8CPU, ins Instruction)
+	// AfterInstruction is called once an instruction executed, including
+	// STOP and an instruction that faulted, cpu.Fault is then set
+	AfterInstruction(cpu *Pep8CPU, ins Instruction)
+	// MemoryRead is called on every read of size 1 or 2 bytes done by an
+	// instruction, instruction fetches are not reported
+	MemoryRead(cpu *Pep8CPU, addr uint16, size int, val uint16)
+	// MemoryWrite is called on every write of size 1 or 2 bytes
+	MemoryWrite(cpu *Pep8CPU, addr uint16, size int, val uint16)
+	// Input is called for every byte consumed from the input stream
+	Input(cpu *Pep8CPU, b byte)
+	// Output is called for every byte written to the output stream
+	Output(cpu *Pep8CPU, b byte)
+	// Call is called when a CALL at site jumps to target, sp points to the
+	// return address just pushed
+	Call(cpu *Pep8CPU, site, target, sp uint16)
+	// Return is called when a RET at site returns to target, sp is the
+	// stack pointer after the return address was popped
+	Return(cpu *Pep8CPU, site, target, sp uint16)
+}
+
+// NopObserver implements Observer with methods that do nothing, it can be
+// embedded by observers that care only about some events
+type NopObserver struct{}
+
+func (NopObserver) BeforeInstruction(cpu *Pep8CPU, ins Instruction)             {}
+func (NopObserver) AfterInstruction(cpu *Pep8CPU, ins Instruction)              {}
+func (NopObserver) MemoryRead(cpu *Pep8CPU, addr uint16, size int, val uint16)  {}
+func (NopObserver) MemoryWrite(cpu *Pep8CPU, addr uint16, size int, val uint16) {}
+func (NopObserver) Input(cpu *Pep8CPU, b byte)                                  {}
+func (NopObserver) Output(cpu *Pep8CPU, b byte)                                 {}
+func (NopObserver) Call(cpu *Pep8CPU, site, target, sp uint16)                  {}
+func (NopObserver) Return(cpu *Pep8CPU, site, target, sp uint16)                {}
@@ -0,0 +1,110 @@
+package cpu
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// callProgram calls a subroutine that reads a character into a global, and
+// outputs another one once back
+var callProgram = []byte{
+	0x16, 0x00, 0x07, // 0000 CALL sub,i
+	0x50, 0x00, 0x41, // 0003 CHARO 'A',i
+	0x00,             // 0006 STOP
+	0x49, 0x00, 0x10, // 0007 sub: CHARI 0x0010,d
+	0x58, // 000A RET0
+}
+
+// eventLog records the events of the observers, one string per event
+type eventLog struct {
+	events []string
+}
+
+func (el *eventLog) add(format string, args ...interface{}) {
+	el.events = append(el.events, fmt.Sprintf(format, args...))
+}
+
+func (el *eventLog) BeforeInstruction(cpu *Pep8CPU, ins Instruction) {
+	el.add("before %04x %s", ins.Addr, ins.Mnemonic)
+}
+
+func (el *eventLog) AfterInstruction(cpu *Pep8CPU, ins Instruction) {
+	el.add("after %04x pc=%04x fault=%v", ins.Addr, cpu.PC, cpu.Fault)
+}
+
+func (el *eventLog) MemoryRead(cpu *Pep8CPU, addr uint16, size int, val uint16) {
+	el.add("read %04x/%d=%04x", addr, size, val)
+}
+
+func (el *eventLog) MemoryWrite(cpu *Pep8CPU, addr uint16, size int, val uint16) {
+	el.add("write %04x/%d=%04x", addr, size, val)
+}
+
+func (el *eventLog) Input(cpu *Pep8CPU, b byte) {
+	el.add("input %q", b)
+}
+
+func (el *eventLog) Output(cpu *Pep8CPU, b byte) {
+	el.add("output %q", b)
+}
+
+func (el *eventLog) Call(cpu *Pep8CPU, site, target, sp uint16) {
+	el.add("call %04x->%04x sp=%04x", site, target, sp)
+}
+
+func (el *eventLog) Return(cpu *Pep8CPU, site, target, sp uint16) {
+	el.add("return %04x->%04x sp=%04x", site, target, sp)
+}
+
+// observe runs a program to its end with the observers
+func observe(program []byte, input string, observers ...Observer) *Pep8CPU {
+	cpu := NewPep8Cpu()
+	cpu.Load(program)
+	cpu.In = strings.NewReader(input)
+	cpu.Out = &strings.Builder{}
+	cpu.Observers = observers
+	cpu.Run()
+	return cpu
+}
+
+func TestObserverEvents(t *testing.T) {
+	el := &eventLog{}
+	observe(callProgram, "z", el)
+
+	want := []string{
+		"before 0000 CALL",
+		"write fffd/2=0003",
+		"call 0000->0007 sp=fffd",
+		"after 0000 pc=0007 fault=<nil>",
+		"before 0007 CHARI",
+		"input 'z'",
+		"write 0010/1=007a",
+		"after 0007 pc=000a fault=<nil>",
+		"before 000a RET0",
+		"read fffd/2=0003",
+		"return 000a->0003 sp=ffff",
+		"after 000a pc=0003 fault=<nil>",
+		"before 0003 CHARO",
+		"output 'A'",
+		"after 0003 pc=0006 fault=<nil>",
+		"before 0006 STOP",
+		"after 0006 pc=0007 fault=<nil>",
+	}
+	if strings.Join(el.events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(el.events, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestObserverFault(t *testing.T) {
+	// CHARI without input faults, the instruction is still reported
+	el := &eventLog{}
+	cpu := observe(callProgram, "", el)
+	if cpu.Fault == nil {
+		t.Fatal("no fault at the end of the input")
+	}
+	last := el.events[len(el.events)-1]
+	if !strings.HasPrefix(last, "after 0007 ") || strings.HasSuffix(last, "fault=<nil>") {
+		t.Errorf("last event %q, want the fault of CHARI at 0007", last)
+	}
+}
@@ -0,0 +1,293 @@
+package cpu
+
+import "strconv"
+
+// The operations of the instruction set on values rather than on a decoded
+// instruction, they set the flags as the instructions do. The interpreter
+// executes the instructions with them, and so do the programs translated to
+// Go by Translate.
+
+// Add returns lop + rop, and sets NZVC
+func (cpu *Pep8CPU) Add(lop, rop uint16) uint16 {
+	res, n, z, v, c := doadd(lop, rop)
+	cpu.N, cpu.Z, cpu.V, cpu.C = n, z, v, c
+	return res
+}
+
+// Sub returns lop - rop, and sets NZVC
+func (cpu *Pep8CPU) Sub(lop, rop uint16) uint16 {
+	res, n, z, v, c := dosub(lop, rop)
+	cpu.N, cpu.Z, cpu.V, cpu.C = n, z, v, c
+	return res
+}
+
+// And returns lop & rop, and sets NZ
+func (cpu *Pep8CPU) And(lop, rop uint16) uint16 {
+	return cpu.Ld(lop & rop)
+}
+
+// Or returns lop | rop, and sets NZ
+func (cpu *Pep8CPU) Or(lop, rop uint16) uint16 {
+	return cpu.Ld(lop | rop)
+}
+
+// Not returns the bitwise negation of val, and sets NZ
+func (cpu *Pep8CPU) Not(val uint16) uint16 {
+	val = val ^ uint16(0xFFFF)
+
+	cpu.N = false
+	cpu.Z = false
+
+	if val >= 0x8000 {
+		cpu.N = true
+	}
+	if val == 0 {
+		cpu.Z = true
+	}
+	return val
+}
+
+// Neg returns the opposite of val, and sets NZV
+func (cpu *Pep8CPU) Neg(val uint16) uint16 {
+	val = (val ^ uint16(0xFFFF)) + 1
+
+	cpu.N = false
+	cpu.Z = false
+	cpu.V = false
+
+	if val >= 0x8000 {
+		cpu.N = true
+	}
+
+	if val == 0 {
+		cpu.Z = true
+	}
+
+	if val == 0x8000 {
+		cpu.V = true
+	}
+	return val
+}
+
+// Asl returns val shifted left, and sets NZVC
+func (cpu *Pep8CPU) Asl(val uint16) uint16 {
+	cf := val & 0x8000
+	val = val << 1
+
+	cpu.N = false
+	cpu.Z = false
+	cpu.V = false
+	cpu.C = false
+
+	if cf != 0 {
+		cpu.C = true
+	}
+
+	if val&0x8000 != cf {
+		cpu.V = true
+	}
+
+	if val == 0 {
+		cpu.Z = true
+	}
+
+	if val >= 0x8000 {
+		cpu.N = true
+	}
+	return val
+}
+
+// Asr returns val shifted right, its sign kept, and sets NZC
+func (cpu *Pep8CPU) Asr(val uint16) uint16 {
+	cf := val & 1
+	val = val&0x8000 | val>>1
+
+	cpu.N = false
+	cpu.Z = false
+	cpu.C = false
+
+	if cf != 0 {
+		cpu.C = true
+	}
+
+	if val == 0 {
+		cpu.Z = true
+	}
+
+	if val >= 0x8000 {
+		cpu.N = true
+	}
+
+	return val
+}
+
+// Rol returns val rotated left through the carry, and sets C
+func (cpu *Pep8CPU) Rol(val uint16) uint16 {
+	oc := uint16(0)
+	if cpu.C {
+		oc = 1
+	}
+
+	nc := val & 0x8000
+	val = val << 1
+	val |= oc
+
+	cpu.C = false
+	if nc != 0 {
+		cpu.C = true
+	}
+	return val
+}
+
+// Ror returns val rotated right through the carry, and sets C
+func (cpu *Pep8CPU) Ror(val uint16) uint16 {
+	oc := uint16(0)
+	if cpu.C {
+		oc = 1
+	}
+
+	nc := val & 0x1
+	val = val >> 1
+	val |= oc << 15
+
+	cpu.C = false
+	if nc != 0 {
+		cpu.C = true
+	}
+	return val
+}
+
+// Ld returns val, to be loaded in a register, and sets NZ
+func (cpu *Pep8CPU) Ld(val uint16) uint16 {
+	cpu.Z = false
+	cpu.N = false
+	if val == 0 {
+		cpu.Z = true
+	}
+	if val >= 0x8000 {
+		cpu.N = true
+	}
+	return val
+}
+
+// LdByte returns reg with its low byte replaced by the one of val, to be
+// loaded in the register, and sets NZ from the result
+func (cpu *Pep8CPU) LdByte(reg, val uint16) uint16 {
+	return cpu.Ld(reg&0xFF00 | val&0xFF)
+}
+
+// Flags returns the flags as MOVFLGA loads them in A
+func (cpu *Pep8CPU) Flags() uint16 {
+	aval := 0
+
+	if cpu.C {
+		aval |= 1
+	}
+	if cpu.V {
+		aval |= 2
+	}
+	if cpu.Z {
+		aval |= 4
+	}
+	if cpu.N {
+		aval |= 8
+	}
+
+	return uint16(aval)
+}
+
+// Call pushes PC, the return address, and jumps to target, site is the
+// address of the CALL
+func (cpu *Pep8CPU) Call(site, target uint16) {
+	cpu.SP -= 2
+	cpu.write16(cpu.PC, cpu.SP)
+	cpu.PC = target
+	for _, obs := range cpu.Observers {
+		obs.Call(cpu, site, cpu.PC, cpu.SP)
+	}
+}
+
+// Ret pops locals bytes and the return address to PC, site is the address
+// of the RET
+func (cpu *Pep8CPU) Ret(site, locals uint16) {
+	cpu.SP, _, _, _, _ = doadd(cpu.SP, locals)
+	retaddr := cpu.read16(cpu.SP)
+	cpu.SP += 2
+	cpu.PC = retaddr
+	for _, obs := range cpu.Observers {
+		obs.Return(cpu, site, cpu.PC, cpu.SP)
+	}
+}
+
+// Deci reads a decimal number from the input to the word at addr, and sets
+// NZV, V when the number does not fit in a word
+func (cpu *Pep8CPU) Deci(addr uint16) error {
+	val, overflow, err := deci(cpu.readChar)
+	if err != nil {
+		return err
+	}
+
+	cpu.N = false
+	cpu.Z = false
+	cpu.V = overflow
+
+	if val == 0 {
+		cpu.Z = true
+	}
+
+	if val >= 0x8000 {
+		cpu.N = true
+	}
+
+	cpu.write16(val, addr)
+	return nil
+}
+
+// Deco writes val to the output as a signed decimal number
+func (cpu *Pep8CPU) Deco(val uint16) {
+	cpu.output(strconv.AppendInt(cpu.outBuf[:0], int64(int16(val)), 10))
+}
+
+// Stro writes the null-terminated string at addr to the output
+func (cpu *Pep8CPU) Stro(addr uint16) {
+	for chr := cpu.read8(addr); chr != 0; chr = cpu.read8(addr) {
+		cpu.outputChar(chr)
+		addr++
+	}
+}
+
+// Chari reads a character from the input to the byte at addr, at the end
+// of the input it is an error, unless NoEOFChariStop is set and 0 is read
+func (cpu *Pep8CPU) Chari(addr uint16) error {
+	b, err := cpu.readChar()
+	if err != nil && !cpu.NoEOFChariStop {
+		return err
+	}
+	cpu.write8(b, addr)
+	return nil
+}
+
+// Charo writes a character to the output
+func (cpu *Pep8CPU) Charo(chr uint8) {
+	cpu.outputChar(chr)
+}
+
+// Read8 reads the byte at addr
+func (cpu *Pep8CPU) Read8(addr uint16) uint8 {
+	return cpu.read8(addr)
+}
+
+// Read16 reads the word at addr
+func (cpu *Pep8CPU) Read16(addr uint16) uint16 {
+	return cpu.read16(addr)
+}
+
+// Write8 writes val to the byte at addr
+func (cpu *Pep8CPU) Write8(val uint8, addr uint16) {
+	cpu.write8(val, addr)
+}
+
+// Write16 writes val to the word at addr
+func (cpu *Pep8CPU) Write16(val uint16, addr uint16) {
+	cpu.write16(val, addr)
+}
@@ -1,11 +1,12 @@
 package cpu
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"os"
 	"regexp"
-	"strings"
+	"time"
 )
 
 type Sign int
@@ -276,281 +277,6 @@ const (
 	STBYTEXsxf        = 255
 )
 
-func (oc opcode) BaseOp() string {
-	switch oc {
-	case STOP:
-		return "STOP"
-	case RETTR:
-		return "RETTR"
-	case MOVSPA:
-		return "MOVSPA"
-	case MOVFLGA:
-		return "MOVFLGA"
-	case BRi, BRx:
-		return "BR"
-	case BRLEi, BRLEx:
-		return "BRLE"
-	case BRLTi, BRLTx:
-		return "BRLT"
-	case BREQi, BREQx:
-		return "BREQ"
-	case BRNEi, BRNEx:
-		return "BRNE"
-	case BRGEi, BRGEx:
-		return "BRGE"
-	case BRGTi, BRGTx:
-		return "BRGT"
-	case BRVi, BRVx:
-		return "BRV"
-	case BRCi, BRCx:
-		return "BRC"
-	case CALLi, CALLx:
-		return "CALL"
-	case NOTA, NOTX:
-		return "NOT"
-	case NEGA, NEGX:
-		return "NEG"
-	case ASLA, ASLX:
-		return "ASL"
-	case ASRA, ASRX:
-		return "ASR"
-	case ROLA, ROLX:
-		return "ROL"
-	case RORA, RORX:
-		return "ROR"
-	case NOP0, NOP1, NOP2, NOP3, NOPi, NOPd, NOPn, NOPs, NOPsf, NOPx, NOPsx, NOPsxf:
-		return "NOP"
-	case DECIi, DECId, DECIn, DECIs, DECIsf, DECIx, DECIsx, DECIsxf:
-		return "DECI"
-	case DECOi, DECOd, DECOn, DECOs, DECOsf, DECOx, DECOsx, DECOsxf:
-		return "DECO"
-	case STROi, STROd, STROn, STROs, STROsf, STROx, STROsx, STROsxf:
-		return "STRO"
-	case CHARIi, CHARId, CHARIn, CHARIs, CHARIsf, CHARIx, CHARIsx, CHARIsxf:
-		return "CHARI"
-	case CHAROi, CHAROd, CHAROn, CHAROs, CHAROsf, CHAROx, CHAROsx, CHAROsxf:
-		return "CHARO"
-	case RET0, RET1, RET2, RET3, RET4, RET5, RET6, RET7:
-		return "RET"
-	case ADDSPi, ADDSPd, ADDSPn, ADDSPs, ADDSPsf, ADDSPx, ADDSPsx, ADDSPsxf:
-		return "ADDSP"
-	case SUBSPi, SUBSPd, SUBSPn, SUBSPs, SUBSPsf, SUBSPx, SUBSPsx, SUBSPsxf:
-		return "SUBSP"
-	case ADDAi, ADDAd, ADDAn, ADDAs, ADDAsf, ADDAx, ADDAsx, ADDAsxf,
-		ADDXi, ADDXd, ADDXn, ADDXs, ADDXsf, ADDXx, ADDXsx, ADDXsxf:
-		return "ADD"
-	case SUBAi, SUBAd, SUBAn, SUBAs, SUBAsf, SUBAx, SUBAsx, SUBAsxf,
-		SUBXi, SUBXd, SUBXn, SUBXs, SUBXsf, SUBXx, SUBXsx, SUBXsxf:
-		return "SUB"
-	case ANDAi, ANDAd, ANDAn, ANDAs, ANDAsf, ANDAx, ANDAsx, ANDAsxf,
-		ANDXi, ANDXd, ANDXn, ANDXs, ANDXsf, ANDXx, ANDXsx, ANDXsxf:
-		return "AND"
-	case ORAi, ORAd, ORAn, ORAs, ORAsf, ORAx, ORAsx, ORAsxf,
-		ORXi, ORXd, ORXn, ORXs, ORXsf, ORXx, ORXsx, ORXsxf:
-		return "OR"
-	case CPAi, CPAd, CPAn, CPAs, CPAsf, CPAx, CPAsx, CPAsxf,
-		CPXi, CPXd, CPXn, CPXs, CPXsf, CPXx, CPXsx, CPXsxf:
-		return "CP"
-	case LDAi, LDAd, LDAn, LDAs, LDAsf, LDAx, LDAsx, LDAsxf,
-		LDXi, LDXd, LDXn, LDXs, LDXsf, LDXx, LDXsx, LDXsxf:
-		return "LD"
-	case LDBYTEAi, LDBYTEAd, LDBYTEAn, LDBYTEAs, LDBYTEAsf, LDBYTEAx, LDBYTEAsx, LDBYTEAsxf,
-		LDBYTEXi, LDBYTEXd, LDBYTEXn, LDBYTEXs, LDBYTEXsf, LDBYTEXx, LDBYTEXsx, LDBYTEXsxf:
-		return "LDBYTE"
-	case STAi, STAd, STAn, STAs, STAsf, STAx, STAsx, STAsxf,
-		STXi, STXd, STXn, STXs, STXsf, STXx, STXsx, STXsxf:
-		return "ST"
-	case STBYTEAi, STBYTEAd, STBYTEAn, STBYTEAs, STBYTEAsf, STBYTEAx, STBYTEAsx, STBYTEAsxf,
-		STBYTEXi, STBYTEXd, STBYTEXn, STBYTEXs, STBYTEXsf, STBYTEXx, STBYTEXsx, STBYTEXsxf:
-		return "STBYTE"
-	}
-	panic("Unknown opcode")
-}
-
-func (oc opcode) hasAddr() bool {
-	switch oc {
-	case BRLEi, BRLEx,
-		BRLTi, BRLTx,
-		BREQi, BREQx,
-		BRNEi, BRNEx,
-		BRGEi, BRGEx,
-		BRGTi, BRGTx,
-		BRVi, BRVx,
-		BRCi, BRCx,
-		CALLi, CALLx,
-		NOPi, NOPd, NOPn, NOPs, NOPsf, NOPx, NOPsx, NOPsxf,
-		DECIi, DECId, DECIn, DECIs, DECIsf, DECIx, DECIsx, DECIsxf,
-		CHARIi, CHARId, CHARIn, CHARIs, CHARIsf, CHARIx, CHARIsx, CHARIsxf,
-		STAi, STAd, STAn, STAs, STAsf, STAx, STAsx, STAsxf,
-		STXi, STXd, STXn, STXs, STXsf, STXx, STXsx, STXsxf,
-		STBYTEAi, STBYTEAd, STBYTEAn, STBYTEAs, STBYTEAsf, STBYTEAx, STBYTEAsx, STBYTEAsxf,
-		STBYTEXi, STBYTEXd, STBYTEXn, STBYTEXs, STBYTEXsf, STBYTEXx, STBYTEXsx, STBYTEXsxf,
-		STROi, STROd, STROn, STROs, STROsf, STROx, STROsx, STROsxf,
-		DECOi, DECOd, DECOn, DECOs, DECOsf, DECOx, DECOsx, DECOsxf,
-		CHAROi, CHAROd, CHAROn, CHAROs, CHAROsf, CHAROx, CHAROsx, CHAROsxf,
-		ADDSPi, ADDSPd, ADDSPn, ADDSPs, ADDSPsf, ADDSPx, ADDSPsx, ADDSPsxf,
-		SUBSPi, SUBSPd, SUBSPn, SUBSPs, SUBSPsf, SUBSPx, SUBSPsx, SUBSPsxf,
-		ADDAi, ADDAd, ADDAn, ADDAs, ADDAsf, ADDAx, ADDAsx, ADDAsxf,
-		ADDXi, ADDXd, ADDXn, ADDXs, ADDXsf, ADDXx, ADDXsx, ADDXsxf,
-		SUBAi, SUBAd, SUBAn, SUBAs, SUBAsf, SUBAx, SUBAsx, SUBAsxf,
-		SUBXi, SUBXd, SUBXn, SUBXs, SUBXsf, SUBXx, SUBXsx, SUBXsxf,
-		ANDAi, ANDAd, ANDAn, ANDAs, ANDAsf, ANDAx, ANDAsx, ANDAsxf,
-		ANDXi, ANDXd, ANDXn, ANDXs, ANDXsf, ANDXx, ANDXsx, ANDXsxf,
-		ORAi, ORAd, ORAn, ORAs, ORAsf, ORAx, ORAsx, ORAsxf,
-		ORXi, ORXd, ORXn, ORXs, ORXsf, ORXx, ORXsx, ORXsxf,
-		CPAi, CPAd, CPAn, CPAs, CPAsf, CPAx, CPAsx, CPAsxf,
-		CPXi, CPXd, CPXn, CPXs, CPXsf, CPXx, CPXsx, CPXsxf,
-		LDAi, LDAd, LDAn, LDAs, LDAsf, LDAx, LDAsx, LDAsxf,
-		LDXi, LDXd, LDXn, LDXs, LDXsf, LDXx, LDXsx, LDXsxf,
-		LDBYTEAi, LDBYTEAd, LDBYTEAn, LDBYTEAs, LDBYTEAsf, LDBYTEAx, LDBYTEAsx, LDBYTEAsxf,
-		LDBYTEXi, LDBYTEXd, LDBYTEXn, LDBYTEXs, LDBYTEXsf, LDBYTEXx, LDBYTEXsx, LDBYTEXsxf:
-		return true
-	}
-	return false
-}
-
-func (oc opcode) getMode() (AddrMode, error) {
-	switch oc {
-	case BRi, BRx,
-		BRLEi, BRLEx,
-		BRLTi, BRLTx,
-		BREQi, BREQx,
-		BRNEi, BRNEx,
-		BRGEi, BRGEx,
-		BRGTi, BRGTx,
-		BRVi, BRVx,
-		BRCi, BRCx,
-		CALLi, CALLx:
-		am := oc & 0x1
-		if am == 0 {
-			return i, nil
-		}
-		return x, nil
-
-	case NOPi, NOPd, NOPn, NOPs, NOPsf, NOPx, NOPsx, NOPsxf:
-		am := oc & 0x7
-		if am != 0 {
-			return i, fmt.Errorf("invalid addressing mode %s for NOP", AddrMode(am))
-		}
-		return AddrMode(am), nil
-
-	case DECIi, DECId, DECIn, DECIs, DECIsf, DECIx, DECIsx, DECIsxf,
-		CHARIi, CHARId, CHARIn, CHARIs, CHARIsf, CHARIx, CHARIsx, CHARIsxf,
-		STAi, STAd, STAn, STAs, STAsf, STAx, STAsx, STAsxf,
-		STXi, STXd, STXn, STXs, STXsf, STXx, STXsx, STXsxf,
-		STBYTEAi, STBYTEAd, STBYTEAn, STBYTEAs, STBYTEAsf, STBYTEAx, STBYTEAsx, STBYTEAsxf,
-		STBYTEXi, STBYTEXd, STBYTEXn, STBYTEXs, STBYTEXsf, STBYTEXx, STBYTEXsx, STBYTEXsxf:
-		am := oc & 0x7
-		if am == 0 {
-			return i, fmt.Errorf("invalid addressing mode i for %s", oc.BaseOp())
-		}
-		return AddrMode(am), nil
-
-	case STROi, STROd, STROn, STROs, STROsf, STROx, STROsx, STROsxf:
-		am := oc & 0x7
-		switch AddrMode(am) {
-		case d, n, sf:
-			return AddrMode(am), nil
-		}
-		return i, fmt.Errorf("invalid addressing mode %s for STRO", AddrMode(am))
-
-	case DECOi, DECOd, DECOn, DECOs, DECOsf, DECOx, DECOsx, DECOsxf,
-		CHAROi, CHAROd, CHAROn, CHAROs, CHAROsf, CHAROx, CHAROsx, CHAROsxf,
-		ADDSPi, ADDSPd, ADDSPn, ADDSPs, ADDSPsf, ADDSPx, ADDSPsx, ADDSPsxf,
-		SUBSPi, SUBSPd, SUBSPn, SUBSPs, SUBSPsf, SUBSPx, SUBSPsx, SUBSPsxf,
-		ADDAi, ADDAd, ADDAn, ADDAs, ADDAsf, ADDAx, ADDAsx, ADDAsxf,
-		ADDXi, ADDXd, ADDXn, ADDXs, ADDXsf, ADDXx, ADDXsx, ADDXsxf,
-		SUBAi, SUBAd, SUBAn, SUBAs, SUBAsf, SUBAx, SUBAsx, SUBAsxf,
-		SUBXi, SUBXd, SUBXn, SUBXs, SUBXsf, SUBXx, SUBXsx, SUBXsxf,
-		ANDAi, ANDAd, ANDAn, ANDAs, ANDAsf, ANDAx, ANDAsx, ANDAsxf,
-		ANDXi, ANDXd, ANDXn, ANDXs, ANDXsf, ANDXx, ANDXsx, ANDXsxf,
-		ORAi, ORAd, ORAn, ORAs, ORAsf, ORAx, ORAsx, ORAsxf,
-		ORXi, ORXd, ORXn, ORXs, ORXsf, ORXx, ORXsx, ORXsxf,
-		CPAi, CPAd, CPAn, CPAs, CPAsf, CPAx, CPAsx, CPAsxf,
-		CPXi, CPXd, CPXn, CPXs, CPXsf, CPXx, CPXsx, CPXsxf,
-		LDAi, LDAd, LDAn, LDAs, LDAsf, LDAx, LDAsx, LDAsxf,
-		LDXi, LDXd, LDXn, LDXs, LDXsf, LDXx, LDXsx, LDXsxf,
-		LDBYTEAi, LDBYTEAd, LDBYTEAn, LDBYTEAs, LDBYTEAsf, LDBYTEAx, LDBYTEAsx, LDBYTEAsxf,
-		LDBYTEXi, LDBYTEXd, LDBYTEXn, LDBYTEXs, LDBYTEXsf, LDBYTEXx, LDBYTEXsx, LDBYTEXsxf:
-		am := oc & 0x7
-		return AddrMode(am), nil
-	}
-
-	return i, fmt.Errorf("getMode: no known instruction for addressing mode %s (opcode %d)", oc.BaseOp(), oc)
-}
-
-func (oc opcode) hasReg() bool {
-	switch oc {
-	case NOTA, NOTX,
-		NEGA, NEGX,
-		ASLA, ASLX,
-		ASRA, ASRX,
-		ROLA, ROLX,
-		RORA, RORX,
-		ADDAi, ADDAd, ADDAn, ADDAs, ADDAsf, ADDAx, ADDAsx, ADDAsxf,
-		ADDXi, ADDXd, ADDXn, ADDXs, ADDXsf, ADDXx, ADDXsx, ADDXsxf,
-		SUBAi, SUBAd, SUBAn, SUBAs, SUBAsf, SUBAx, SUBAsx, SUBAsxf,
-		SUBXi, SUBXd, SUBXn, SUBXs, SUBXsf, SUBXx, SUBXsx, SUBXsxf,
-		ANDAi, ANDAd, ANDAn, ANDAs, ANDAsf, ANDAx, ANDAsx, ANDAsxf,
-		ANDXi, ANDXd, ANDXn, ANDXs, ANDXsf, ANDXx, ANDXsx, ANDXsxf,
-		ORAi, ORAd, ORAn, ORAs, ORAsf, ORAx, ORAsx, ORAsxf,
-		ORXi, ORXd, ORXn, ORXs, ORXsf, ORXx, ORXsx, ORXsxf,
-		CPAi, CPAd, CPAn, CPAs, CPAsf, CPAx, CPAsx, CPAsxf,
-		CPXi, CPXd, CPXn, CPXs, CPXsf, CPXx, CPXsx, CPXsxf,
-		LDAi, LDAd, LDAn, LDAs, LDAsf, LDAx, LDAsx, LDAsxf,
-		LDXi, LDXd, LDXn, LDXs, LDXsf, LDXx, LDXsx, LDXsxf,
-		LDBYTEAi, LDBYTEAd, LDBYTEAn, LDBYTEAs, LDBYTEAsf, LDBYTEAx, LDBYTEAsx, LDBYTEAsxf,
-		LDBYTEXi, LDBYTEXd, LDBYTEXn, LDBYTEXs, LDBYTEXsf, LDBYTEXx, LDBYTEXsx, LDBYTEXsxf,
-		STAi, STAd, STAn, STAs, STAsf, STAx, STAsx, STAsxf,
-		STXi, STXd, STXn, STXs, STXsf, STXx, STXsx, STXsxf,
-		STBYTEAi, STBYTEAd, STBYTEAn, STBYTEAs, STBYTEAsf, STBYTEAx, STBYTEAsx, STBYTEAsxf,
-		STBYTEXi, STBYTEXd, STBYTEXn, STBYTEXs, STBYTEXsf, STBYTEXx, STBYTEXsx, STBYTEXsxf:
-		return true
-	}
-
-	return false
-}
-
-func (oc opcode) register() register {
-	switch oc {
-	case NOTA, NOTX,
-		NEGA, NEGX,
-		ASLA, ASLX,
-		ASRA, ASRX,
-		ROLA, ROLX,
-		RORA, RORX:
-		regbit := oc & 0x1
-		if regbit == 0 {
-			return A
-		}
-		return X
-	case ADDAi, ADDAd, ADDAn, ADDAs, ADDAsf, ADDAx, ADDAsx, ADDAsxf,
-		ADDXi, ADDXd, ADDXn, ADDXs, ADDXsf, ADDXx, ADDXsx, ADDXsxf,
-		SUBAi, SUBAd, SUBAn, SUBAs, SUBAsf, SUBAx, SUBAsx, SUBAsxf,
-		SUBXi, SUBXd, SUBXn, SUBXs, SUBXsf, SUBXx, SUBXsx, SUBXsxf,
-		ANDAi, ANDAd, ANDAn, ANDAs, ANDAsf, ANDAx, ANDAsx, ANDAsxf,
-		ANDXi, ANDXd, ANDXn, ANDXs, ANDXsf, ANDXx, ANDXsx, ANDXsxf,
-		ORAi, ORAd, ORAn, ORAs, ORAsf, ORAx, ORAsx, ORAsxf,
-		ORXi, ORXd, ORXn, ORXs, ORXsf, ORXx, ORXsx, ORXsxf,
-		CPAi, CPAd, CPAn, CPAs, CPAsf, CPAx, CPAsx, CPAsxf,
-		CPXi, CPXd, CPXn, CPXs, CPXsf, CPXx, CPXsx, CPXsxf,
-		LDAi, LDAd, LDAn, LDAs, LDAsf, LDAx, LDAsx, LDAsxf,
-		LDXi, LDXd, LDXn, LDXs, LDXsf, LDXx, LDXsx, LDXsxf,
-		LDBYTEAi, LDBYTEAd, LDBYTEAn, LDBYTEAs, LDBYTEAsf, LDBYTEAx, LDBYTEAsx, LDBYTEAsxf,
-		LDBYTEXi, LDBYTEXd, LDBYTEXn, LDBYTEXs, LDBYTEXsf, LDBYTEXx, LDBYTEXsx, LDBYTEXsxf,
-		STAi, STAd, STAn, STAs, STAsf, STAx, STAsx, STAsxf,
-		STXi, STXd, STXn, STXs, STXsf, STXx, STXsx, STXsxf,
-		STBYTEAi, STBYTEAd, STBYTEAn, STBYTEAs, STBYTEAsf, STBYTEAx, STBYTEAsx, STBYTEAsxf,
-		STBYTEXi, STBYTEXd, STBYTEXn, STBYTEXs, STBYTEXsf, STBYTEXx, STBYTEXsx, STBYTEXsxf:
-		regbit := (oc & 0x8) >> 3
-		if regbit == 0 {
-			return A
-		}
-		return X
-	}
-	panic(fmt.Sprintf("register: failed to get register from opcode %d (%s)", oc, oc.BaseOp()))
-}
-
 type AddrMode int
 
 const (
@@ -603,58 +329,61 @@ func (reg register) String() string {
 	panic("unknown register")
 }
 
-var rdchar = make([]byte, 1)
-
-func chari(in io.Reader) (byte, error) {
-	b, err := in.Read(rdchar)
+// chari reads a byte from in, through buf, a buffer of one byte
+func chari(in io.Reader, buf []byte) (byte, error) {
+	b, err := in.Read(buf)
 	if b == 0 || err != nil {
 		return 0, fmt.Errorf("no more chars to consume")
 	}
-	return rdchar[0], nil
+	return buf[0], nil
 }
 
-func deci(in io.Reader) int {
+var errInvalidDeci = fmt.Errorf("Invalid DECI input")
+
+// deci reads a decimal number, after spaces and with an optional sign, it
+// returns its value modulo 2^16 and whether it overflows a word
+func deci(chari func() (byte, error)) (uint16, bool, error) {
 	var c byte = 0
 	var err error
 
 	for c <= ' ' {
-		c, err = chari(in)
+		c, err = chari()
 		if err != nil {
-			fmt.Print("Invalid DECI input\n")
-			os.Exit(1)
+			return 0, false, errInvalidDeci
 		}
 	}
 
 	neg := false
-	if c == '-' {
-		neg = true
-		c, err = chari(in)
+	if c == '-' || c == '+' {
+		neg = c == '-'
+		c, err = chari()
 		if err != nil {
-			fmt.Print("Invalid DECI input\n")
-			os.Exit(1)
+			return 0, false, errInvalidDeci
 		}
 	}
 
 	if c < '0' || c > '9' {
-		fmt.Print("Invalid DECI input\n")
-		os.Exit(1)
+		return 0, false, errInvalidDeci
 	}
 
-	val := 0
+	// mag is the magnitude of the number, it stops growing once it
+	// overflows
+	val, mag := uint16(0), 0
 	for c >= '0' && c <= '9' {
-		val *= 10
-		val += int(c - '0')
-		c, err = chari(in)
+		val = val*10 + uint16(c-'0')
+		if mag <= 0x8000 {
+			mag = mag*10 + int(c-'0')
+		}
+		c, err = chari()
 		if err != nil {
 			break
 		}
 	}
 
 	if neg {
-		val = -val
+		return -val, mag > 0x8000, nil
 	}
-
-	return val
+	return val, mag > 0x7FFF, nil
 }
 
 func doadd(lop, rop uint16) (res uint16, n, z, v, c bool) {
@@ -729,6 +458,8 @@ type Pep8CPU struct {
 	Spec uint16
 	// Operand register, keeps the resolved operand for the instruction
 	Operand uint16
+	// EffAddr is the address of the operand in memory, unless AddrMode is immediate
+	EffAddr uint16
 	// AddrMode is the addressing mode for the operand
 	AddrMode AddrMode
 	// RAM is the memory allocated for a PEP/8 machine, i.e. 64kiB
@@ -750,15 +481,52 @@ type Pep8CPU struct {
 	NoEOFChariStop bool
 	// Trace will output the state of the CPU after each execution cycle
 	Trace bool
+	// TraceOut is where the trace is written, stdout by default
+	TraceOut io.Writer
+	// Fault is the error that stopped the execution of the program, if any,
+	// PC is then left on the faulting instruction
+	Fault error
+	// Observers are notified of the execution of the program
+	Observers []Observer
+	// Interleave flushes the output buffered by Run after every instruction,
+	// before the observers are notified, for observers that write to the
+	// same stream as the program. Otherwise the output is flushed on STOP,
+	// on a fault and before reading input.
+	Interleave bool
+	// Encoding is how the characters output by the program are written to
+	// Out, raw by default
+	Encoding Encoding
+	// Steps is the number of instructions executed by Run, STOP included
+	Steps uint64
+	// MaxSteps stops Run with ErrStepLimit when that many instructions were
+	// executed, 0 for no limit
+	MaxSteps uint64
+	// Deadline stops Run with ErrTimeLimit once passed, the zero time for no
+	// limit
+	Deadline time.Time
+
+	// insAddr is the address of the instruction being executed
+	insAddr uint16
+	// inBuf holds the byte read by an input instruction
+	inBuf [1]byte
+	// outBuf holds the text of an output instruction, to write it without
+	// allocating
+	outBuf [8]byte
+	// bout buffers the output during Run, it is nil otherwise
+	bout *bufio.Writer
+	// blocks caches the code translated by RunFast, it is nil until
+	// RunFast is called
+	blocks *blockCache
 }
 
 func NewPep8Cpu() *Pep8CPU {
 	return &Pep8CPU{
-		PC:  0,
-		SP:  0xFFFF,
-		RAM: make([]byte, 65536),
-		In:  os.Stdin,
-		Out: os.Stdout,
+		PC:       0,
+		SP:       0xFFFF,
+		RAM:      make([]byte, 65536),
+		In:       os.Stdin,
+		Out:      os.Stdout,
+		TraceOut: os.Stdout,
 	}
 }
 
@@ -791,11 +559,11 @@ func convertByte(in byte) byte {
 	panic(fmt.Sprintf("invalid byte: %c", in))
 }
 
-// LoadFromFile loads a pep8 program from an object code file
-func (cpu *Pep8CPU) LoadFromFile(pepo string) error {
+// ReadObjectFile reads a pep8 program from an object code file
+func ReadObjectFile(pepo string) ([]byte, error) {
 	cnts, err := os.ReadFile(pepo)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	bytes := regexbyte.FindAll(cnts, -1)
@@ -806,6 +574,16 @@ func (cpu *Pep8CPU) LoadFromFile(pepo string) error {
 		prgm[i] = val
 	}
 
+	return prgm, nil
+}
+
+// LoadFromFile loads a pep8 program from an object code file
+func (cpu *Pep8CPU) LoadFromFile(pepo string) error {
+	prgm, err := ReadObjectFile(pepo)
+	if err != nil {
+		return err
+	}
+
 	return cpu.Load(prgm)
 }
 
@@ -815,15 +593,52 @@ func (cpu *Pep8CPU) Load(pepo []byte) error {
 	return nil
 }
 
+// Run executes the loaded program from the start until it stops
+//
+// The output is buffered, and flushed when the program stops, faults, or
+// waits for input. Traced or observed programs flush it after every
+// instruction, in order with the trace.
+//
+// Returns the fault that stopped the program, if any, or the error writing
+// the output
 func (cpu *Pep8CPU) Run() error {
 	cpu.PC = 0
 	cpu.SP = 0xFFFF
+	cpu.Fault = nil
+	cpu.Steps = 0
+	done := cpu.bufferIO()
 	for {
+		if err := cpu.checkLimits(); err != nil {
+			cpu.Fault = err
+			break
+		}
 		cont := cpu.DoNextCycle()
 		if !cont {
 			break
 		}
 	}
+	return done()
+}
+
+// ErrStepLimit is the fault of a program stopped after MaxSteps instructions
+var ErrStepLimit = fmt.Errorf("step limit reached")
+
+// ErrTimeLimit is the fault of a program stopped at its Deadline
+var ErrTimeLimit = fmt.Errorf("time limit reached")
+
+// deadlineInterval is the number of instructions between two checks of the
+// deadline, reading the clock costs more than an instruction
+const deadlineInterval = 4096
+
+// checkLimits returns the fault of a program that reached its limits, before
+// the next instruction, nil if it may go on
+func (cpu *Pep8CPU) checkLimits() error {
+	if cpu.MaxSteps != 0 && cpu.Steps >= cpu.MaxSteps {
+		return ErrStepLimit
+	}
+	if !cpu.Deadline.IsZero() && cpu.Steps%deadlineInterval == 0 && time.Now().After(cpu.Deadline) {
+		return ErrTimeLimit
+	}
 	return nil
 }
 
@@ -833,41 +648,59 @@ func (cpu *Pep8CPU) Run() error {
 // 2. decode/validate instruction
 // 3. increment PC
 // 4. execute instruction
-func (cpu *Pep8CPU) DoNextCycle() bool {
+//
+// Returns false when the program stopped, either normally or on a fault
+func (cpu *Pep8CPU) DoNextCycle() (cont bool) {
+	cpu.insAddr = cpu.PC
 	cpu.opcode = opcode(cpu.RAM[cpu.PC])
 	cpu.Spec = 0
-	incr := 1
-	if cpu.needSpec() {
-		cpu.Spec = cpu.read16(cpu.PC + 1)
-		cpu.getAddrMode()
-		cpu.getOp()
-		incr = 3
+
+	if len(cpu.Observers) > 0 {
+		ins := cpu.Decode(cpu.PC)
+		for _, obs := range cpu.Observers {
+			obs.BeforeInstruction(cpu, ins)
+		}
+		defer func() {
+			if cpu.Interleave || !cont {
+				cpu.flushOutput()
+			}
+			for _, obs := range cpu.Observers {
+				obs.AfterInstruction(cpu, ins)
+			}
+		}()
+	}
+
+	op := &decodeTable[cpu.opcode]
+	if op.length > 1 {
+		cpu.Spec = cpu.peek16(cpu.PC + 1)
+		if op.modeErr != nil {
+			cpu.Fault = op.modeErr
+			return false
+		}
+		cpu.AddrMode = op.mode
+		cpu.loadOperand(op.operand)
 	}
-	cpu.PC += uint16(incr)
-	cont := cpu.Exec()
+	cpu.PC += op.length
+	cont = cpu.Exec()
+	if cpu.Fault != nil {
+		cpu.PC = cpu.insAddr
+		return false
+	}
+	cpu.Steps++
 	if cpu.Trace {
+		cpu.flushOutput()
 		cpu.dumpState()
 	}
 	return cont
 }
 
-func (cpu *Pep8CPU) dumpRAM() {
-	cur := 0
-	for off := 0; off <= 0xFFFF; off++ {
-		if cur == 0 {
-			fmt.Printf("0x%04x |", off)
-		}
-		cur++
-		fmt.Printf(" %02x", cpu.RAM[off])
-		if cur >= 8 {
-			fmt.Printf(" |\n")
-			cur = 0
-		}
-	}
+func (cpu *Pep8CPU) dumpState() {
+	io.WriteString(cpu.TraceOut, cpu.traceLine())
 }
 
-func (cpu *Pep8CPU) dumpState() {
-	fmt.Printf("PC = %04x; SP = %04x; A %04x; X = %04x; Spec = %04x; N = %d, Z = %d, V = %d, C = %d; opcode = %02x; %s \n",
+// traceLine is the state of the cpu after an instruction, as printed by Trace
+func (cpu *Pep8CPU) traceLine() string {
+	return fmt.Sprintf("PC = %04x; SP = %04x; A %04x; X = %04x; Spec = %04x; N = %d, Z = %d, V = %d, C = %d; opcode = %02x; %s \n",
 		cpu.PC, cpu.SP, cpu.A, cpu.X, cpu.Spec,
 		booltoInt(cpu.N), booltoInt(cpu.Z), booltoInt(cpu.V), booltoInt(cpu.C),
 		cpu.opcode,
@@ -875,18 +708,17 @@ func (cpu *Pep8CPU) dumpState() {
 }
 
 func (cpu *Pep8CPU) instruction() string {
-	instr := strings.Builder{}
-	instr.WriteString(cpu.opcode.BaseOp())
-	if cpu.opcode.hasReg() {
-		instr.WriteString(cpu.opcode.register().String())
+	op := &decodeTable[cpu.opcode]
+	instr := op.base
+	if op.hasReg {
+		instr += op.reg.String()
 	}
-	if cpu.opcode.hasAddr() {
-		instr.WriteRune(',')
-		addr, _ := cpu.opcode.getMode()
-		instr.WriteString(addr.String())
+	// The trace has never shown the addressing mode of BR, the expected
+	// traces of the tests rely on it
+	if op.hasMode && op.base != "BR" {
+		instr += "," + op.mode.String()
 	}
-
-	return instr.String()
+	return instr
 }
 
 func booltoInt(flg bool) int {
@@ -896,208 +728,107 @@ func booltoInt(flg bool) int {
 	return 0
 }
 
-func (cpu *Pep8CPU) getAddrMode() {
-	am, err := cpu.opcode.getMode()
-	if err != nil {
-		fmt.Printf("%s\n", err)
-		os.Exit(1)
-	}
-
-	cpu.AddrMode = am
-}
-
-func (cpu *Pep8CPU) getOp() {
-	switch cpu.opcode {
-	case DECIi, DECId, DECIn, DECIs, DECIsf, DECIx, DECIsx, DECIsxf,
-		CHARIi, CHARId, CHARIn, CHARIs, CHARIsf, CHARIx, CHARIsx, CHARIsxf,
-		STAi, STAd, STAn, STAs, STAsf, STAx, STAsx, STAsxf,
-		STXi, STXd, STXn, STXs, STXsf, STXx, STXsx, STXsxf,
-		STBYTEAi, STBYTEAd, STBYTEAn, STBYTEAs, STBYTEAsf, STBYTEAx, STBYTEAsx, STBYTEAsxf,
-		STBYTEXi, STBYTEXd, STBYTEXn, STBYTEXs, STBYTEXsf, STBYTEXx, STBYTEXsx, STBYTEXsxf,
-		STROi, STROd, STROn, STROs, STROsf, STROx, STROsx, STROsxf:
-		cpu.getOpAddr()
-	default:
-		cpu.getOpRd()
+// loadOperand resolves the operand of the instruction from its specifier
+func (cpu *Pep8CPU) loadOperand(class operandClass) {
+	if class == opAddr {
+		cpu.Operand = cpu.operandAddr()
+		cpu.EffAddr = cpu.Operand
+		return
 	}
-}
 
-func (cpu *Pep8CPU) getOpRd() {
-	switch cpu.AddrMode {
-	case i:
+	if cpu.AddrMode == i {
 		cpu.Operand = cpu.Spec
-	case d:
-		cpu.Operand = cpu.read16(cpu.Spec)
-	case x:
-		cpu.Operand = cpu.read16(cpu.Spec + cpu.X)
-	case n:
-		cpu.Operand = cpu.read16(cpu.read16(cpu.Spec))
-	case s:
-		cpu.Operand = cpu.read16(cpu.Spec + cpu.SP)
-	case sx:
-		cpu.Operand = cpu.read16(cpu.Spec + cpu.SP + cpu.X)
-	case sf:
-		cpu.Operand = cpu.read16(cpu.read16(cpu.SP + cpu.Spec))
-	case sxf:
-		cpu.Operand = cpu.read16(cpu.read16(cpu.SP+cpu.Spec) + cpu.X)
+		return
 	}
 
-	// Align 8 bits for all the byte-oriented ops
-	switch cpu.opcode {
-	case CHAROd, CHAROn, CHAROs, CHAROsf, CHAROx, CHAROsx, CHAROsxf,
-		LDBYTEAd, LDBYTEAn, LDBYTEAs, LDBYTEAsf, LDBYTEAx, LDBYTEAsx, LDBYTEAsxf,
-		LDBYTEXd, LDBYTEXn, LDBYTEXs, LDBYTEXsf, LDBYTEXx, LDBYTEXsx, LDBYTEXsxf:
-		cpu.Operand = cpu.Operand >> 8
+	addr := cpu.operandAddr()
+	cpu.EffAddr = addr
+	if class == opByte {
+		cpu.Operand = uint16(cpu.read8(addr))
+	} else {
+		cpu.Operand = cpu.read16(addr)
 	}
 }
 
-func (cpu *Pep8CPU) getOpAddr() {
+// operandAddr computes the address of the operand in memory, for all the
+// addressing modes but immediate
+func (cpu *Pep8CPU) operandAddr() uint16 {
 	switch cpu.AddrMode {
-	case i:
-		fmt.Printf("invalid addressing mode for in-memory operation: i\n")
-		os.Exit(1)
-	case d:
-		cpu.Operand = cpu.Spec
 	case x:
-		cpu.Operand = cpu.Spec + cpu.X
+		return cpu.Spec + cpu.X
 	case n:
-		cpu.Operand = cpu.read16(cpu.Spec)
+		return cpu.read16(cpu.Spec)
 	case s:
-		cpu.Operand = cpu.Spec + cpu.SP
+		return cpu.Spec + cpu.SP
 	case sx:
-		cpu.Operand = cpu.Spec + cpu.SP + cpu.X
+		return cpu.Spec + cpu.SP + cpu.X
 	case sf:
-		cpu.Operand = cpu.read16(cpu.SP + cpu.Spec)
+		return cpu.read16(cpu.SP + cpu.Spec)
 	case sxf:
-		cpu.Operand = cpu.read16(cpu.SP+cpu.Spec) + cpu.X
+		return cpu.read16(cpu.SP+cpu.Spec) + cpu.X
 	}
+	return cpu.Spec
 }
 
-func (cpu *Pep8CPU) read16(addr uint16) uint16 {
+// peek16 reads a word without notifying the observers
+func (cpu *Pep8CPU) peek16(addr uint16) uint16 {
 	b1 := uint16(cpu.RAM[addr])
 	b2 := uint16(cpu.RAM[addr+1])
 	return b1<<8 | b2
 }
 
+func (cpu *Pep8CPU) read16(addr uint16) uint16 {
+	val := cpu.peek16(addr)
+	for _, obs := range cpu.Observers {
+		obs.MemoryRead(cpu, addr, 2, val)
+	}
+	return val
+}
+
+func (cpu *Pep8CPU) read8(addr uint16) uint8 {
+	val := cpu.RAM[addr]
+	for _, obs := range cpu.Observers {
+		obs.MemoryRead(cpu, addr, 1, uint16(val))
+	}
+	return val
+}
+
 func (cpu *Pep8CPU) write16(val uint16, addr uint16) {
+	if cpu.blocks != nil {
+		cpu.blocks.written(addr, 2)
+	}
 	cpu.RAM[addr] = uint8(val >> 8)
 	cpu.RAM[addr+1] = uint8(val & 0xFF)
+	for _, obs := range cpu.Observers {
+		obs.MemoryWrite(cpu, addr, 2, val)
+	}
 }
 
 func (cpu *Pep8CPU) write8(val uint8, addr uint16) {
+	if cpu.blocks != nil {
+		cpu.blocks.written(addr, 1)
+	}
 	cpu.RAM[addr] = val
-}
-
-func (cpu *Pep8CPU) needSpec() bool {
-	oc := cpu.opcode
-	switch oc {
-	case STOP, RETTR, MOVSPA, MOVFLGA,
-		NOTA, NOTX,
-		NEGA, NEGX,
-		ASLA, ASLX,
-		ASRA, ASRX,
-		ROLA, ROLX,
-		RORA, RORX,
-		NOP0, NOP1, NOP2, NOP3,
-		RET0, RET1, RET2, RET3, RET4, RET5, RET6, RET7:
-		return false
+	for _, obs := range cpu.Observers {
+		obs.MemoryWrite(cpu, addr, 1, uint16(val))
 	}
-	return true
 }
 
 // Execute the next instruction
 //
-// Returns whether or not to continue execution after that
+// Returns whether or not to continue execution after that, on a fault
+// execution stops and the error is kept in cpu.Fault
 func (cpu *Pep8CPU) Exec() bool {
-	switch cpu.opcode {
-	case STOP:
-		return false
-	case RETTR:
-		fmt.Printf("Unsupported instruction: RETTR\n")
+	op := &decodeTable[cpu.opcode]
+	if op.exec == nil {
 		return false
-	case MOVSPA:
-		cpu.movspa()
-	case MOVFLGA:
-		cpu.movflga()
-	case BRi, BRx:
-		cpu.br()
-	case BRLEi, BRLEx:
-		cpu.brle()
-	case BRLTi, BRLTx:
-		cpu.brlt()
-	case BREQi, BREQx:
-		cpu.breq()
-	case BRNEi, BRNEx:
-		cpu.brne()
-	case BRGEi, BRGEx:
-		cpu.brge()
-	case BRGTi, BRGTx:
-		cpu.brgt()
-	case BRVi, BRVx:
-		cpu.brv()
-	case BRCi, BRCx:
-		cpu.brc()
-	case CALLi, CALLx:
-		cpu.call()
-	case NOTA, NOTX:
-		cpu.not()
-	case NEGA, NEGX:
-		cpu.neg()
-	case ASLA, ASLX:
-		cpu.asl()
-	case ASRA, ASRX:
-		cpu.asr()
-	case ROLA, ROLX:
-		cpu.rol()
-	case RORA, RORX:
-		cpu.ror()
-	case NOP0, NOP1, NOP2, NOP3, NOPi, NOPd, NOPn, NOPs, NOPsf, NOPx, NOPsx, NOPsxf:
-		cpu.nop()
-	case DECIi, DECId, DECIn, DECIs, DECIsf, DECIx, DECIsx, DECIsxf:
-		cpu.deci()
-	case DECOi, DECOd, DECOn, DECOs, DECOsf, DECOx, DECOsx, DECOsxf:
-		cpu.deco()
-	case STROi, STROd, STROn, STROs, STROsf, STROx, STROsx, STROsxf:
-		cpu.stro()
-	case CHARIi, CHARId, CHARIn, CHARIs, CHARIsf, CHARIx, CHARIsx, CHARIsxf:
-		cpu.chari()
-	case CHAROi, CHAROd, CHAROn, CHAROs, CHAROsf, CHAROx, CHAROsx, CHAROsxf:
-		cpu.charo()
-	case RET0, RET1, RET2, RET3, RET4, RET5, RET6, RET7:
-		cpu.ret()
-	case ADDSPi, ADDSPd, ADDSPn, ADDSPs, ADDSPsf, ADDSPx, ADDSPsx, ADDSPsxf:
-		cpu.addsp()
-	case SUBSPi, SUBSPd, SUBSPn, SUBSPs, SUBSPsf, SUBSPx, SUBSPsx, SUBSPsxf:
-		cpu.subsp()
-	case ADDAi, ADDAd, ADDAn, ADDAs, ADDAsf, ADDAx, ADDAsx, ADDAsxf,
-		ADDXi, ADDXd, ADDXn, ADDXs, ADDXsf, ADDXx, ADDXsx, ADDXsxf:
-		cpu.add()
-	case SUBAi, SUBAd, SUBAn, SUBAs, SUBAsf, SUBAx, SUBAsx, SUBAsxf,
-		SUBXi, SUBXd, SUBXn, SUBXs, SUBXsf, SUBXx, SUBXsx, SUBXsxf:
-		cpu.sub()
-	case ANDAi, ANDAd, ANDAn, ANDAs, ANDAsf, ANDAx, ANDAsx, ANDAsxf,
-		ANDXi, ANDXd, ANDXn, ANDXs, ANDXsf, ANDXx, ANDXsx, ANDXsxf:
-		cpu.and()
-	case ORAi, ORAd, ORAn, ORAs, ORAsf, ORAx, ORAsx, ORAsxf,
-		ORXi, ORXd, ORXn, ORXs, ORXsf, ORXx, ORXsx, ORXsxf:
-		cpu.or()
-	case CPAi, CPAd, CPAn, CPAs, CPAsf, CPAx, CPAsx, CPAsxf,
-		CPXi, CPXd, CPXn, CPXs, CPXsf, CPXx, CPXsx, CPXsxf:
-		cpu.cp()
-	case LDAi, LDAd, LDAn, LDAs, LDAsf, LDAx, LDAsx, LDAsxf,
-		LDXi, LDXd, LDXn, LDXs, LDXsf, LDXx, LDXsx, LDXsxf:
-		cpu.ld()
-	case LDBYTEAi, LDBYTEAd, LDBYTEAn, LDBYTEAs, LDBYTEAsf, LDBYTEAx, LDBYTEAsx, LDBYTEAsxf,
-		LDBYTEXi, LDBYTEXd, LDBYTEXn, LDBYTEXs, LDBYTEXsf, LDBYTEXx, LDBYTEXsx, LDBYTEXsxf:
-		cpu.ldbyte()
-	case STAi, STAd, STAn, STAs, STAsf, STAx, STAsx, STAsxf,
-		STXi, STXd, STXn, STXs, STXsf, STXx, STXsx, STXsxf:
-		cpu.st()
-	case STBYTEAi, STBYTEAd, STBYTEAn, STBYTEAs, STBYTEAsf, STBYTEAx, STBYTEAsx, STBYTEAsxf,
-		STBYTEXi, STBYTEXd, STBYTEXn, STBYTEXs, STBYTEXsf, STBYTEXx, STBYTEXsx, STBYTEXsxf:
-		cpu.stbyte()
 	}
+	op.exec(cpu)
+	return cpu.Fault == nil
+}
 
-	return true
+func (cpu *Pep8CPU) rettr() {
+	cpu.Fault = fmt.Errorf("Unsupported instruction: RETTR")
 }
 
 func (cpu *Pep8CPU) movspa() {
@@ -1105,22 +836,7 @@ func (cpu *Pep8CPU) movspa() {
 }
 
 func (cpu *Pep8CPU) movflga() {
-	aval := 0
-
-	if cpu.C {
-		aval |= 1
-	}
-	if cpu.V {
-		aval |= 2
-	}
-	if cpu.Z {
-		aval |= 4
-	}
-	if cpu.N {
-		aval |= 8
-	}
-
-	cpu.A = uint16(aval)
+	cpu.A = cpu.Flags()
 }
 
 func (cpu *Pep8CPU) br() {
@@ -1176,31 +892,20 @@ func (cpu *Pep8CPU) brc() {
 }
 
 func (cpu *Pep8CPU) call() {
-	cpu.SP -= 2
-	cpu.write16(cpu.PC, cpu.SP)
-	cpu.PC = cpu.Operand
+	cpu.Call(cpu.insAddr, cpu.Operand)
 }
 
-func (cpu *Pep8CPU) not() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	val = val ^ uint16(0xFFFF)
-
-	cpu.N = false
-	cpu.Z = false
-
-	if val < 0 {
-		cpu.N = true
-	}
-	if val == 0 {
-		cpu.Z = true
+// reg returns the register of the instruction
+func (cpu *Pep8CPU) reg() uint16 {
+	if cpu.opcode.register() == X {
+		return cpu.X
 	}
+	return cpu.A
+}
 
-	switch reg {
+// setReg sets the register of the instruction
+func (cpu *Pep8CPU) setReg(val uint16) {
+	switch cpu.opcode.register() {
 	case A:
 		cpu.A = val
 	case X:
@@ -1208,410 +913,96 @@ func (cpu *Pep8CPU) not() {
 	}
 }
 
-func (cpu *Pep8CPU) neg() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	val = (val ^ uint16(0xFFFF)) + 1
-
-	cpu.N = false
-	cpu.Z = false
-	cpu.V = false
-
-	if val < 0 {
-		cpu.N = true
-	}
-
-	if val == 0 {
-		cpu.Z = true
-	}
-
-	if val == 0x8000 {
-		cpu.V = true
-	}
+func (cpu *Pep8CPU) not() {
+	cpu.setReg(cpu.Not(cpu.reg()))
+}
 
-	switch reg {
-	case A:
-		cpu.A = val
-	case X:
-		cpu.X = val
-	}
+func (cpu *Pep8CPU) neg() {
+	cpu.setReg(cpu.Neg(cpu.reg()))
 }
 
 func (cpu *Pep8CPU) asl() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	cf := val & 0x8000
-	val = val << 1
-
-	cpu.N = false
-	cpu.Z = false
-	cpu.V = false
-	cpu.C = false
-
-	if cf != 0 {
-		cpu.C = true
-	}
-
-	if val&0x8000 != cf {
-		cpu.V = true
-	}
-
-	if val == 0 {
-		cpu.Z = true
-	}
-
-	if val < 0 {
-		cpu.N = true
-	}
-
-	switch reg {
-	case A:
-		cpu.A = val
-	case X:
-		cpu.X = val
-	}
+	cpu.setReg(cpu.Asl(cpu.reg()))
 }
 
 func (cpu *Pep8CPU) asr() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	sf := val & 0x8000
-	cf := val & 1
-	val = val >> 1
-
-	cpu.N = false
-	cpu.Z = false
-	cpu.C = false
-
-	if cf != 0 {
-		cpu.C = true
-	}
-
-	if val == 0 {
-		cpu.Z = true
-	}
-
-	if val < 0 {
-		cpu.N = true
-	}
-
-	val = sf | val
-
-	switch reg {
-	case A:
-		cpu.A = val
-	case X:
-		cpu.X = val
-	}
+	cpu.setReg(cpu.Asr(cpu.reg()))
 }
 
 func (cpu *Pep8CPU) rol() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	oc := uint16(0)
-	if cpu.C {
-		oc = 1
-	}
-
-	nc := val & 0x8000
-	val = val << 1
-	val |= oc
-
-	cpu.C = false
-	if nc != 0 {
-		cpu.C = true
-	}
-
-	switch reg {
-	case A:
-		cpu.A = val
-	case X:
-		cpu.X = val
-	}
+	cpu.setReg(cpu.Rol(cpu.reg()))
 }
 
 func (cpu *Pep8CPU) ror() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	oc := uint16(0)
-	if cpu.C {
-		oc = 1
-	}
-
-	nc := val & 0x1
-	val = val >> 1
-	val |= oc << 15
-
-	cpu.C = false
-	if nc != 0 {
-		cpu.C = true
-	}
-
-	switch reg {
-	case A:
-		cpu.A = val
-	case X:
-		cpu.X = val
-	}
+	cpu.setReg(cpu.Ror(cpu.reg()))
 }
 
 func (cpu *Pep8CPU) nop() {}
 
 func (cpu *Pep8CPU) deci() {
-	val := deci(cpu.In)
-
-	cpu.N = false
-	cpu.Z = false
-	cpu.V = false
-
-	if val > 32767 {
-		cpu.V = true
-	}
-	if val < -32768 {
-		cpu.V = true
-	}
-
-	if val == 0 {
-		cpu.Z = true
-	}
-
-	if val < 0 {
-		cpu.N = true
-	}
-
-	cpu.write16(uint16(val&0xFFFF), cpu.Operand)
+	cpu.Fault = cpu.Deci(cpu.Operand)
 }
 
 func (cpu *Pep8CPU) deco() {
-	fmt.Fprintf(cpu.Out, "%d", int16(cpu.Operand))
+	cpu.Deco(cpu.Operand)
 }
 
 func (cpu *Pep8CPU) stro() {
-	addr := cpu.Operand
-	for cpu.RAM[addr] != 0 {
-		fmt.Fprintf(cpu.Out, "%c", cpu.RAM[addr])
-		addr++
-	}
+	cpu.Stro(cpu.Operand)
 }
 
 func (cpu *Pep8CPU) chari() {
-	b, err := chari(cpu.In)
-	if err != nil && !cpu.NoEOFChariStop {
-		fmt.Printf("%s\n", err)
-		os.Exit(1)
-	}
-	cpu.RAM[cpu.Operand] = b
+	cpu.Fault = cpu.Chari(cpu.Operand)
 }
 
 func (cpu *Pep8CPU) charo() {
-	chr := cpu.Operand & 0xFF
-	fmt.Fprintf(cpu.Out, "%c", chr)
+	cpu.Charo(uint8(cpu.Operand))
 }
 
 func (cpu *Pep8CPU) ret() {
-	loc := cpu.opcode & 0x7
-	cpu.SP, _, _, _, _ = doadd(cpu.SP, uint16(loc))
-	retaddr := cpu.read16(cpu.SP)
-	cpu.SP += 2
-	cpu.PC = retaddr
+	cpu.Ret(cpu.insAddr, uint16(cpu.opcode&0x7))
 }
 
 func (cpu *Pep8CPU) addsp() {
-	res, n, z, v, c := doadd(cpu.SP, cpu.Operand)
-	cpu.SP = res
-	cpu.N = n
-	cpu.Z = z
-	cpu.V = v
-	cpu.C = c
+	cpu.SP = cpu.Add(cpu.SP, cpu.Operand)
 }
 
 func (cpu *Pep8CPU) subsp() {
-	res, n, z, v, c := dosub(cpu.SP, cpu.Operand)
-	cpu.SP = res
-	cpu.N = n
-	cpu.Z = z
-	cpu.V = v
-	cpu.C = c
+	cpu.SP = cpu.Sub(cpu.SP, cpu.Operand)
 }
 
 func (cpu *Pep8CPU) add() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	res, n, z, v, c := doadd(val, cpu.Operand)
-	cpu.N = n
-	cpu.Z = z
-	cpu.V = v
-	cpu.C = c
-
-	switch reg {
-	case A:
-		cpu.A = res
-	case X:
-		cpu.X = res
-	}
+	cpu.setReg(cpu.Add(cpu.reg(), cpu.Operand))
 }
 
 func (cpu *Pep8CPU) sub() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	res, n, z, v, c := dosub(val, cpu.Operand)
-	cpu.N = n
-	cpu.Z = z
-	cpu.V = v
-	cpu.C = c
-
-	switch reg {
-	case A:
-		cpu.A = res
-	case X:
-		cpu.X = res
-	}
+	cpu.setReg(cpu.Sub(cpu.reg(), cpu.Operand))
 }
 
 func (cpu *Pep8CPU) and() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	val = val & cpu.Operand
-
-	cpu.Z = false
-	cpu.N = false
-
-	if val == 0 {
-		cpu.Z = true
-	}
-	if val >= 0x8000 {
-		cpu.N = true
-	}
-
-	switch reg {
-	case A:
-		cpu.A = val
-	case X:
-		cpu.X = val
-	}
+	cpu.setReg(cpu.And(cpu.reg(), cpu.Operand))
 }
 
 func (cpu *Pep8CPU) or() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	val = val | cpu.Operand
-
-	cpu.Z = false
-	cpu.N = false
-
-	if val == 0 {
-		cpu.Z = true
-	}
-	if val >= 0x8000 {
-		cpu.N = true
-	}
-
-	switch reg {
-	case A:
-		cpu.A = val
-	case X:
-		cpu.X = val
-	}
+	cpu.setReg(cpu.Or(cpu.reg(), cpu.Operand))
 }
 
 func (cpu *Pep8CPU) cp() {
-	reg := cpu.opcode.register()
-	val := cpu.A
-	if reg == X {
-		val = cpu.X
-	}
-
-	_, n, z, v, c := dosub(val, cpu.Operand)
-	cpu.N = n
-	cpu.Z = z
-	cpu.V = v
-	cpu.C = c
+	cpu.Sub(cpu.reg(), cpu.Operand)
 }
 
 func (cpu *Pep8CPU) ld() {
-	switch cpu.opcode.register() {
-	case A:
-		cpu.A = cpu.Operand
-	case X:
-		cpu.X = cpu.Operand
-	}
-
-	cpu.Z = false
-	cpu.N = false
-	if cpu.Operand == 0 {
-		cpu.Z = true
-	}
-	if cpu.Operand >= 0x8000 {
-		cpu.N = true
-	}
+	cpu.setReg(cpu.Ld(cpu.Operand))
 }
 
 func (cpu *Pep8CPU) ldbyte() {
-	switch cpu.opcode.register() {
-	case A:
-		cpu.A = cpu.Operand & 0xFF
-	case X:
-		cpu.X = cpu.Operand & 0xFF
-	}
-
-	cpu.Z = false
-	cpu.N = false
-	if cpu.Operand == 0 {
-		cpu.Z = true
-	}
-	if cpu.Operand >= 0x8000 {
-		cpu.N = true
-	}
+	cpu.setReg(cpu.LdByte(cpu.reg(), cpu.Operand))
 }
 
 func (cpu *Pep8CPU) st() {
-	val := cpu.A
-	if cpu.opcode.register() == X {
-		val = cpu.X
-	}
-	cpu.write16(val, cpu.Operand)
+	cpu.write16(cpu.reg(), cpu.Operand)
 }
 
 func (cpu *Pep8CPU) stbyte() {
-	val := cpu.A
-	if cpu.opcode.register() == X {
-		val = cpu.X
-	}
-	cpu.write8(uint8(val&0xFF), cpu.Operand)
+	cpu.write8(uint8(cpu.reg()&0xFF), cpu.Operand)
 }
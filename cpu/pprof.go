@@ -0,0 +1,147 @@
+package cpu
+
+// A minimal encoder for the pprof profile format, a gzipped protocol buffer
+// as described in github.com/google/pprof/proto/profile.proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// Field numbers of the messages of profile.proto
+const (
+	profSampleType    = 1
+	profSample        = 2
+	profMapping       = 3
+	profLocation      = 4
+	profFunction      = 5
+	profStringTable   = 6
+	profTimeNanos     = 9
+	profDurationNanos = 10
+	profPeriodType    = 11
+	profPeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+	sampleLabel      = 3
+
+	labelKey = 1
+	labelStr = 2
+
+	mappingID             = 1
+	mappingMemoryStart    = 2
+	mappingMemoryLimit    = 3
+	mappingFilename       = 5
+	mappingHasFunctions   = 7
+	mappingHasFilenames   = 8
+	mappingHasLineNumbers = 9
+
+	locationID        = 1
+	locationMappingID = 2
+	locationAddress   = 3
+	locationLine      = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID        = 1
+	functionName      = 2
+	functionSysName   = 3
+	functionFilename  = 4
+	functionStartLine = 5
+)
+
+// protoBuf encodes the fields of a protocol buffer message
+type protoBuf struct {
+	bytes.Buffer
+}
+
+func (pb *protoBuf) varint(v uint64) {
+	for v >= 0x80 {
+		pb.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	pb.WriteByte(byte(v))
+}
+
+func (pb *protoBuf) tag(field, wire int) {
+	pb.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// uint64 writes a varint field, zero values are omitted as in proto3
+func (pb *protoBuf) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	pb.tag(field, 0)
+	pb.varint(v)
+}
+
+func (pb *protoBuf) int64(field int, v int64) {
+	pb.uint64(field, uint64(v))
+}
+
+func (pb *protoBuf) bool(field int, v bool) {
+	if v {
+		pb.uint64(field, 1)
+	}
+}
+
+func (pb *protoBuf) bytes(field int, b []byte) {
+	pb.tag(field, 2)
+	pb.varint(uint64(len(b)))
+	pb.Write(b)
+}
+
+func (pb *protoBuf) string(field int, s string) {
+	pb.tag(field, 2)
+	pb.varint(uint64(len(s)))
+	pb.WriteString(s)
+}
+
+func (pb *protoBuf) message(field int, msg *protoBuf) {
+	pb.bytes(field, msg.Bytes())
+}
+
+func (pb *protoBuf) packed(field int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	tmp := protoBuf{}
+	for _, v := range vs {
+		tmp.varint(v)
+	}
+	pb.bytes(field, tmp.Bytes())
+}
+
+// stringTable interns the strings of a profile, the first one must be ""
+type stringTable struct {
+	strs []string
+	idx  map[string]int64
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{strs: []string{""}, idx: map[string]int64{"": 0}}
+}
+
+func (st *stringTable) index(s string) int64 {
+	if idx, ok := st.idx[s]; ok {
+		return idx
+	}
+	st.idx[s] = int64(len(st.strs))
+	st.strs = append(st.strs, s)
+	return st.idx[s]
+}
+
+// writeGzipped compresses the encoded profile to w
+func writeGzipped(w io.Writer, pb *protoBuf) error {
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(pb.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,256 @@
+package cpu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// profKey is a location in the program, and the calls that led to it
+type profKey struct {
+	// stack holds the site and callee of the active calls, 4 bytes per call
+	stack    string
+	pc       uint16
+	mnemonic string
+}
+
+// Profiler is an Observer that counts the instructions executed, per
+// address, per instruction, and per call stack
+//
+// Instructions are attributed to the subroutine they execute in, from the
+// CALLs and RETs of the program.
+type Profiler struct {
+	NopObserver
+
+	// Addrs is the number of times the instruction at each address executed
+	Addrs [0x10000]uint64
+	// Mnemonics is the number of times each instruction executed
+	Mnemonics map[string]uint64
+	// Total is the number of instructions executed
+	Total uint64
+
+	calls   CallStack
+	stack   string
+	samples map[profKey]int64
+	start   time.Time
+}
+
+// NewProfiler creates an empty profile
+func NewProfiler() *Profiler {
+	return &Profiler{
+		Mnemonics: map[string]uint64{},
+		samples:   map[profKey]int64{},
+		start:     time.Now(),
+	}
+}
+
+func (prof *Profiler) BeforeInstruction(cpu *Pep8CPU, ins Instruction) {
+	prof.Addrs[ins.Addr]++
+	prof.Mnemonics[ins.Mnemonic]++
+	prof.Total++
+	prof.samples[profKey{prof.stack, ins.Addr, ins.Mnemonic}]++
+}
+
+func (prof *Profiler) Call(cpu *Pep8CPU, site, target, sp uint16) {
+	prof.calls.Call(cpu, site, target, sp)
+	prof.updateStack()
+}
+
+func (prof *Profiler) Return(cpu *Pep8CPU, site, target, sp uint16) {
+	prof.calls.Return(cpu, site, target, sp)
+	prof.updateStack()
+}
+
+func (prof *Profiler) updateStack() {
+	stack := make([]byte, 0, 4*len(prof.calls.Frames))
+	for _, fr := range prof.calls.Frames {
+		stack = append(stack, byte(fr.Site>>8), byte(fr.Site), byte(fr.Callee>>8), byte(fr.Callee))
+	}
+	prof.stack = string(stack)
+}
+
+// WritePprof writes the profile in the pprof format to w
+//
+// Subroutines are named after the symbols of lst, and every address is
+// attributed to its line in the listing, so that `go tool pprof -list`
+// annotates the listing. lst may be nil, program is the name of the
+// program in the profile.
+func (prof *Profiler) WritePprof(w io.Writer, program string, lst *Listing) error {
+	strs := newStringTable()
+	names := CallStack{Symbols: lst}
+	filename := program
+	if lst != nil && lst.Path != "" {
+		filename = lst.Path
+	}
+	lineOf := func(addr uint16) int64 {
+		if lst == nil {
+			return 0
+		}
+		num, _ := lst.LineAt(addr)
+		return int64(num)
+	}
+
+	// Functions are keyed by their entry point, main is -1
+	funcs := map[int]uint64{}
+	funcMsgs := []*protoBuf{}
+	function := func(entry int) uint64 {
+		if id, ok := funcs[entry]; ok {
+			return id
+		}
+		id := uint64(len(funcs) + 1)
+		funcs[entry] = id
+
+		name := "main"
+		start := uint16(0)
+		if entry >= 0 {
+			start = uint16(entry)
+			name = names.Name(start)
+		}
+		msg := &protoBuf{}
+		msg.uint64(functionID, id)
+		msg.int64(functionName, strs.index(name))
+		msg.int64(functionSysName, strs.index(name))
+		msg.int64(functionFilename, strs.index(filename))
+		msg.int64(functionStartLine, lineOf(start))
+		funcMsgs = append(funcMsgs, msg)
+		return id
+	}
+
+	// Locations are keyed by address and function, as the same code may
+	// run within different subroutines
+	type locKey struct {
+		addr  uint16
+		entry int
+	}
+	locs := map[locKey]uint64{}
+	locMsgs := []*protoBuf{}
+	location := func(addr uint16, entry int) uint64 {
+		key := locKey{addr, entry}
+		if id, ok := locs[key]; ok {
+			return id
+		}
+		id := uint64(len(locs) + 1)
+		locs[key] = id
+
+		line := &protoBuf{}
+		line.uint64(lineFunctionID, function(entry))
+		line.int64(lineLine, lineOf(addr))
+		msg := &protoBuf{}
+		msg.uint64(locationID, id)
+		msg.uint64(locationMappingID, 1)
+		msg.uint64(locationAddress, uint64(addr))
+		msg.message(locationLine, line)
+		locMsgs = append(locMsgs, msg)
+		return id
+	}
+
+	// Samples are sorted for a deterministic output
+	keys := make([]profKey, 0, len(prof.samples))
+	for key := range prof.samples {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stack != keys[j].stack {
+			return keys[i].stack < keys[j].stack
+		}
+		if keys[i].pc != keys[j].pc {
+			return keys[i].pc < keys[j].pc
+		}
+		return keys[i].mnemonic < keys[j].mnemonic
+	})
+
+	pb := &protoBuf{}
+	insType := &protoBuf{}
+	insType.int64(valueTypeType, strs.index("instructions"))
+	insType.int64(valueTypeUnit, strs.index("count"))
+	pb.message(profSampleType, insType)
+
+	mnemonicKey := strs.index("instruction")
+	for _, key := range keys {
+		// Locations go from the innermost one to main, the entry of the
+		// function of each location is the callee of the enclosing call
+		ids := []uint64{}
+		pc := key.pc
+		for off := len(key.stack); off >= 0; off -= 4 {
+			entry := -1
+			if off > 0 {
+				entry = int(key.stack[off-2])<<8 | int(key.stack[off-1])
+			}
+			ids = append(ids, location(pc, entry))
+			if off > 0 {
+				pc = uint16(key.stack[off-4])<<8 | uint16(key.stack[off-3])
+			}
+		}
+
+		label := &protoBuf{}
+		label.int64(labelKey, mnemonicKey)
+		label.int64(labelStr, strs.index(key.mnemonic))
+		sample := &protoBuf{}
+		sample.packed(sampleLocationID, ids)
+		sample.packed(sampleValue, []uint64{uint64(prof.samples[key])})
+		sample.message(sampleLabel, label)
+		pb.message(profSample, sample)
+	}
+
+	mapping := &protoBuf{}
+	mapping.uint64(mappingID, 1)
+	mapping.uint64(mappingMemoryLimit, 0x10000)
+	mapping.int64(mappingFilename, strs.index(program))
+	mapping.bool(mappingHasFunctions, true)
+	mapping.bool(mappingHasFilenames, lst != nil)
+	mapping.bool(mappingHasLineNumbers, lst != nil)
+	pb.message(profMapping, mapping)
+
+	for _, msg := range locMsgs {
+		pb.message(profLocation, msg)
+	}
+	for _, msg := range funcMsgs {
+		pb.message(profFunction, msg)
+	}
+
+	periodType := &protoBuf{}
+	periodType.int64(valueTypeType, strs.index("instructions"))
+	periodType.int64(valueTypeUnit, strs.index("count"))
+	for _, s := range strs.strs {
+		pb.string(profStringTable, s)
+	}
+	pb.int64(profTimeNanos, prof.start.UnixNano())
+	pb.int64(profDurationNanos, int64(time.Since(prof.start)))
+	pb.message(profPeriodType, periodType)
+	pb.int64(profPeriod, 1)
+
+	return writeGzipped(w, pb)
+}
+
+// WriteFolded writes the profile as folded stacks, one line per call stack
+// with the number of instructions executed in it, e.g. `main;fib;fib 123`,
+// as read by flamegraph tools
+//
+// Subroutines are named after the symbols of lst, which may be nil.
+func (prof *Profiler) WriteFolded(w io.Writer, lst *Listing) error {
+	names := CallStack{Symbols: lst}
+	counts := map[string]int64{}
+	for key, n := range prof.samples {
+		stack := []string{"main"}
+		for off := 0; off < len(key.stack); off += 4 {
+			callee := uint16(key.stack[off+2])<<8 | uint16(key.stack[off+3])
+			stack = append(stack, names.Name(callee))
+		}
+		counts[strings.Join(stack, ";")] += n
+	}
+
+	stacks := make([]string, 0, len(counts))
+	for stack := range counts {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	bw := bufio.NewWriter(w)
+	for _, stack := range stacks {
+		fmt.Fprintf(bw, "%s %d\n", stack, counts[stack])
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,123 @@
+package cpu
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// callListing is the listing of callProgram
+const callListing = `-------------------------------------------------------------------------------
+      Object
+Addr  code   Symbol   Mnemon  Operand     Comment
+-------------------------------------------------------------------------------
+0000  160007          CALL    sub,i
+0003  500041          CHARO   'A',i
+0006  00              STOP
+0007  490010 sub:     CHARI   0x0010,d
+000A  58              RET0
+000B                  .END
+-------------------------------------------------------------------------------
+`
+
+func profile(t *testing.T) (*Profiler, *Listing) {
+	lst, err := ParseListing(strings.NewReader(callListing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := NewProfiler()
+	observe(callProgram, "z", prof)
+	return prof, lst
+}
+
+func TestProfiler(t *testing.T) {
+	prof, _ := profile(t)
+	if prof.Total != 5 {
+		t.Errorf("%d instructions, want 5", prof.Total)
+	}
+	for addr, want := range map[uint16]uint64{0x0000: 1, 0x0003: 1, 0x0007: 1, 0x000A: 1, 0x0001: 0} {
+		if prof.Addrs[addr] != want {
+			t.Errorf("%d instructions at %04x, want %d", prof.Addrs[addr], addr, want)
+		}
+	}
+	if prof.Mnemonics["CHARI"] != 1 || prof.Mnemonics["LDA"] != 0 {
+		t.Errorf("mnemonics %v", prof.Mnemonics)
+	}
+}
+
+// TestPprof decodes the profile with go tool pprof
+func TestPprof(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go tool pprof")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+
+	prof, lst := profile(t)
+	path := filepath.Join(t.TempDir(), "prog.pb.gz")
+	out := &bytes.Buffer{}
+	if err := prof.WritePprof(out, "prog", lst); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := exec.Command(goTool, "tool", "pprof", "-raw", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go tool pprof: %s\n%s", err, raw)
+	}
+
+	// The samples are the instructions, with their stack, the locations
+	// are named after the subroutines and the lines of the listing
+	text := strings.ReplaceAll(string(raw), " \n", "\n")
+	samples := text[strings.Index(text, "Samples:"):strings.Index(text, "Mappings")]
+	want := `Samples:
+instructions/count
+          1: 1
+                instruction:[CALL]
+          1: 2
+                instruction:[CHARO]
+          1: 3
+                instruction:[STOP]
+          1: 4 1
+                instruction:[CHARI]
+          1: 5 1
+                instruction:[RET0]
+Locations
+     1: 0x0 M=1 main prog:5:0 s=5
+     2: 0x3 M=1 main prog:6:0 s=5
+     3: 0x6 M=1 main prog:7:0 s=5
+     4: 0x7 M=1 sub prog:8:0 s=8
+     5: 0xa M=1 sub prog:9:0 s=8
+`
+	if samples != want {
+		t.Errorf("decoded profile:\n%s\nwant:\n%s", samples, want)
+	}
+	if !strings.HasPrefix(text, "PeriodType: instructions count\nPeriod: 1\n") {
+		t.Errorf("decoded profile header:\n%s", text)
+	}
+}
+
+func TestFolded(t *testing.T) {
+	prof, lst := profile(t)
+	out := &bytes.Buffer{}
+	if err := prof.WriteFolded(out, lst); err != nil {
+		t.Fatal(err)
+	}
+	if want := "main 3\nmain;sub 2\n"; out.String() != want {
+		t.Errorf("folded stacks %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	if err := prof.WriteFolded(out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := "main 3\nmain;0x0007 2\n"; out.String() != want {
+		t.Errorf("folded stacks without listing %q, want %q", out.String(), want)
+	}
+}
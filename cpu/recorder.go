@@ -0,0 +1,139 @@
+package cpu
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Access is a write to memory
+type Access struct {
+	Addr uint16
+	Size int
+	Val  uint16
+}
+
+// Record is an executed instruction, with the state of the cpu after it
+type Record struct {
+	Ins        Instruction
+	A, X       uint16
+	SP, PC     uint16
+	N, Z, V, C bool
+	// Writes are the memory writes done by the instruction
+	Writes []Access
+	// In and Out are the bytes read and written by the instruction
+	In, Out []byte
+	// Fault is the error raised by the instruction, if any
+	Fault error
+}
+
+func (rec Record) String() string {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "%04x  %-18s A=%04x X=%04x SP=%04x N=%d Z=%d V=%d C=%d",
+		rec.Ins.Addr, rec.Ins, rec.A, rec.X, rec.SP,
+		booltoInt(rec.N), booltoInt(rec.Z), booltoInt(rec.V), booltoInt(rec.C))
+	for _, wr := range rec.Writes {
+		if wr.Size == 1 {
+			fmt.Fprintf(&sb, " [%04x]<-%02x", wr.Addr, wr.Val)
+		} else {
+			fmt.Fprintf(&sb, " [%04x]<-%04x", wr.Addr, wr.Val)
+		}
+	}
+	if len(rec.In) > 0 {
+		fmt.Fprintf(&sb, " in %q", rec.In)
+	}
+	if len(rec.Out) > 0 {
+		fmt.Fprintf(&sb, " out %q", rec.Out)
+	}
+	if rec.Fault != nil {
+		fmt.Fprintf(&sb, " fault: %s", rec.Fault)
+	}
+	return sb.String()
+}
+
+// Recorder is an Observer that remembers the last instructions executed,
+// as a flight recorder to see what led to a fault
+type Recorder struct {
+	NopObserver
+
+	// records is a ring buffer, next is the slot of the next instruction
+	records []Record
+	next    int
+	full    bool
+}
+
+// NewRecorder creates a recorder of the last n instructions
+func NewRecorder(n int) *Recorder {
+	if n < 1 {
+		n = 1
+	}
+	return &Recorder{records: make([]Record, n)}
+}
+
+func (rc *Recorder) current() *Record {
+	return &rc.records[rc.next]
+}
+
+func (rc *Recorder) BeforeInstruction(cpu *Pep8CPU, ins Instruction) {
+	// Slots are reused to avoid allocating on every instruction
+	rec := rc.current()
+	*rec = Record{
+		Ins:    ins,
+		Writes: rec.Writes[:0],
+		In:     rec.In[:0],
+		Out:    rec.Out[:0],
+	}
+}
+
+func (rc *Recorder) MemoryWrite(cpu *Pep8CPU, addr uint16, size int, val uint16) {
+	rec := rc.current()
+	rec.Writes = append(rec.Writes, Access{addr, size, val})
+}
+
+func (rc *Recorder) Input(cpu *Pep8CPU, b byte) {
+	rec := rc.current()
+	rec.In = append(rec.In, b)
+}
+
+func (rc *Recorder) Output(cpu *Pep8CPU, b byte) {
+	rec := rc.current()
+	rec.Out = append(rec.Out, b)
+}
+
+func (rc *Recorder) AfterInstruction(cpu *Pep8CPU, ins Instruction) {
+	rec := rc.current()
+	rec.A, rec.X = cpu.A, cpu.X
+	rec.SP, rec.PC = cpu.SP, cpu.PC
+	rec.N, rec.Z, rec.V, rec.C = cpu.N, cpu.Z, cpu.V, cpu.C
+	rec.Fault = cpu.Fault
+
+	rc.next++
+	if rc.next == len(rc.records) {
+		rc.next = 0
+		rc.full = true
+	}
+}
+
+// Records returns a copy of the recorded instructions, the oldest first
+func (rc *Recorder) Records() []Record {
+	recs := []Record{}
+	if rc.full {
+		recs = append(recs, rc.records[rc.next:]...)
+	}
+	recs = append(recs, rc.records[:rc.next]...)
+	// The slots and their slices are reused by the next instructions
+	for idx := range recs {
+		rec := &recs[idx]
+		rec.Writes = append([]Access(nil), rec.Writes...)
+		rec.In = append([]byte(nil), rec.In...)
+		rec.Out = append([]byte(nil), rec.Out...)
+	}
+	return recs
+}
+
+// Dump writes the recorded instructions to w, one per line, the oldest first
+func (rc *Recorder) Dump(w io.Writer) {
+	for _, rec := range rc.Records() {
+		fmt.Fprintln(w, rec)
+	}
+}
@@ -0,0 +1,129 @@
+package cpu
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// storeLoopProgram stores A and outputs a character 3 times, 14 instructions
+var storeLoopProgram = []byte{
+	0xC0, 0x00, 0x03, // 0000 LDA 3,i
+	0xE1, 0x00, 0x20, // 0003 loop: STA 0x0020,d
+	0x50, 0x00, 0x78, // 0006 CHARO 'x',i
+	0x80, 0x00, 0x01, // 0009 SUBA 1,i
+	0x0C, 0x00, 0x03, // 000C BRNE loop,i
+	0x00, // 000F STOP
+}
+
+var storeLoopAddrs = []uint16{0x0, 0x3, 0x6, 0x9, 0xC, 0x3, 0x6, 0x9, 0xC, 0x3, 0x6, 0x9, 0xC, 0xF}
+
+func recordedAddrs(rc *Recorder) []uint16 {
+	addrs := []uint16{}
+	for _, rec := range rc.Records() {
+		addrs = append(addrs, rec.Ins.Addr)
+	}
+	return addrs
+}
+
+func TestRecorderRing(t *testing.T) {
+	for _, n := range []int{-1, 0, 1, 4, 5, 13, 14, 15, 100} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			rc := NewRecorder(n)
+			observe(storeLoopProgram, "", rc)
+
+			// The last min(n, 14) instructions, at least one is kept
+			keep := n
+			if keep < 1 {
+				keep = 1
+			}
+			if keep > len(storeLoopAddrs) {
+				keep = len(storeLoopAddrs)
+			}
+			want := storeLoopAddrs[len(storeLoopAddrs)-keep:]
+			if got := recordedAddrs(rc); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("records at %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestRecorderRecords(t *testing.T) {
+	rc := NewRecorder(5)
+	observe(storeLoopProgram, "", rc)
+	recs := rc.Records()
+	if len(recs) != 5 {
+		t.Fatalf("%d records, want 5", len(recs))
+	}
+
+	// The slots are reused, the writes and output of the instructions
+	// recorded before must not remain
+	sta, charo, suba, brne, stop := recs[0], recs[1], recs[2], recs[3], recs[4]
+	if len(sta.Writes) != 1 || sta.Writes[0] != (Access{0x0020, 2, 1}) || len(sta.Out) != 0 {
+		t.Errorf("STA recorded %v, out %q", sta.Writes, sta.Out)
+	}
+	if len(charo.Writes) != 0 || string(charo.Out) != "x" {
+		t.Errorf("CHARO recorded %v, out %q", charo.Writes, charo.Out)
+	}
+	if len(suba.Writes) != 0 || len(suba.Out) != 0 || suba.A != 0 || !suba.Z {
+		t.Errorf("SUBA recorded %+v", suba)
+	}
+	if len(brne.Writes) != 0 || brne.PC != 0x000F {
+		t.Errorf("BRNE recorded %+v", brne)
+	}
+	if stop.Ins.Mnemonic != "STOP" || stop.Fault != nil {
+		t.Errorf("STOP recorded %+v", stop)
+	}
+
+	out := &bytes.Buffer{}
+	rc.Dump(out)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("dump of %d lines, want 5:\n%s", len(lines), out)
+	}
+	for idx, want := range []string{"[0020]<-0001", `out "x"`, "A=0000", "000c  BRNE", "STOP"} {
+		if !strings.Contains(lines[idx], want) {
+			t.Errorf("dump line %q, want %s", lines[idx], want)
+		}
+	}
+}
+
+func TestRecorderFault(t *testing.T) {
+	rc := NewRecorder(3)
+	// CHARI without input faults
+	observe(callProgram, "", rc)
+	recs := rc.Records()
+	if len(recs) != 2 {
+		t.Fatalf("%d records, want 2", len(recs))
+	}
+	if last := recs[1]; last.Ins.Addr != 0x0007 || last.Fault == nil {
+		t.Errorf("last record %+v, want the fault of CHARI", last)
+	}
+	if !strings.Contains(recs[1].String(), "fault: ") {
+		t.Errorf("record %q without its fault", recs[1])
+	}
+}
+
+func TestRecorderCopy(t *testing.T) {
+	// The records returned are not overwritten as the ring wraps
+	rc := NewRecorder(4)
+	cpu := NewPep8Cpu()
+	cpu.Load(storeLoopProgram)
+	cpu.Out = &bytes.Buffer{}
+	cpu.Observers = []Observer{rc}
+	cpu.DoNextCycle()
+	cpu.DoNextCycle()
+	recs := rc.Records()
+	for cpu.DoNextCycle() {
+	}
+	if recs[1].Ins.Addr != 0x0003 || len(recs[1].Writes) != 1 || recs[1].Writes[0] != (Access{0x0020, 2, 3}) {
+		t.Errorf("record of STA overwritten: %s", recs[1])
+	}
+
+	recs = rc.Records()
+	recs[0].Writes = append(recs[0].Writes[:0], Access{0x0000, 1, 0})
+	if got := rc.Records(); got[0].Ins.Addr != 0x0006 || len(got[0].Writes) != 0 {
+		t.Errorf("record changed through its copy: %s", got[0])
+	}
+}
@@ -0,0 +1,141 @@
+package cpu
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SuiteCase is a run of a program of a test directory laid out as
+// cpu_tests/tests: a test is a directory with a single object program, and
+// either the files of its run or a subtests directory with a directory of
+// files per subtest. The files are input, expected_output and
+// expected_trace, the trace being the one of qdpep8cli -t.
+type SuiteCase struct {
+	// Name is the test, then the subtest if any, e.g. 08-fib/zero
+	Name    string
+	Program string
+	// Dir holds the files of the run
+	Dir string
+	// Err is set when the test is not laid out as expected, it cannot run
+	Err error
+}
+
+// FindSuite returns the runs of the tests in dir, in the order of their
+// names, the tests laid out otherwise are returned with their Err set
+func FindSuite(dir string) ([]SuiteCase, error) {
+	tests, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	cases := []SuiteCase{}
+	for _, test := range tests {
+		if !test.IsDir() {
+			continue
+		}
+		testDir := filepath.Join(dir, test.Name())
+		programs, err := filepath.Glob(filepath.Join(testDir, "*.pepo"))
+		if err != nil {
+			return nil, err
+		}
+		if len(programs) != 1 {
+			cases = append(cases, SuiteCase{
+				Name: test.Name(),
+				Dir:  testDir,
+				Err:  fmt.Errorf("%s: %d object programs, expected 1", testDir, len(programs)),
+			})
+			continue
+		}
+
+		subs, err := os.ReadDir(filepath.Join(testDir, "subtests"))
+		if os.IsNotExist(err) {
+			cases = append(cases, SuiteCase{Name: test.Name(), Program: programs[0], Dir: testDir})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, sub := range subs {
+			if sub.IsDir() {
+				cases = append(cases, SuiteCase{
+					Name:    test.Name() + "/" + sub.Name(),
+					Program: programs[0],
+					Dir:     filepath.Join(testDir, "subtests", sub.Name()),
+				})
+			}
+		}
+	}
+	return cases, nil
+}
+
+// Job returns the traced job of the run, a missing input is empty
+func (sc SuiteCase) Job() (Job, error) {
+	if sc.Err != nil {
+		return Job{}, sc.Err
+	}
+	prgm, err := ReadObjectFile(sc.Program)
+	if err != nil {
+		return Job{}, err
+	}
+	in, err := os.ReadFile(filepath.Join(sc.Dir, "input"))
+	if err != nil && !os.IsNotExist(err) {
+		return Job{}, err
+	}
+	return Job{Program: prgm, Input: in, Trace: true}, nil
+}
+
+// Check compares the result of the run to its expected files, it returns a
+// description of each mismatch, none if the run passed
+func (sc SuiteCase) Check(res Result) []string {
+	failures := []string{}
+	for _, golden := range []struct {
+		file string
+		got  []byte
+	}{
+		{"expected_output", res.Output},
+		{"expected_trace", res.Trace},
+	} {
+		want, err := os.ReadFile(filepath.Join(sc.Dir, golden.file))
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		if bytes.Equal(golden.got, want) {
+			continue
+		}
+		if golden.file == "expected_trace" {
+			failures = append(failures, traceMismatch(want, golden.got))
+			continue
+		}
+		failures = append(failures, fmt.Sprintf("output mismatch:\ngot:  %q\nwant: %q", golden.got, want))
+	}
+	return failures
+}
+
+// traceMismatch describes how two traces differ
+func traceMismatch(want, got []byte) string {
+	expected, err := ParseTrace(bytes.NewReader(want))
+	if err != nil {
+		return fmt.Sprintf("trace mismatch, the expected trace is invalid: %s", err)
+	}
+	actual, err := ParseTrace(bytes.NewReader(got))
+	if err != nil {
+		return fmt.Sprintf("trace mismatch, the trace is invalid: %s", err)
+	}
+	td := DiffTraces(expected, actual)
+	if td.Equal() {
+		// The steps are the same, the lines that are not steps differ,
+		// e.g. the fault
+		return fmt.Sprintf("trace mismatch after the steps:\ngot:  %q\nwant: %q", lastLine(got), lastLine(want))
+	}
+	report := &bytes.Buffer{}
+	td.Report(report, 3)
+	return "trace mismatch: " + report.String()
+}
+
+// lastLine returns the last line of a text
+func lastLine(text []byte) []byte {
+	text = bytes.TrimSuffix(text, []byte("\n"))
+	return text[bytes.LastIndexByte(text, '\n')+1:]
+}
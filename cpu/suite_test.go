@@ -0,0 +1,54 @@
+package cpu
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "write the expected output and trace of the tests of cpu_tests from the current results")
+
+// suiteDir holds the tests of cpu_tests
+const suiteDir = "../cpu_tests/tests"
+
+// suiteMaxSteps stops the programs of the suite that never stop
+const suiteMaxSteps = 10000000
+
+func suiteCases(t *testing.T) []SuiteCase {
+	cases, err := FindSuite(suiteDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("no test found in " + suiteDir)
+	}
+	return cases
+}
+
+func TestSuite(t *testing.T) {
+	for _, sc := range suiteCases(t) {
+		sc := sc
+		t.Run(sc.Name, func(t *testing.T) {
+			t.Parallel()
+			job, err := sc.Job()
+			if err != nil {
+				t.Fatal(err)
+			}
+			job.MaxSteps = suiteMaxSteps
+			res := RunJob(job)
+
+			if *update {
+				for file, got := range map[string][]byte{"expected_output": res.Output, "expected_trace": res.Trace} {
+					if err := os.WriteFile(filepath.Join(sc.Dir, file), got, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return
+			}
+			for _, failure := range sc.Check(res) {
+				t.Error(failure)
+			}
+		})
+	}
+}
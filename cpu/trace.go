@@ -0,0 +1,316 @@
+package cpu
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// TraceFormat is the format of the lines written by a Tracer
+type TraceFormat int
+
+const (
+	// TraceText is the format of Pep8CPU.Trace, fields are ignored
+	TraceText TraceFormat = iota
+	// TraceJSON writes a JSON object per instruction, i.e. JSON Lines
+	TraceJSON
+	// TraceCSV writes a header, then a row per instruction
+	TraceCSV
+)
+
+// ParseTraceFormat parses a format name: text, jsonl or csv
+func ParseTraceFormat(name string) (TraceFormat, error) {
+	switch name {
+	case "text":
+		return TraceText, nil
+	case "jsonl", "json":
+		return TraceJSON, nil
+	case "csv":
+		return TraceCSV, nil
+	}
+	return TraceText, fmt.Errorf("unknown trace format %q, expected text, jsonl or csv", name)
+}
+
+// TraceField is a value written for every instruction in a structured trace
+type TraceField string
+
+const (
+	// FieldStep is the number of instructions executed, starting at 1
+	FieldStep TraceField = "step"
+	// FieldAddr is the address of the instruction
+	FieldAddr TraceField = "addr"
+	// FieldPC, FieldSP, FieldA and FieldX are the registers after the instruction
+	FieldPC TraceField = "pc"
+	FieldSP TraceField = "sp"
+	FieldA  TraceField = "a"
+	FieldX  TraceField = "x"
+	// FieldOpcode is the instruction specifier
+	FieldOpcode TraceField = "opcode"
+	// FieldSpec is the operand specifier
+	FieldSpec TraceField = "spec"
+	// FieldOperand is the resolved operand
+	FieldOperand TraceField = "operand"
+	// FieldEffAddr is the address of the operand in memory, empty if immediate
+	FieldEffAddr TraceField = "effaddr"
+	// FieldFlags are the N, Z, V and C flags, as 4 fields
+	FieldFlags TraceField = "flags"
+	// FieldMnemonic is the instruction, e.g. LDA
+	FieldMnemonic TraceField = "mnemonic"
+	// FieldMode is the addressing mode, empty for unary instructions
+	FieldMode TraceField = "mode"
+	// FieldWrites are the memory writes, as `addr:value` in hexadecimal
+	FieldWrites TraceField = "writes"
+	// FieldIn and FieldOut are the bytes read and written by the instruction
+	FieldIn  TraceField = "in"
+	FieldOut TraceField = "out"
+)
+
+// AllTraceFields are all the fields, in the order they are written
+var AllTraceFields = []TraceField{
+	FieldStep, FieldAddr, FieldPC, FieldSP, FieldA, FieldX, FieldOpcode, FieldSpec,
+	FieldOperand, FieldEffAddr, FieldFlags, FieldMnemonic, FieldMode,
+	FieldWrites, FieldIn, FieldOut,
+}
+
+// ParseTraceFields parses a comma separated list of fields, "all" selects
+// all of them
+func ParseTraceFields(list string) ([]TraceField, error) {
+	if list == "" || list == "all" {
+		return AllTraceFields, nil
+	}
+
+	fields := []TraceField{}
+	for _, name := range strings.Split(list, ",") {
+		fld := TraceField(strings.ToLower(strings.TrimSpace(name)))
+		found := false
+		for _, known := range AllTraceFields {
+			if fld == known {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown trace field %q", name)
+		}
+		fields = append(fields, fld)
+	}
+	return fields, nil
+}
+
+// Tracer is an Observer that writes a line for every instruction executed
+//
+// Instructions that fault are not written, as with Pep8CPU.Trace. Steps are
+// counted from the start of the program, filtered out instructions included.
+type Tracer struct {
+	NopObserver
+
+	// Format is the format of the trace
+	Format TraceFormat
+	// Fields are the values written in the structured formats
+	Fields []TraceField
+	// Filter selects the instructions written
+	Filter TraceFilter
+	// Err is the first error writing the trace, later lines are dropped
+	Err error
+
+	out   io.Writer
+	csv   *csv.Writer
+	calls CallStack
+	step  uint64
+	// selected is true if the current instruction passes the filter
+	selected bool
+	writes   []Access
+	in       []byte
+	output   []byte
+}
+
+// NewTracer creates a tracer writing to w
+func NewTracer(w io.Writer, format TraceFormat, fields []TraceField) *Tracer {
+	return &Tracer{
+		Format: format,
+		Fields: fields,
+		out:    w,
+	}
+}
+
+func (tr *Tracer) BeforeInstruction(cpu *Pep8CPU, ins Instruction) {
+	tr.step++
+	tr.selected = tr.Filter.match(tr.step, ins, &tr.calls)
+	tr.writes = tr.writes[:0]
+	tr.in = tr.in[:0]
+	tr.output = tr.output[:0]
+}
+
+func (tr *Tracer) MemoryWrite(cpu *Pep8CPU, addr uint16, size int, val uint16) {
+	tr.writes = append(tr.writes, Access{addr, size, val})
+}
+
+func (tr *Tracer) Input(cpu *Pep8CPU, b byte) {
+	tr.in = append(tr.in, b)
+}
+
+func (tr *Tracer) Output(cpu *Pep8CPU, b byte) {
+	tr.output = append(tr.output, b)
+}
+
+func (tr *Tracer) Call(cpu *Pep8CPU, site, target, sp uint16) {
+	tr.calls.Call(cpu, site, target, sp)
+}
+
+func (tr *Tracer) Return(cpu *Pep8CPU, site, target, sp uint16) {
+	tr.calls.Return(cpu, site, target, sp)
+}
+
+func (tr *Tracer) AfterInstruction(cpu *Pep8CPU, ins Instruction) {
+	if cpu.Fault != nil || tr.Err != nil || !tr.selected {
+		return
+	}
+
+	switch tr.Format {
+	case TraceText:
+		_, tr.Err = io.WriteString(tr.out, cpu.traceLine())
+	case TraceJSON:
+		tr.Err = tr.writeJSON(cpu, ins)
+	case TraceCSV:
+		tr.Err = tr.writeCSV(cpu, ins)
+	}
+}
+
+// traceValue is the value of a field, num is used if str is nil
+type traceValue struct {
+	name string
+	num  uint64
+	str  *string
+	// none is true for a field with no value for this instruction
+	none bool
+}
+
+func (tr *Tracer) values(cpu *Pep8CPU, ins Instruction) []traceValue {
+	vals := make([]traceValue, 0, len(tr.Fields)+3)
+	num := func(fld TraceField, v uint64) {
+		vals = append(vals, traceValue{name: string(fld), num: v})
+	}
+	str := func(fld TraceField, s string) {
+		vals = append(vals, traceValue{name: string(fld), str: &s})
+	}
+	hasMode := ins.HasSpec && ins.Err == nil
+
+	for _, fld := range tr.Fields {
+		switch fld {
+		case FieldStep:
+			num(fld, tr.step)
+		case FieldAddr:
+			num(fld, uint64(ins.Addr))
+		case FieldPC:
+			num(fld, uint64(cpu.PC))
+		case FieldSP:
+			num(fld, uint64(cpu.SP))
+		case FieldA:
+			num(fld, uint64(cpu.A))
+		case FieldX:
+			num(fld, uint64(cpu.X))
+		case FieldOpcode:
+			num(fld, uint64(ins.Opcode))
+		case FieldSpec:
+			num(fld, uint64(cpu.Spec))
+		case FieldOperand:
+			num(fld, uint64(cpu.Operand))
+		case FieldEffAddr:
+			if hasMode && ins.Mode != i {
+				num(fld, uint64(cpu.EffAddr))
+			} else {
+				vals = append(vals, traceValue{name: string(fld), none: true})
+			}
+		case FieldFlags:
+			num("n", uint64(booltoInt(cpu.N)))
+			num("z", uint64(booltoInt(cpu.Z)))
+			num("v", uint64(booltoInt(cpu.V)))
+			num("c", uint64(booltoInt(cpu.C)))
+		case FieldMnemonic:
+			str(fld, ins.Mnemonic)
+		case FieldMode:
+			if hasMode {
+				str(fld, ins.Mode.String())
+			} else {
+				str(fld, "")
+			}
+		case FieldWrites:
+			wrs := make([]string, len(tr.writes))
+			for idx, wr := range tr.writes {
+				if wr.Size == 1 {
+					wrs[idx] = fmt.Sprintf("%04x:%02x", wr.Addr, wr.Val)
+				} else {
+					wrs[idx] = fmt.Sprintf("%04x:%04x", wr.Addr, wr.Val)
+				}
+			}
+			str(fld, strings.Join(wrs, " "))
+		case FieldIn:
+			str(fld, string(tr.in))
+		case FieldOut:
+			str(fld, string(tr.output))
+		}
+	}
+	return vals
+}
+
+func (tr *Tracer) writeJSON(cpu *Pep8CPU, ins Instruction) error {
+	line := []byte{'{'}
+	for idx, val := range tr.values(cpu, ins) {
+		if idx > 0 {
+			line = append(line, ',')
+		}
+		line = strconv.AppendQuote(line, val.name)
+		line = append(line, ':')
+		switch {
+		case val.none:
+			line = append(line, "null"...)
+		case val.str != nil:
+			// I/O bytes are not always valid UTF-8, they are kept as Latin-1
+			enc, err := json.Marshal(latin1([]byte(*val.str)))
+			if err != nil {
+				return err
+			}
+			line = append(line, enc...)
+		default:
+			line = strconv.AppendUint(line, val.num, 10)
+		}
+	}
+	line = append(line, '}', '\n')
+
+	_, err := tr.out.Write(line)
+	return err
+}
+
+func (tr *Tracer) writeCSV(cpu *Pep8CPU, ins Instruction) error {
+	vals := tr.values(cpu, ins)
+	if tr.csv == nil {
+		tr.csv = csv.NewWriter(tr.out)
+		header := make([]string, len(vals))
+		for idx, val := range vals {
+			header[idx] = val.name
+		}
+		if err := tr.csv.Write(header); err != nil {
+			return err
+		}
+	}
+
+	row := make([]string, len(vals))
+	for idx, val := range vals {
+		switch {
+		case val.none:
+		case val.str != nil:
+			row[idx] = *val.str
+		default:
+			row[idx] = strconv.FormatUint(val.num, 10)
+		}
+	}
+	if err := tr.csv.Write(row); err != nil {
+		return err
+	}
+
+	// The trace may be interleaved with the output of the program
+	tr.csv.Flush()
+	return tr.csv.Error()
+}
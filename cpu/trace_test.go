@@ -0,0 +1,89 @@
+package cpu
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceFields(t *testing.T) {
+	for _, list := range []string{"", "all"} {
+		if fields, err := ParseTraceFields(list); err != nil || len(fields) != len(AllTraceFields) {
+			t.Errorf("fields of %q: %v, %v, want all", list, fields, err)
+		}
+	}
+	fields, err := ParseTraceFields("step, PC,flags")
+	if err != nil || len(fields) != 3 || fields[0] != FieldStep || fields[1] != FieldPC || fields[2] != FieldFlags {
+		t.Errorf("fields %v, %v", fields, err)
+	}
+	if _, err := ParseTraceFields("step,ir"); err == nil {
+		t.Errorf("unknown field accepted")
+	}
+}
+
+func TestTraceJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	observe(storeLoopProgram, "", NewTracer(out, TraceJSON, AllTraceFields))
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(storeLoopAddrs) {
+		t.Fatalf("%d lines, want %d:\n%s", len(lines), len(storeLoopAddrs), out)
+	}
+	// The fields are written in order
+	want := `{"step":2,"addr":3,"pc":6,"sp":65535,"a":3,"x":0,"opcode":225,"spec":32,"operand":32,` +
+		`"effaddr":32,"n":0,"z":0,"v":0,"c":0,"mnemonic":"STA","mode":"d","writes":"0020:0003","in":"","out":""}`
+	if lines[1] != want {
+		t.Errorf("STA traced as\n%s\nwant\n%s", lines[1], want)
+	}
+	for idx, line := range lines {
+		rec := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("line %d: %s", idx+1, err)
+		}
+		if rec["addr"] != float64(storeLoopAddrs[idx]) || rec["step"] != float64(idx+1) {
+			t.Errorf("line %d: %s", idx+1, line)
+		}
+	}
+
+	// The operand is immediate, and the output is kept as Latin-1
+	out.Reset()
+	observe([]byte{0x50, 0x00, 0xE9, 0x00}, "", NewTracer(out, TraceJSON, []TraceField{FieldEffAddr, FieldMode, FieldOut}))
+	if want := "{\"effaddr\":null,\"mode\":\"i\",\"out\":\"é\"}\n{\"effaddr\":null,\"mode\":\"\",\"out\":\"\"}\n"; out.String() != want {
+		t.Errorf("CHARO traced as %q, want %q", out, want)
+	}
+}
+
+func TestTraceCSV(t *testing.T) {
+	out := &bytes.Buffer{}
+	observe(storeLoopProgram, "", NewTracer(out, TraceCSV, []TraceField{FieldStep, FieldMnemonic, FieldFlags, FieldWrites, FieldOut}))
+
+	rows, err := csv.NewReader(out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(storeLoopAddrs)+1 {
+		t.Fatalf("%d rows, want a header and %d", len(rows), len(storeLoopAddrs))
+	}
+	for idx, want := range map[int]string{
+		0:  "step,mnemonic,n,z,v,c,writes,out",
+		2:  "2,STA,0,0,0,0,0020:0003,",
+		3:  "3,CHARO,0,0,0,0,,x",
+		13: "13,BRNE,0,1,0,1,,",
+		14: "14,STOP,0,1,0,1,,",
+	} {
+		if got := strings.Join(rows[idx], ","); got != want {
+			t.Errorf("row %d %q, want %q", idx, got, want)
+		}
+	}
+}
+
+func TestTraceFault(t *testing.T) {
+	// The instruction that faults is not traced
+	out := &bytes.Buffer{}
+	observe(callProgram, "", NewTracer(out, TraceCSV, []TraceField{FieldAddr}))
+	if want := "addr\n0\n"; out.String() != want {
+		t.Errorf("trace %q, want %q", out, want)
+	}
+}
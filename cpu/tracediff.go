@@ -0,0 +1,290 @@
+package cpu
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// TraceStep is the state of the cpu after an instruction, as read from a trace
+type TraceStep struct {
+	// Step is the number of the step, starting at 1
+	Step       uint64
+	PC, SP     uint16
+	A, X       uint16
+	Spec       uint16
+	N, Z, V, C bool
+	Opcode     uint8
+	// Line is the line of the trace
+	Line string
+}
+
+var traceLineRe = regexp.MustCompile(`PC = ([0-9a-f]{4}); SP = ([0-9a-f]{4}); A ([0-9a-f]{4}); X = ([0-9a-f]{4}); Spec = ([0-9a-f]{4}); N = ([01]), Z = ([01]), V = ([01]), C = ([01]); opcode = ([0-9a-f]{2});`)
+
+// ParseTrace reads a trace in the text format of Pep8CPU.Trace, or in the
+// JSON Lines format of a Tracer
+//
+// Lines that are not part of the trace, such as the output of the program
+// or a fault message, are skipped. The output written by an instruction
+// precedes its line in a text trace, it is not part of the step.
+func ParseTrace(r io.Reader) ([]TraceStep, error) {
+	steps := []TraceStep{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		var st TraceStep
+		var ok bool
+		if strings.HasPrefix(line, "{") {
+			st, ok = parseJSONStep(line)
+		} else {
+			st, line, ok = parseTextStep(line)
+		}
+		if !ok {
+			continue
+		}
+		if st.Step == 0 {
+			st.Step = uint64(len(steps) + 1)
+		}
+		st.Line = strings.TrimRight(line, " ")
+		steps = append(steps, st)
+	}
+	return steps, sc.Err()
+}
+
+// parseTextStep parses a line of a text trace, it returns the line without
+// the output before it
+func parseTextStep(line string) (TraceStep, string, bool) {
+	loc := traceLineRe.FindStringIndex(line)
+	if loc == nil {
+		return TraceStep{}, line, false
+	}
+	line = line[loc[0]:]
+	m := traceLineRe.FindStringSubmatch(line)
+
+	hex := func(s string) uint16 {
+		var v uint16
+		fmt.Sscanf(s, "%x", &v)
+		return v
+	}
+	return TraceStep{
+		PC:     hex(m[1]),
+		SP:     hex(m[2]),
+		A:      hex(m[3]),
+		X:      hex(m[4]),
+		Spec:   hex(m[5]),
+		N:      m[6] == "1",
+		Z:      m[7] == "1",
+		V:      m[8] == "1",
+		C:      m[9] == "1",
+		Opcode: uint8(hex(m[10])),
+	}, line, true
+}
+
+func parseJSONStep(line string) (TraceStep, bool) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return TraceStep{}, false
+	}
+	if _, ok := fields["pc"]; !ok {
+		return TraceStep{}, false
+	}
+
+	num := func(name string) uint64 {
+		v, _ := fields[name].(float64)
+		return uint64(v)
+	}
+	return TraceStep{
+		Step:   num("step"),
+		PC:     uint16(num("pc")),
+		SP:     uint16(num("sp")),
+		A:      uint16(num("a")),
+		X:      uint16(num("x")),
+		Spec:   uint16(num("spec")),
+		N:      num("n") != 0,
+		Z:      num("z") != 0,
+		V:      num("v") != 0,
+		C:      num("c") != 0,
+		Opcode: uint8(num("opcode")),
+	}, true
+}
+
+// Diff returns the names of the registers and flags that differ
+func (st TraceStep) Diff(other TraceStep) []string {
+	diffs := []string{}
+	cmp := func(name string, differ bool) {
+		if differ {
+			diffs = append(diffs, name)
+		}
+	}
+	cmp("PC", st.PC != other.PC)
+	cmp("SP", st.SP != other.SP)
+	cmp("A", st.A != other.A)
+	cmp("X", st.X != other.X)
+	cmp("Spec", st.Spec != other.Spec)
+	cmp("opcode", st.Opcode != other.Opcode)
+	cmp("N", st.N != other.N)
+	cmp("Z", st.Z != other.Z)
+	cmp("V", st.V != other.V)
+	cmp("C", st.C != other.C)
+	return diffs
+}
+
+func (st TraceStep) value(name string) string {
+	switch name {
+	case "PC":
+		return fmt.Sprintf("%04x", st.PC)
+	case "SP":
+		return fmt.Sprintf("%04x", st.SP)
+	case "A":
+		return fmt.Sprintf("%04x", st.A)
+	case "X":
+		return fmt.Sprintf("%04x", st.X)
+	case "Spec":
+		return fmt.Sprintf("%04x", st.Spec)
+	case "opcode":
+		return fmt.Sprintf("%02x", st.Opcode)
+	case "N":
+		return fmt.Sprint(booltoInt(st.N))
+	case "Z":
+		return fmt.Sprint(booltoInt(st.Z))
+	case "V":
+		return fmt.Sprint(booltoInt(st.V))
+	case "C":
+		return fmt.Sprint(booltoInt(st.C))
+	}
+	return ""
+}
+
+// StepRange is a range of step indices, both bounds included
+type StepRange struct {
+	First, Last int
+}
+
+// TraceDiff is the comparison of two traces, aligned by step
+type TraceDiff struct {
+	Expected, Actual []TraceStep
+	// First is the index of the first step that differs, -1 if none; a
+	// trace that ends early differs at its end
+	First int
+	// Ranges are the ranges of steps that differ, when both traces have them
+	Ranges []StepRange
+	// Differing is the number of steps that differ, when both traces have them
+	Differing int
+}
+
+// DiffTraces compares two traces step by step
+func DiffTraces(expected, actual []TraceStep) *TraceDiff {
+	td := &TraceDiff{Expected: expected, Actual: actual, First: -1}
+
+	common := len(expected)
+	if len(actual) < common {
+		common = len(actual)
+	}
+	for idx := 0; idx < common; idx++ {
+		if len(expected[idx].Diff(actual[idx])) == 0 {
+			continue
+		}
+		td.Differing++
+		if td.First < 0 {
+			td.First = idx
+		}
+		if n := len(td.Ranges); n > 0 && td.Ranges[n-1].Last == idx-1 {
+			td.Ranges[n-1].Last = idx
+		} else {
+			td.Ranges = append(td.Ranges, StepRange{idx, idx})
+		}
+	}
+
+	if td.First < 0 && len(expected) != len(actual) {
+		td.First = common
+	}
+	return td
+}
+
+// Equal is true when the traces are identical
+func (td *TraceDiff) Equal() bool {
+	return td.First < 0
+}
+
+// maxRanges is the number of ranges listed by a report, the others are only
+// counted
+const maxRanges = 10
+
+// Report writes the first divergence with context steps before and after
+// it, then a summary of the later ones
+func (td *TraceDiff) Report(w io.Writer, context int) {
+	if td.Equal() {
+		fmt.Fprintf(w, "traces are identical, %d steps\n", len(td.Expected))
+		return
+	}
+
+	first := td.First
+	step := func(steps []TraceStep, idx int) string {
+		if idx < len(steps) {
+			return fmt.Sprintf("%6d  %s", steps[idx].Step, steps[idx].Line)
+		}
+		return "        <end of trace>"
+	}
+
+	fmt.Fprintf(w, "first divergence at step %d\n", first+1)
+	if first < len(td.Expected) && first < len(td.Actual) {
+		exp, act := td.Expected[first], td.Actual[first]
+		for _, name := range exp.Diff(act) {
+			fmt.Fprintf(w, "  %-6s expected %s, got %s\n", name, exp.value(name), act.value(name))
+		}
+	} else if first >= len(td.Actual) {
+		fmt.Fprintf(w, "  the actual trace ends after %d steps\n", len(td.Actual))
+	} else {
+		fmt.Fprintf(w, "  the expected trace ends after %d steps\n", len(td.Expected))
+	}
+
+	fmt.Fprintln(w)
+	lo := first - context
+	if lo < 0 {
+		lo = 0
+	}
+	for idx := lo; idx < first; idx++ {
+		fmt.Fprintf(w, "  %s\n", step(td.Expected, idx))
+	}
+	for idx := first; idx <= first+context; idx++ {
+		if idx >= len(td.Expected) && idx >= len(td.Actual) {
+			break
+		}
+		if idx > first && idx < len(td.Expected) && idx < len(td.Actual) &&
+			len(td.Expected[idx].Diff(td.Actual[idx])) == 0 {
+			fmt.Fprintf(w, "  %s\n", step(td.Expected, idx))
+			continue
+		}
+		fmt.Fprintf(w, "- %s\n", step(td.Expected, idx))
+		fmt.Fprintf(w, "+ %s\n", step(td.Actual, idx))
+	}
+
+	fmt.Fprintln(w)
+	common := len(td.Expected)
+	if len(td.Actual) < common {
+		common = len(td.Actual)
+	}
+	fmt.Fprintf(w, "%d of %d common steps differ", td.Differing, common)
+	if len(td.Ranges) > 0 {
+		fmt.Fprintf(w, ", in %d ranges:", len(td.Ranges))
+		for idx, rg := range td.Ranges {
+			if idx == maxRanges {
+				fmt.Fprintf(w, " ...")
+				break
+			}
+			if rg.First == rg.Last {
+				fmt.Fprintf(w, " %d", rg.First+1)
+			} else {
+				fmt.Fprintf(w, " %d-%d", rg.First+1, rg.Last+1)
+			}
+		}
+	}
+	fmt.Fprintln(w)
+	if len(td.Expected) != len(td.Actual) {
+		fmt.Fprintf(w, "expected %d steps, got %d\n", len(td.Expected), len(td.Actual))
+	}
+}
@@ -0,0 +1,213 @@
+package cpu
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// textTrace and jsonTrace are the traces of storeLoopProgram
+func textTrace(t *testing.T) string {
+	cpu := NewPep8Cpu()
+	cpu.Load(storeLoopProgram)
+	out := &bytes.Buffer{}
+	cpu.In = strings.NewReader("")
+	cpu.Out = out
+	cpu.Trace = true
+	cpu.TraceOut = out
+	if err := cpu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func jsonTrace(t *testing.T) string {
+	out := &bytes.Buffer{}
+	observe(storeLoopProgram, "", NewTracer(out, TraceJSON, AllTraceFields))
+	return out.String()
+}
+
+func parseTrace(t *testing.T, text string) []TraceStep {
+	steps, err := ParseTrace(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return steps
+}
+
+func TestParseTrace(t *testing.T) {
+	text := "PC = 0003; SP = fffd; A 8001; X = 00ff; Spec = 000a; N = 1, Z = 0, V = 1, C = 0; opcode = c1; LDA,d \n"
+	json := `{"step":7,"addr":0,"pc":3,"sp":65533,"a":32769,"x":255,"opcode":193,"spec":10,"n":1,"z":0,"v":1,"c":0}` + "\n"
+	want := TraceStep{PC: 0x0003, SP: 0xFFFD, A: 0x8001, X: 0x00FF, Spec: 0x000A, N: true, V: true, Opcode: 0xC1}
+	step := func(n uint64) TraceStep {
+		st := want
+		st.Step = n
+		return st
+	}
+
+	for _, tc := range []struct {
+		name  string
+		trace string
+		want  []TraceStep
+	}{
+		// Text steps are numbered in order, JSON steps keep their number
+		{"text", text, []TraceStep{step(1)}},
+		{"json", json, []TraceStep{step(7)}},
+		{"empty", "", []TraceStep{}},
+		// The output of the program and the fault are not steps, the
+		// output of an instruction is before its line
+		{"text with output", "hello\n" + text + "x" + text + "Error: no input\n", []TraceStep{step(1), step(2)}},
+		{"json without registers", `{"step":1,"addr":0}` + "\n" + json, []TraceStep{step(7)}},
+		{"invalid json", "{\"pc\":\n" + json, []TraceStep{step(7)}},
+		{"truncated text", text[:40] + "\n" + text, []TraceStep{step(1)}},
+	} {
+		got := parseTrace(t, tc.trace)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: %d steps, want %d", tc.name, len(got), len(tc.want))
+			continue
+		}
+		for idx := range got {
+			exp := tc.want[idx]
+			exp.Line = got[idx].Line
+			if got[idx] != exp {
+				t.Errorf("%s: step %d %+v, want %+v", tc.name, idx+1, got[idx], exp)
+			}
+			if !strings.HasPrefix(got[idx].Line, "PC = ") && !strings.HasPrefix(got[idx].Line, "{") || strings.HasSuffix(got[idx].Line, " ") {
+				t.Errorf("%s: line %q not trimmed", tc.name, got[idx].Line)
+			}
+		}
+	}
+}
+
+func TestParseTraceFormats(t *testing.T) {
+	// Both formats of the same run have the same steps
+	text := parseTrace(t, textTrace(t))
+	json := parseTrace(t, jsonTrace(t))
+	if len(text) != len(storeLoopAddrs) || len(json) != len(storeLoopAddrs) {
+		t.Fatalf("%d text and %d json steps, want %d", len(text), len(json), len(storeLoopAddrs))
+	}
+	if td := DiffTraces(text, json); !td.Equal() {
+		report := &bytes.Buffer{}
+		td.Report(report, 2)
+		t.Errorf("text and json traces differ:\n%s", report)
+	}
+}
+
+// changed returns a copy of steps with the registers of some steps changed
+func changed(steps []TraceStep, change func(idx int, st *TraceStep)) []TraceStep {
+	out := append([]TraceStep{}, steps...)
+	for idx := range out {
+		change(idx, &out[idx])
+	}
+	return out
+}
+
+func TestDiffTraces(t *testing.T) {
+	steps := parseTrace(t, textTrace(t))
+	n := len(steps)
+
+	for _, tc := range []struct {
+		name      string
+		actual    []TraceStep
+		first     int
+		ranges    string
+		differing int
+		diff      []string
+	}{
+		{"equal", steps, -1, "[]", 0, nil},
+		{"register", changed(steps, func(idx int, st *TraceStep) {
+			if idx == 4 {
+				st.A++
+			}
+		}), 4, "[{4 4}]", 1, []string{"A"}},
+		{"flags", changed(steps, func(idx int, st *TraceStep) {
+			if idx >= 2 {
+				st.N, st.C = !st.N, !st.C
+			}
+		}), 2, fmt.Sprintf("[{2 %d}]", n-1), n - 2, []string{"N", "C"}},
+		{"ranges", changed(steps, func(idx int, st *TraceStep) {
+			if idx == 1 || idx == 2 || idx == 7 {
+				st.PC, st.Opcode = 0, 0
+			}
+		}), 1, "[{1 2} {7 7}]", 3, []string{"PC", "opcode"}},
+		{"actual ends early", steps[:5], 5, "[]", 0, nil},
+		{"expected ends early", append(append([]TraceStep{}, steps...), steps[0]), n, "[]", 0, nil},
+		{"empty", []TraceStep{}, 0, "[]", 0, nil},
+		{"ends early after a difference", changed(steps[:5], func(idx int, st *TraceStep) {
+			if idx == 3 {
+				st.SP = 0
+			}
+		}), 3, "[{3 3}]", 1, []string{"SP"}},
+	} {
+		td := DiffTraces(steps, tc.actual)
+		if td.First != tc.first || fmt.Sprint(td.Ranges) != tc.ranges || td.Differing != tc.differing {
+			t.Errorf("%s: first %d, ranges %v, %d differing, want %d, %s, %d",
+				tc.name, td.First, td.Ranges, td.Differing, tc.first, tc.ranges, tc.differing)
+			continue
+		}
+		if td.Equal() != (tc.first < 0) {
+			t.Errorf("%s: equal %t", tc.name, td.Equal())
+		}
+		if tc.diff != nil {
+			if got := steps[td.First].Diff(tc.actual[td.First]); fmt.Sprint(got) != fmt.Sprint(tc.diff) {
+				t.Errorf("%s: %v differ, want %v", tc.name, got, tc.diff)
+			}
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	steps := parseTrace(t, textTrace(t))
+	report := func(actual []TraceStep) string {
+		out := &bytes.Buffer{}
+		DiffTraces(steps, actual).Report(out, 1)
+		return out.String()
+	}
+
+	if got, want := report(steps), "traces are identical, 14 steps\n"; got != want {
+		t.Errorf("report %q, want %q", got, want)
+	}
+
+	got := report(changed(steps, func(idx int, st *TraceStep) {
+		if idx == 4 {
+			st.A = 0x1234
+		}
+	}))
+	want := fmt.Sprintf(`first divergence at step 5
+  A      expected 0002, got 1234
+
+  %6d  %s
+- %6d  %s
++ %6d  %s
+  %6d  %s
+
+1 of 14 common steps differ, in 1 ranges: 5
+`, 4, steps[3].Line, 5, steps[4].Line, 5, steps[4].Line, 6, steps[5].Line)
+	if got != want {
+		t.Errorf("report:\n%s\nwant:\n%s", got, want)
+	}
+
+	// A truncated trace diverges where it ends
+	got = report(steps[:5])
+	want = fmt.Sprintf(`first divergence at step 6
+  the actual trace ends after 5 steps
+
+  %6d  %s
+- %6d  %s
++         <end of trace>
+- %6d  %s
++         <end of trace>
+
+0 of 5 common steps differ
+expected 14 steps, got 5
+`, 5, steps[4].Line, 6, steps[5].Line, 7, steps[6].Line)
+	if got != want {
+		t.Errorf("report:\n%s\nwant:\n%s", got, want)
+	}
+
+	got = report(append(append([]TraceStep{}, steps...), steps[0]))
+	if !strings.Contains(got, "the expected trace ends after 14 steps\n") || !strings.Contains(got, "expected 14 steps, got 15\n") {
+		t.Errorf("report:\n%s", got)
+	}
+}
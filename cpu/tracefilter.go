@@ -0,0 +1,156 @@
+package cpu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AddrRange is a range of addresses, both bounds included
+type AddrRange struct {
+	Lo, Hi uint16
+}
+
+// ParseAddrRange parses a range written `lo-hi` or `lo:len`, or a single
+// address, with addresses in hexadecimal
+func ParseAddrRange(text string) (AddrRange, error) {
+	parse := func(s string) (uint16, error) {
+		s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "0x")
+		v, err := strconv.ParseUint(s, 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid address %q", s)
+		}
+		return uint16(v), nil
+	}
+
+	if lo, size, ok := strings.Cut(text, ":"); ok {
+		start, err := parse(lo)
+		if err != nil {
+			return AddrRange{}, err
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(size), 0, 17)
+		if err != nil || n == 0 || uint64(start)+n > 0x10000 {
+			return AddrRange{}, fmt.Errorf("invalid range length %q", size)
+		}
+		return AddrRange{start, uint16(uint64(start) + n - 1)}, nil
+	}
+
+	lo, hi, isRange := strings.Cut(text, "-")
+	start, err := parse(lo)
+	if err != nil {
+		return AddrRange{}, err
+	}
+	end := start
+	if isRange {
+		end, err = parse(hi)
+		if err != nil {
+			return AddrRange{}, err
+		}
+	}
+	if end < start {
+		return AddrRange{}, fmt.Errorf("invalid range %q, the end is before the start", text)
+	}
+	return AddrRange{start, end}, nil
+}
+
+// Contains is true if addr is within the range
+func (ar AddrRange) Contains(addr uint16) bool {
+	return addr >= ar.Lo && addr <= ar.Hi
+}
+
+func (ar AddrRange) String() string {
+	return fmt.Sprintf("%04x-%04x", ar.Lo, ar.Hi)
+}
+
+// Classes of instructions for TraceFilter.Ops
+var opClasses = map[string][]string{
+	"branch": {"BR", "BRLE", "BRLT", "BREQ", "BRNE", "BRGE", "BRGT", "BRV", "BRC"},
+	"call":   {"CALL", "RET"},
+	"io":     {"DECI", "DECO", "CHARI", "CHARO", "STRO"},
+}
+
+// TraceFilter selects the instructions written by a Tracer, the zero value
+// selects all of them
+type TraceFilter struct {
+	// From and To are the first and last steps traced, 0 for no limit
+	From, To uint64
+	// Addrs are the addresses of the instructions traced, if any
+	Addrs []AddrRange
+	// Subroutines are the entry points of the subroutines traced, if any,
+	// with the subroutines they call
+	Subroutines []uint16
+	// Ops are the operations traced, as mnemonics, e.g. LDA, as base
+	// operations regardless of the register, e.g. LD, or as the classes
+	// "branch", "call" and "io"
+	Ops []string
+}
+
+// ParseOps parses a comma separated list of mnemonics, base operations and
+// classes
+func ParseOps(list string) ([]string, error) {
+	ops := []string{}
+	for _, op := range strings.Split(list, ",") {
+		op = strings.TrimSpace(op)
+		if _, ok := opClasses[strings.ToLower(op)]; ok {
+			ops = append(ops, strings.ToLower(op))
+			continue
+		}
+
+		op = strings.ToUpper(op)
+		found := false
+		for oc := range decodeTable {
+			found = found || decodeTable[oc].base == op || decodeTable[oc].mnemonic == op
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown operation %q, expected a mnemonic or one of branch, call or io", op)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func (tf *TraceFilter) match(step uint64, ins Instruction, calls *CallStack) bool {
+	if step < tf.From || (tf.To > 0 && step > tf.To) {
+		return false
+	}
+
+	if len(tf.Addrs) > 0 {
+		found := false
+		for _, ar := range tf.Addrs {
+			found = found || ar.Contains(ins.Addr)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(tf.Subroutines) > 0 {
+		found := false
+		for _, fr := range calls.Frames {
+			for _, sub := range tf.Subroutines {
+				found = found || fr.Callee == sub
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(tf.Ops) > 0 {
+		found := false
+		for _, op := range tf.Ops {
+			if class, ok := opClasses[op]; ok {
+				for _, cop := range class {
+					found = found || cop == ins.BaseOp
+				}
+			} else {
+				found = found || op == ins.BaseOp || op == ins.Mnemonic
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
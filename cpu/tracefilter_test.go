@@ -0,0 +1,113 @@
+package cpu
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseAddrRange(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want AddrRange
+		err  bool
+	}{
+		{"0010", AddrRange{0x0010, 0x0010}, false},
+		{"0x10-0x1f", AddrRange{0x0010, 0x001F}, false},
+		{" 10 - 1F ", AddrRange{0x0010, 0x001F}, false},
+		{"0-ffff", AddrRange{0x0000, 0xFFFF}, false},
+		{"10:16", AddrRange{0x0010, 0x001F}, false},
+		{"10:0x10", AddrRange{0x0010, 0x001F}, false},
+		{"ffff:1", AddrRange{0xFFFF, 0xFFFF}, false},
+		{"0:65536", AddrRange{0x0000, 0xFFFF}, false},
+		// The end before the start
+		{"1f-10", AddrRange{}, true},
+		// Past the end of the memory
+		{"ffff:2", AddrRange{}, true},
+		{"1:0x10000", AddrRange{}, true},
+		{"0:131072", AddrRange{}, true},
+		{"10000", AddrRange{}, true},
+		{"0-10000", AddrRange{}, true},
+		// Empty and malformed
+		{"10:0", AddrRange{}, true},
+		{"10:-1", AddrRange{}, true},
+		{"", AddrRange{}, true},
+		{"10-", AddrRange{}, true},
+		{"xyz", AddrRange{}, true},
+		{"10-20-30", AddrRange{}, true},
+	} {
+		got, err := ParseAddrRange(tc.text)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("ParseAddrRange(%q) = %v, %v, want %v, error %t", tc.text, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestParseOps(t *testing.T) {
+	for _, tc := range []struct {
+		list string
+		want []string
+	}{
+		{"LDA", []string{"LDA"}},
+		{"lda, stx", []string{"LDA", "STX"}},
+		{"LD,RET0,NOP1", []string{"LD", "RET0", "NOP1"}},
+		{"Branch,io", []string{"branch", "io"}},
+	} {
+		got, err := ParseOps(tc.list)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("ParseOps(%q) = %v, %v, want %v", tc.list, got, err, tc.want)
+		}
+	}
+	for _, list := range []string{"LDQ", "LDA,", "jumps"} {
+		if got, err := ParseOps(list); err == nil {
+			t.Errorf("ParseOps(%q) = %v, want an error", list, got)
+		}
+	}
+}
+
+// tracedAddrs runs a program with a filtered trace, and returns the
+// addresses traced
+func tracedAddrs(t *testing.T, program []byte, input string, tf TraceFilter) string {
+	out := &bytes.Buffer{}
+	tr := NewTracer(out, TraceCSV, []TraceField{FieldAddr})
+	tr.Filter = tf
+	observe(program, input, tr)
+	if tr.Err != nil {
+		t.Fatal(tr.Err)
+	}
+	return strings.Join(strings.Split(strings.TrimSpace(out.String()), "\n")[1:], " ")
+}
+
+func TestTraceFilter(t *testing.T) {
+	ops := func(list string) []string {
+		parsed, err := ParseOps(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	for _, tc := range []struct {
+		name    string
+		program []byte
+		input   string
+		tf      TraceFilter
+		want    string
+	}{
+		{"all", storeLoopProgram, "", TraceFilter{}, "0 3 6 9 12 3 6 9 12 3 6 9 12 15"},
+		{"mnemonic", storeLoopProgram, "", TraceFilter{Ops: ops("STA")}, "3 3 3"},
+		{"other register", storeLoopProgram, "", TraceFilter{Ops: ops("STX")}, ""},
+		{"base", storeLoopProgram, "", TraceFilter{Ops: ops("ST,SUB")}, "3 9 3 9 3 9"},
+		{"class", storeLoopProgram, "", TraceFilter{Ops: ops("branch,io")}, "6 12 6 12 6 12"},
+		{"steps", storeLoopProgram, "", TraceFilter{From: 4, To: 6}, "9 12 3"},
+		{"addrs", storeLoopProgram, "", TraceFilter{Addrs: []AddrRange{{0x0, 0x3}, {0xF, 0xF}}}, "0 3 3 3 15"},
+		{"combined", storeLoopProgram, "", TraceFilter{From: 6, Ops: ops("LDA,STA")}, "3 3"},
+		{"subroutine", callProgram, "z", TraceFilter{Subroutines: []uint16{0x0007}}, "7 10"},
+		{"call", callProgram, "z", TraceFilter{Ops: ops("call")}, "0 10"},
+	} {
+		if got := tracedAddrs(t, tc.program, tc.input, tc.tf); got != tc.want {
+			t.Errorf("%s: traced %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
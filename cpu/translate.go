@@ -0,0 +1,342 @@
+package cpu
+
+import (
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Translate writes a Go program equivalent to the object program, a main
+// package that runs it on stdin and stdout
+//
+// The instructions reachable from the start by fallthrough and immediate
+// branches and calls are translated to Go, with the operations of this
+// package. The others, reached by computed jumps (BRx, CALLx, RET) or
+// overwritten by the program, are executed by the interpreter. Faults are
+// left to the interpreter too, and show as with qdpep8cli. The characters
+// are output in the encoding enc, and flushed before every read of stdin.
+//
+// The Go program is not self-contained: it imports this package for the
+// operations and the interpreter. It is an accelerator for long runs, to be
+// built within this module or one that requires it.
+func Translate(w io.Writer, program []byte, name string, enc Encoding) error {
+	cpu := NewPep8Cpu()
+	cpu.Load(program)
+	addrs := cpu.reachable()
+
+	src := &strings.Builder{}
+	fmt.Fprintf(src, "// Code generated by qdpep8cli translate from %s. DO NOT EDIT.\n\n", name)
+	src.WriteString(translateHeader)
+	encName := "EncodingRaw"
+	if enc == EncodingLatin1 {
+		encName = "EncodingLatin1"
+	}
+	fmt.Fprintf(src, "\n// encoding is the encoding of the output\nconst encoding = cpu.%s\n", encName)
+
+	src.WriteString("\n// program is the object code, for the interpreter\nvar program = []byte{")
+	for idx, b := range program {
+		if idx%16 == 0 {
+			src.WriteString("\n")
+		}
+		fmt.Fprintf(src, "0x%02X, ", b)
+	}
+	src.WriteString("\n}\n")
+
+	src.WriteString("\n// translated are the addresses of the translated instructions\nvar translated = []uint16{")
+	for idx, addr := range addrs {
+		if idx%8 == 0 {
+			src.WriteString("\n")
+		}
+		fmt.Fprintf(src, "0x%04X, ", addr)
+	}
+	src.WriteString("\n}\n")
+
+	src.WriteString(`
+// run executes the program from PC, the translated instructions as Go and
+// the others with the interpreter
+func run(c *cpu.Pep8CPU) error {
+	for {
+		switch c.PC {
+`)
+	for idx, addr := range addrs {
+		ins := cpu.Decode(addr)
+		fmt.Fprintf(src, "case 0x%04X:\n", addr)
+		fmt.Fprintf(src, "if !valid[0x%04X] {\nbreak\n}\n", addr)
+		fmt.Fprintf(src, "// %s\n", ins)
+		body, falls := translateIns(ins)
+		src.WriteString(body)
+		if falls {
+			if idx+1 < len(addrs) && addrs[idx+1] == ins.Next() {
+				src.WriteString("fallthrough\n")
+			} else {
+				src.WriteString("continue\n")
+			}
+		}
+	}
+	src.WriteString(`}
+		if !c.DoNextCycle() {
+			return c.Fault
+		}
+	}
+}
+`)
+
+	out, err := format.Source([]byte(src.String()))
+	if err != nil {
+		return fmt.Errorf("translation error: %s", err)
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+const translateHeader = `package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/lbajolet/qdpep8/cpu"
+)
+
+func main() {
+	c := cpu.NewPep8Cpu()
+	c.Load(program)
+	out := bufio.NewWriter(os.Stdout)
+	c.In = flushingReader{bufio.NewReader(os.Stdin), out}
+	c.Out = out
+	c.Encoding = encoding
+	c.Observers = []cpu.Observer{codeWatch{}}
+
+	err := run(c)
+	out.Flush()
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+}
+
+// flushingReader flushes the output before waiting for input, so that
+// interactive programs show their prompts
+type flushingReader struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (fr flushingReader) Read(p []byte) (int, error) {
+	if fr.r.Buffered() == 0 {
+		fr.w.Flush()
+	}
+	return fr.r.Read(p)
+}
+
+// valid is true at the address of the translated instructions that were
+// not overwritten since
+var valid [0x10000]bool
+
+func init() {
+	for _, addr := range translated {
+		valid[addr] = true
+	}
+}
+
+// codeWatch hands the translated instructions written over to the
+// interpreter
+type codeWatch struct {
+	cpu.NopObserver
+}
+
+func (codeWatch) MemoryWrite(c *cpu.Pep8CPU, addr uint16, size int, val uint16) {
+	for k := -2; k < size; k++ {
+		valid[addr+uint16(k)] = false
+	}
+}
+
+// fault stops the program on the instruction at addr
+func fault(c *cpu.Pep8CPU, addr uint16, err error) error {
+	c.PC = addr
+	c.Fault = err
+	return err
+}
+`
+
+// translatable is true for the instructions Translate translates, the
+// faulting ones are left to the interpreter
+func translatable(op *opInfo) bool {
+	return op.modeErr == nil && op.base != "RETTR"
+}
+
+// reachable returns the sorted addresses of the translatable instructions
+// reachable from the start by fallthrough and immediate branches and calls
+func (cpu *Pep8CPU) reachable() []uint16 {
+	seen := map[uint16]bool{}
+	todo := []uint16{0}
+	for len(todo) > 0 {
+		addr := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if seen[addr] {
+			continue
+		}
+		op := &decodeTable[cpu.RAM[addr]]
+		if !translatable(op) {
+			continue
+		}
+		seen[addr] = true
+
+		ins := cpu.Decode(addr)
+		falls := op.exec != nil && op.base != "BR" && op.base != "RET"
+		if falls && ins.Next() > addr {
+			todo = append(todo, ins.Next())
+		}
+		if op.jumps && op.base != "RET" && op.mode == i {
+			todo = append(todo, ins.Spec)
+		}
+	}
+
+	addrs := make([]uint16, 0, len(seen))
+	for addr := range seen {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(a, b int) bool { return addrs[a] < addrs[b] })
+	return addrs
+}
+
+// branchConds are the conditions of the conditional branches, as Go
+var branchConds = map[string]string{
+	"BRLE": "c.Z || c.N",
+	"BRLT": "c.N",
+	"BREQ": "c.Z",
+	"BRNE": "!c.Z",
+	"BRGE": "!c.N",
+	"BRGT": "!c.N && !c.Z",
+	"BRV":  "c.V",
+	"BRC":  "c.C",
+}
+
+// translateIns translates an instruction to Go, falls is true when it
+// continues with the next instruction, PC then points to it
+func translateIns(ins Instruction) (string, bool) {
+	op := &decodeTable[ins.Opcode]
+	reg := "c.A"
+	if op.hasReg && op.reg == X {
+		reg = "c.X"
+	}
+	next := fmt.Sprintf("0x%04X", ins.Next())
+	site := fmt.Sprintf("0x%04X", ins.Addr)
+
+	// The address and the value of the operand
+	addr, word, byt := "", "", ""
+	if op.hasMode {
+		spec := fmt.Sprintf("0x%04X", ins.Spec)
+		switch op.mode {
+		case i:
+			word, byt = spec, spec
+		case d:
+			addr = spec
+		case n:
+			addr = "c.Read16(" + spec + ")"
+		case s:
+			addr = "c.SP + " + spec
+		case sf:
+			addr = "c.Read16(c.SP + " + spec + ")"
+		case x:
+			addr = spec + " + c.X"
+		case sx:
+			addr = "c.SP + " + spec + " + c.X"
+		case sxf:
+			addr = "c.Read16(c.SP+" + spec + ") + c.X"
+		}
+		if op.mode != i {
+			word = "c.Read16(" + addr + ")"
+			byt = "uint16(c.Read8(" + addr + "))"
+		}
+	}
+	operand := word
+	if op.operand == opByte {
+		operand = byt
+	}
+
+	b := &strings.Builder{}
+	stmt := func(format string, args ...interface{}) {
+		fmt.Fprintf(b, format+"\n", args...)
+	}
+	// The instructions that may fault count as a step once they succeed
+	fault := func(call string) {
+		stmt("if err := %s; err != nil {\nreturn fault(c, %s, err)\n}", call, site)
+		stmt("c.Steps++")
+	}
+	if op.base != "DECI" && op.base != "CHARI" {
+		stmt("c.Steps++")
+	}
+
+	switch op.base {
+	case "STOP":
+		stmt("c.PC = %s", next)
+		stmt("return nil")
+		return b.String(), false
+	case "MOVSPA":
+		stmt("c.A = c.SP")
+	case "MOVFLGA":
+		stmt("c.A = c.Flags()")
+	case "BR":
+		stmt("c.PC = %s", operand)
+		stmt("continue")
+		return b.String(), false
+	case "BRLE", "BRLT", "BREQ", "BRNE", "BRGE", "BRGT", "BRV", "BRC":
+		stmt("if %s {\nc.PC = %s\ncontinue\n}", branchConds[op.base], operand)
+	case "CALL":
+		stmt("c.PC = %s", next)
+		stmt("c.Call(%s, %s)", site, operand)
+		stmt("continue")
+		return b.String(), false
+	case "RET":
+		stmt("c.Ret(%s, %d)", site, ins.Opcode&0x7)
+		stmt("continue")
+		return b.String(), false
+	case "NOT", "NEG", "ASL", "ASR", "ROL", "ROR":
+		stmt("%s = c.%s%s(%s)", reg, op.base[:1], strings.ToLower(op.base[1:]), reg)
+	case "NOP":
+	case "DECI":
+		fault("c.Deci(" + addr + ")")
+	case "DECO":
+		stmt("c.Deco(%s)", operand)
+	case "STRO":
+		stmt("c.Stro(%s)", addr)
+	case "CHARI":
+		fault("c.Chari(" + addr + ")")
+	case "CHARO":
+		if op.mode == i {
+			stmt("c.Charo(0x%02X)", ins.Spec&0xFF)
+		} else {
+			stmt("c.Charo(c.Read8(%s))", addr)
+		}
+	case "ADDSP":
+		stmt("c.SP = c.Add(c.SP, %s)", operand)
+	case "SUBSP":
+		stmt("c.SP = c.Sub(c.SP, %s)", operand)
+	case "ADD":
+		stmt("%s = c.Add(%s, %s)", reg, reg, operand)
+	case "SUB":
+		stmt("%s = c.Sub(%s, %s)", reg, reg, operand)
+	case "AND":
+		stmt("%s = c.And(%s, %s)", reg, reg, operand)
+	case "OR":
+		stmt("%s = c.Or(%s, %s)", reg, reg, operand)
+	case "CP":
+		stmt("c.Sub(%s, %s)", reg, operand)
+	case "LD":
+		stmt("%s = c.Ld(%s)", reg, operand)
+	case "LDBYTE":
+		stmt("%s = c.LdByte(%s, %s)", reg, reg, operand)
+	case "ST":
+		stmt("c.Write16(%s, %s)", reg, addr)
+	case "STBYTE":
+		stmt("c.Write8(uint8(%s), %s)", reg, addr)
+	default:
+		panic(fmt.Sprintf("translate: no translation for %s", op.base))
+	}
+	stmt("c.PC = %s", next)
+	return b.String(), true
+}
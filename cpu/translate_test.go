@@ -0,0 +1,199 @@
+package cpu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// translatedTimeout bounds a run of a translated program, which has no step
+// limit
+const translatedTimeout = 10 * time.Second
+
+func TestTranslate(t *testing.T) {
+	cases := suiteCases(t)
+	paths, err := filepath.Glob(filepath.Join(suiteDir, "*", "*.pepo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	programs := map[string][]byte{}
+	for _, path := range paths {
+		prgm, err := ReadObjectFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		programs[strings.TrimSuffix(filepath.Base(path), ".pepo")] = prgm
+	}
+	dir := translateAll(t, programs)
+	if testing.Short() {
+		return
+	}
+
+	bin := buildAll(t, dir)
+	for _, path := range paths {
+		path := path
+		name := strings.TrimSuffix(filepath.Base(path), ".pepo")
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for _, sc := range cases {
+				if filepath.Clean(sc.Program) != filepath.Clean(path) {
+					continue
+				}
+				job, err := sc.Job()
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkTranslated(t, sc.Name, filepath.Join(bin, name), job)
+			}
+		})
+	}
+}
+
+func TestTranslateFlush(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a translated program")
+	}
+
+	// The prompt is shown before the program waits for its input
+	prompt := []byte{
+		0x50, 0x00, 0x3F, // CHARO '?',i
+		0x49, 0x00, 0x20, // CHARI 0x0020,d
+		0x51, 0x00, 0x20, // CHARO 0x0020,d
+		0x00, // STOP
+	}
+	bin := buildAll(t, translateAll(t, map[string][]byte{"prompt": prompt}))
+	cmd := exec.Command(filepath.Join(bin, "prompt"))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := stdout.Read(buf)
+		got <- string(buf[:n])
+	}()
+	select {
+	case out := <-got:
+		if out != "?" {
+			t.Errorf("prompt %q, want ?", out)
+		}
+	case <-time.After(translatedTimeout):
+		t.Fatal("no prompt before the input")
+	}
+
+	stdin.Write([]byte("x"))
+	stdin.Close()
+	rest, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "x" {
+		t.Errorf("output after the prompt %q, want x", rest)
+	}
+}
+
+// translateAll translates the programs to main packages named after them,
+// in a module in a temporary directory, and checks that they parse
+func translateAll(t *testing.T, programs map[string][]byte) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module translated\n\ngo 1.18\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, prgm := range programs {
+		src := &bytes.Buffer{}
+		if err := Translate(src, prgm, name+".pepo", EncodingLatin1); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if _, err := parser.ParseFile(token.NewFileSet(), "main.go", src, 0); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "main.go"), src.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// buildAll builds the programs of translateAll with a single go build, in a
+// workspace where their import of the cpu package resolves to this module,
+// and returns the directory of the binaries
+func buildAll(t *testing.T, dir string) string {
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := filepath.Join(dir, "go.work")
+	if err := os.WriteFile(work, []byte(fmt.Sprintf("go 1.18\n\nuse (\n\t.\n\t%q\n)\n", root)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bin := filepath.Join(dir, "bin") + string(filepath.Separator)
+	build := exec.Command("go", "build", "-o", bin, "./...")
+	build.Dir = dir
+	// -mod=mod, if set, is refused in workspace mode
+	build.Env = append(os.Environ(), "GOWORK="+work, "GOFLAGS=")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %s\n%s", err, out)
+	}
+	return bin
+}
+
+// checkTranslated runs the translated program bin on the input of the job,
+// and compares its output to that of Run, followed by the fault if any
+func checkTranslated(t *testing.T, name, bin string, job Job) {
+	cpu := NewPep8Cpu()
+	cpu.Load(job.Program)
+	cpu.In = bytes.NewReader(job.Input)
+	want := &bytes.Buffer{}
+	cpu.Out = want
+	cpu.Encoding = EncodingLatin1
+	cpu.MaxSteps = suiteMaxSteps
+	if err := cpu.Run(); err != nil {
+		if errors.Is(err, ErrStepLimit) {
+			t.Logf("%s: skipped, the step limit was reached", name)
+			return
+		}
+		fmt.Fprintf(want, "%s\n", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), translatedTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin)
+	cmd.Stdin = bytes.NewReader(job.Input)
+	got, err := cmd.Output()
+	if ctx.Err() != nil {
+		t.Fatalf("%s: %s", name, ctx.Err())
+	}
+	if exit := (&exec.ExitError{}); err != nil && !errors.As(err, &exit) {
+		t.Fatalf("%s: %s", name, err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("%s: output of the translation:\n%q\nwant, from Run:\n%q", name, got, want.Bytes())
+	}
+}
@@ -0,0 +1,184 @@
+package cpu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// WatchedWord is a word of memory shown as a signal in a VCD
+type WatchedWord struct {
+	Name string
+	Addr uint16
+}
+
+// vcdSignal is a variable of a VCD, and its last value
+type vcdSignal struct {
+	name  string
+	id    string
+	width int
+	value func(cpu *Pep8CPU, ins Instruction) uint32
+	last  uint32
+}
+
+// VCD is an Observer that writes the registers and flags after every
+// instruction as a Value Change Dump, viewable in GTKWave
+//
+// An instruction lasts one time unit, time 0 is the state before the
+// first instruction.
+type VCD struct {
+	NopObserver
+
+	// Err is the first error writing the dump, later changes are dropped
+	Err error
+
+	out     *bufio.Writer
+	signals []*vcdSignal
+	// registers is the number of signals that are not watched words
+	registers int
+	time      uint64
+	started   bool
+}
+
+// NewVCD creates a dump written to w, with a signal for every watched word
+func NewVCD(w io.Writer, watch []WatchedWord) *VCD {
+	vcd := &VCD{out: bufio.NewWriter(w)}
+
+	reg := func(name string, width int, value func(cpu *Pep8CPU, ins Instruction) uint32) {
+		vcd.signals = append(vcd.signals, &vcdSignal{
+			name:  name,
+			id:    vcdID(len(vcd.signals)),
+			width: width,
+			value: value,
+		})
+	}
+	flag := func(flg bool) uint32 {
+		return uint32(booltoInt(flg))
+	}
+
+	reg("PC", 16, func(cpu *Pep8CPU, ins Instruction) uint32 { return uint32(cpu.PC) })
+	reg("SP", 16, func(cpu *Pep8CPU, ins Instruction) uint32 { return uint32(cpu.SP) })
+	reg("A", 16, func(cpu *Pep8CPU, ins Instruction) uint32 { return uint32(cpu.A) })
+	reg("X", 16, func(cpu *Pep8CPU, ins Instruction) uint32 { return uint32(cpu.X) })
+	reg("IR", 24, func(cpu *Pep8CPU, ins Instruction) uint32 {
+		return uint32(ins.Opcode)<<16 | uint32(ins.Spec)
+	})
+	reg("N", 1, func(cpu *Pep8CPU, ins Instruction) uint32 { return flag(cpu.N) })
+	reg("Z", 1, func(cpu *Pep8CPU, ins Instruction) uint32 { return flag(cpu.Z) })
+	reg("V", 1, func(cpu *Pep8CPU, ins Instruction) uint32 { return flag(cpu.V) })
+	reg("C", 1, func(cpu *Pep8CPU, ins Instruction) uint32 { return flag(cpu.C) })
+	vcd.registers = len(vcd.signals)
+	for _, ww := range watch {
+		addr := ww.Addr
+		reg(ww.Name, 16, func(cpu *Pep8CPU, ins Instruction) uint32 { return uint32(cpu.peek16(addr)) })
+	}
+
+	return vcd
+}
+
+// vcdID is the short identifier of the nth signal, made of the printable
+// characters from '!' to '~'
+func vcdID(n int) string {
+	id := []byte{}
+	for {
+		id = append(id, byte('!'+n%94))
+		n /= 94
+		if n == 0 {
+			return string(id)
+		}
+		n--
+	}
+}
+
+func (vcd *VCD) BeforeInstruction(cpu *Pep8CPU, ins Instruction) {
+	if !vcd.started {
+		vcd.writeHeader(cpu)
+	}
+}
+
+// writeHeader writes the definitions of the signals, and their values
+// before the first instruction, unknown if cpu is nil
+func (vcd *VCD) writeHeader(cpu *Pep8CPU) {
+	vcd.started = true
+	vcd.printf("$date %s $end\n", time.Now().Format(time.RFC1123))
+	vcd.printf("$version qdpep8 $end\n")
+	vcd.printf("$timescale 1us $end\n")
+	vcd.printf("$scope module pep8 $end\n")
+	for idx, sig := range vcd.signals {
+		if idx == vcd.registers {
+			vcd.printf("$scope module memory $end\n")
+		}
+		vcd.printf("$var wire %d %s %s $end\n", sig.width, sig.id, sig.name)
+	}
+	if len(vcd.signals) > vcd.registers {
+		vcd.printf("$upscope $end\n")
+	}
+	vcd.printf("$upscope $end\n$enddefinitions $end\n")
+
+	// The initial IR is empty, nothing has been fetched yet
+	vcd.printf("#0\n$dumpvars\n")
+	for _, sig := range vcd.signals {
+		if cpu == nil {
+			if sig.width == 1 {
+				vcd.printf("x%s\n", sig.id)
+			} else {
+				vcd.printf("bx %s\n", sig.id)
+			}
+			continue
+		}
+		sig.last = sig.value(cpu, Instruction{})
+		vcd.writeValue(sig)
+	}
+	vcd.printf("$end\n")
+}
+
+func (vcd *VCD) AfterInstruction(cpu *Pep8CPU, ins Instruction) {
+	vcd.time++
+	changed := false
+	for _, sig := range vcd.signals {
+		val := sig.value(cpu, ins)
+		if val == sig.last {
+			continue
+		}
+		if !changed {
+			vcd.printf("#%d\n", vcd.time)
+			changed = true
+		}
+		sig.last = val
+		vcd.writeValue(sig)
+	}
+}
+
+func (vcd *VCD) writeValue(sig *vcdSignal) {
+	if sig.width == 1 {
+		vcd.printf("%d%s\n", sig.last, sig.id)
+		return
+	}
+	vcd.printf("b%s %s\n", strconv.FormatUint(uint64(sig.last), 2), sig.id)
+}
+
+// printf writes to the dump, unless writing failed before
+func (vcd *VCD) printf(format string, args ...interface{}) {
+	if vcd.Err != nil {
+		return
+	}
+	if _, err := fmt.Fprintf(vcd.out, format, args...); err != nil {
+		vcd.Err = err
+	}
+}
+
+// Close ends the dump at the current time, and flushes it
+//
+// The header is written if no instruction ran, with unknown values.
+func (vcd *VCD) Close() error {
+	if !vcd.started {
+		vcd.writeHeader(nil)
+	}
+	vcd.printf("#%d\n", vcd.time+1)
+	if vcd.Err == nil {
+		vcd.Err = vcd.out.Flush()
+	}
+	return vcd.Err
+}
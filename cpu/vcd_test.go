@@ -0,0 +1,147 @@
+package cpu
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVCD(t *testing.T) {
+	out := &bytes.Buffer{}
+	vcd := NewVCD(out, []WatchedWord{{"n", 0x0020}})
+	observe([]byte{
+		0xC0, 0x00, 0x03, // LDA 3,i
+		0xE1, 0x00, 0x20, // STA 0x0020,d
+		0x80, 0x00, 0x04, // SUBA 4,i
+		0x00, // STOP
+	}, "", vcd)
+	if err := vcd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	date, dump, _ := strings.Cut(out.String(), "\n")
+	if !strings.HasPrefix(date, "$date ") || !strings.HasSuffix(date, " $end") {
+		t.Errorf("date %q", date)
+	}
+	// Only the signals that changed are written after an instruction
+	want := `$version qdpep8 $end
+$timescale 1us $end
+$scope module pep8 $end
+$var wire 16 ! PC $end
+$var wire 16 " SP $end
+$var wire 16 # A $end
+$var wire 16 $ X $end
+$var wire 24 % IR $end
+$var wire 1 & N $end
+$var wire 1 ' Z $end
+$var wire 1 ( V $end
+$var wire 1 ) C $end
+$scope module memory $end
+$var wire 16 * n $end
+$upscope $end
+$upscope $end
+$enddefinitions $end
+#0
+$dumpvars
+b0 !
+b1111111111111111 "
+b0 #
+b0 $
+b0 %
+0&
+0'
+0(
+0)
+b0 *
+$end
+#1
+b11 !
+b11 #
+b110000000000000000000011 %
+#2
+b110 !
+b111000010000000000100000 %
+b11 *
+#3
+b1001 !
+b1111111111111111 #
+b100000000000000000000100 %
+1&
+#4
+b1010 !
+b0 %
+#5
+`
+	if dump != want {
+		t.Errorf("dump:\n%s\nwant:\n%s", dump, want)
+	}
+}
+
+func TestVCDEmpty(t *testing.T) {
+	// Without instructions, the dump still has its definitions, the values
+	// are unknown
+	out := &bytes.Buffer{}
+	vcd := NewVCD(out, []WatchedWord{{"n", 0x0020}})
+	if err := vcd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, dump, _ := strings.Cut(out.String(), "$enddefinitions $end\n")
+	want := "#0\n$dumpvars\nbx !\nbx \"\nbx #\nbx $\nbx %\nx&\nx'\nx(\nx)\nbx *\n$end\n#1\n"
+	if dump != want {
+		t.Errorf("dump after the definitions:\n%q\nwant:\n%q", dump, want)
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct {
+	writes int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	fw.writes++
+	return 0, errors.New("disk full")
+}
+
+func TestVCDError(t *testing.T) {
+	// The first error is kept, nothing is written after it
+	fw := &failingWriter{}
+	vcd := NewVCD(fw, nil)
+	cpu := NewPep8Cpu()
+	cpu.Load([]byte{
+		0x70, 0x00, 0x01, // loop: ADDA 1,i
+		0x04, 0x00, 0x00, // BR loop,i
+	})
+	cpu.Observers = []Observer{vcd}
+	cpu.MaxSteps = 1000
+	cpu.Run()
+	if vcd.Err == nil || fw.writes != 1 {
+		t.Errorf("error %v after %d writes, want disk full after 1", vcd.Err, fw.writes)
+	}
+	if err := vcd.Close(); err != vcd.Err || fw.writes != 1 {
+		t.Errorf("Close: %v after %d writes, want the first error", err, fw.writes)
+	}
+}
+
+func TestVCDIDs(t *testing.T) {
+	for n, want := range map[int]string{0: "!", 93: "~", 94: "!!", 95: "\"!", 94 + 94*94: "!!!"} {
+		if got := vcdID(n); got != want {
+			t.Errorf("vcdID(%d) = %q, want %q", n, got, want)
+		}
+	}
+
+	// Identifiers are unique and printable
+	seen := map[string]int{}
+	for n := 0; n < 20000; n++ {
+		id := vcdID(n)
+		if prev, ok := seen[id]; ok {
+			t.Fatalf("vcdID(%d) = vcdID(%d) = %q", n, prev, id)
+		}
+		seen[id] = n
+		for _, c := range id {
+			if c < '!' || c > '~' {
+				t.Fatalf("vcdID(%d) = %q", n, id)
+			}
+		}
+	}
+}
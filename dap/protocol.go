@@ -0,0 +1,191 @@
+// Package dap implements a Debug Adapter Protocol server for the PEP/8 emulator
+//
+// The protocol is documented on https://microsoft.github.io/debug-adapter-protocol/
+// only the subset needed for debugging a Pep/8 program is implemented.
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// conn reads and writes base protocol messages, i.e. JSON payloads
+// preceded by a Content-Length header
+type conn struct {
+	rd *bufio.Reader
+
+	// mu guards the writer and the sequence number, events can be sent
+	// while the program runs in the background
+	mu  sync.Mutex
+	wr  io.Writer
+	seq int
+}
+
+func newConn(r io.Reader, w io.Writer) *conn {
+	return &conn{
+		rd: bufio.NewReader(r),
+		wr: w,
+	}
+}
+
+func (c *conn) readRequest() (*request, error) {
+	length := -1
+	for {
+		line, err := c.rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		key, val, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("malformed header: %q", line)
+		}
+		if strings.EqualFold(strings.TrimSpace(key), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(val))
+			if err != nil {
+				return nil, fmt.Errorf("malformed Content-Length: %s", err)
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length header")
+	}
+
+	payload := make([]byte, length)
+	_, err := io.ReadFull(c.rd, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &request{}
+	err = json.Unmarshal(payload, req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (c *conn) write(msg interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(c.wr, "Content-Length: %d\r\n\r\n%s", len(payload), payload)
+	return err
+}
+
+func (c *conn) respond(req *request, body interface{}, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	resp := response{
+		Seq:        c.seq,
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    err == nil,
+		Command:    req.Command,
+		Body:       body,
+	}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	return c.write(resp)
+}
+
+func (c *conn) send(name string, body interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	return c.write(event{
+		Seq:   c.seq,
+		Type:  "event",
+		Event: name,
+		Body:  body,
+	})
+}
+
+// outputChunk is the most output buffered before it is sent
+const outputChunk = 4096
+
+// outputWriter forwards the output of the program as output events
+//
+// The output is buffered, and sent by flush when the program stops or
+// reads input, as one event rather than one per character.
+type outputWriter struct {
+	conn     *conn
+	category string
+	buf      []byte
+}
+
+func (ow *outputWriter) Write(p []byte) (int, error) {
+	ow.buf = append(ow.buf, p...)
+	if len(ow.buf) >= outputChunk {
+		if err := ow.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flush sends the buffered output
+func (ow *outputWriter) flush() error {
+	if len(ow.buf) == 0 {
+		return nil
+	}
+	err := ow.conn.send("output", map[string]interface{}{
+		"category": ow.category,
+		"output":   string(ow.buf),
+	})
+	ow.buf = ow.buf[:0]
+	return err
+}
+
+// inputReader flushes the output before the program reads input
+type inputReader struct {
+	r   io.Reader
+	out *outputWriter
+}
+
+func (ir inputReader) Read(p []byte) (int, error) {
+	if err := ir.out.flush(); err != nil {
+		return 0, err
+	}
+	return ir.r.Read(p)
+}
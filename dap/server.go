@@ -0,0 +1,705 @@
+package dap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lbajolet/qdpep8/cpu"
+)
+
+const threadID = 1
+
+// Generated disassembly is served as the only source with a reference
+const disasmSourceRef = 1
+
+// Variable references for the scopes, the stack scope of a frame is
+// stackScopeRef + the frame's index
+const (
+	registersScopeRef = 1
+	symbolsScopeRef   = 2
+	stackScopeRef     = 3
+)
+
+// Max number of words shown for a stack frame
+const maxFrameWords = 64
+
+type stepMode int
+
+const (
+	stepContinue stepMode = iota
+	stepIn
+	stepOver
+	stepOut
+)
+
+type launchArgs struct {
+	// Program is the path to the object code to debug
+	Program string `json:"program"`
+	// Listing is the path to the assembler listing of the program, it
+	// defaults to the program with a .pepl extension if such a file exists
+	Listing string `json:"listing"`
+	// Input is the path to the file read by the program as its stdin
+	Input string `json:"input"`
+	// StopOnEntry stops before executing the first instruction
+	StopOnEntry bool `json:"stopOnEntry"`
+	// EOF runs the program in simulator mode, CHARI returns 0 on EOF
+	EOF bool `json:"eof"`
+}
+
+type source struct {
+	Name            string `json:"name,omitempty"`
+	Path            string `json:"path,omitempty"`
+	SourceReference int    `json:"sourceReference,omitempty"`
+}
+
+type breakpoint struct {
+	Verified bool    `json:"verified"`
+	Line     int     `json:"line,omitempty"`
+	Source   *source `json:"source,omitempty"`
+	Message  string  `json:"message,omitempty"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+// Server is a debug session for one Pep/8 program
+type Server struct {
+	conn *conn
+
+	// Set by launch, and never modified after that
+	lst    *cpu.Listing
+	src    source
+	disasm string
+
+	// Breakpoints can be set while the program runs
+	bpMu        sync.Mutex
+	breakpoints map[uint16]bool
+
+	// mu guards everything below, it is held while the program runs
+	mu          sync.Mutex
+	cpu         *cpu.Pep8CPU
+	out         *outputWriter
+	calls       *cpu.CallStack
+	stopOnEntry bool
+	faulted     bool
+	exited      bool
+
+	// running and pause are accessed without holding mu, requests are
+	// still served while the program runs
+	running int32
+	pause   int32
+}
+
+// Serve runs a debug session, reading requests from r and writing
+// responses and events to w until the client disconnects
+func Serve(r io.Reader, w io.Writer) error {
+	srv := &Server{
+		conn:        newConn(r, w),
+		breakpoints: map[uint16]bool{},
+	}
+
+	for {
+		req, err := srv.conn.readRequest()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		done, err := srv.handle(req)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func (srv *Server) handle(req *request) (bool, error) {
+	var body interface{}
+	var err error
+	var after func()
+
+	switch req.Command {
+	case "initialize":
+		body = map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsReadMemoryRequest":        true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		}
+		after = func() { srv.conn.send("initialized", nil) }
+	case "launch":
+		err = srv.launch(req.Arguments)
+	case "setBreakpoints":
+		body, err = srv.setBreakpoints(req.Arguments)
+	case "setExceptionBreakpoints":
+		body = map[string]interface{}{"breakpoints": []breakpoint{}}
+	case "configurationDone":
+		after = srv.start
+	case "threads":
+		body = map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": threadID, "name": "main"}},
+		}
+	case "stackTrace":
+		body, err = srv.stackTrace()
+	case "scopes":
+		body, err = srv.scopes(req.Arguments)
+	case "variables":
+		body, err = srv.variables(req.Arguments)
+	case "source":
+		body, err = srv.sourceContent(req.Arguments)
+	case "readMemory":
+		body, err = srv.readMemory(req.Arguments)
+	case "evaluate":
+		body, err = srv.evaluate(req.Arguments)
+	case "continue":
+		body = map[string]interface{}{"allThreadsContinued": true}
+		after = func() { srv.resume(stepContinue) }
+	case "next":
+		after = func() { srv.resume(stepOver) }
+	case "stepIn":
+		after = func() { srv.resume(stepIn) }
+	case "stepOut":
+		after = func() { srv.resume(stepOut) }
+	case "pause":
+		atomic.StoreInt32(&srv.pause, 1)
+	case "disconnect", "terminate":
+		atomic.StoreInt32(&srv.pause, 1)
+		srv.mu.Lock()
+		srv.exited = true
+		srv.mu.Unlock()
+		if req.Command == "terminate" {
+			after = func() { srv.conn.send("terminated", nil) }
+		}
+	default:
+		err = fmt.Errorf("unsupported request: %s", req.Command)
+	}
+
+	if rerr := srv.conn.respond(req, body, err); rerr != nil {
+		return true, rerr
+	}
+	if after != nil {
+		after()
+	}
+	return req.Command == "disconnect", nil
+}
+
+func (srv *Server) launch(raw json.RawMessage) error {
+	args := launchArgs{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+
+	prgm, err := cpu.ReadObjectFile(args.Program)
+	if err != nil {
+		return fmt.Errorf("load error: %s", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.cpu = cpu.NewPep8Cpu()
+	srv.cpu.Load(prgm)
+	srv.cpu.NoEOFChariStop = args.EOF
+	srv.out = &outputWriter{conn: srv.conn, category: "stdout"}
+	srv.cpu.Out = srv.out
+	// Output events carry text, the output must be valid UTF-8
+	srv.cpu.Encoding = cpu.EncodingLatin1
+	in := []byte{}
+	if args.Input != "" {
+		in, err = os.ReadFile(args.Input)
+		if err != nil {
+			return fmt.Errorf("input file error: %s", err)
+		}
+	}
+	srv.cpu.In = inputReader{bytes.NewReader(in), srv.out}
+
+	if args.Listing == "" {
+		pepl := strings.TrimSuffix(args.Program, filepath.Ext(args.Program)) + ".pepl"
+		if _, err := os.Stat(pepl); err == nil {
+			args.Listing = pepl
+		}
+	}
+
+	if args.Listing != "" {
+		srv.lst, err = cpu.LoadListing(args.Listing)
+		if err != nil {
+			return fmt.Errorf("listing error: %s", err)
+		}
+		path, _ := filepath.Abs(args.Listing)
+		srv.src = source{Name: filepath.Base(path), Path: path}
+	} else {
+		srv.lst = srv.cpu.Disassemble(0, len(prgm))
+		text := strings.Builder{}
+		for _, ll := range srv.lst.Lines {
+			text.WriteString(ll.Text)
+			text.WriteByte('\n')
+		}
+		srv.disasm = text.String()
+		srv.src = source{
+			Name:            filepath.Base(args.Program) + " (disassembly)",
+			SourceReference: disasmSourceRef,
+		}
+	}
+
+	srv.calls = &cpu.CallStack{
+		Symbols: srv.lst,
+		OnBadReturn: func(br cpu.BadReturn) {
+			srv.conn.send("output", map[string]interface{}{
+				"category": "stderr",
+				"output":   fmt.Sprintf("warning: %s\n", br),
+			})
+		},
+	}
+	srv.cpu.Observers = append(srv.cpu.Observers, srv.calls)
+
+	srv.cpu.PC = 0
+	srv.cpu.SP = 0xFFFF
+	srv.stopOnEntry = args.StopOnEntry
+	return nil
+}
+
+func (srv *Server) setBreakpoints(raw json.RawMessage) (interface{}, error) {
+	args := struct {
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	if srv.lst == nil {
+		return nil, fmt.Errorf("no program launched")
+	}
+
+	srv.bpMu.Lock()
+	defer srv.bpMu.Unlock()
+
+	srv.breakpoints = map[uint16]bool{}
+	bps := []breakpoint{}
+	for _, bp := range args.Breakpoints {
+		ll, ok := srv.lst.InstructionAt(bp.Line)
+		if !ok {
+			bps = append(bps, breakpoint{
+				Verified: false,
+				Line:     bp.Line,
+				Message:  "no instruction at or after this line",
+			})
+			continue
+		}
+		srv.breakpoints[ll.Addr] = true
+		src := srv.src
+		bps = append(bps, breakpoint{Verified: true, Line: ll.Num, Source: &src})
+	}
+
+	return map[string]interface{}{"breakpoints": bps}, nil
+}
+
+func (srv *Server) start() {
+	srv.mu.Lock()
+	entry := srv.stopOnEntry
+	srv.mu.Unlock()
+
+	if entry {
+		srv.stopped("entry", "")
+		return
+	}
+	srv.resume(stepContinue)
+}
+
+func (srv *Server) resume(mode stepMode) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if atomic.LoadInt32(&srv.running) != 0 || srv.exited || srv.cpu == nil {
+		return
+	}
+	if srv.faulted {
+		srv.exit(1)
+		return
+	}
+
+	atomic.StoreInt32(&srv.running, 1)
+	atomic.StoreInt32(&srv.pause, 0)
+	go srv.run(mode)
+}
+
+// run executes the program in the background, and reports why it stopped
+func (srv *Server) run(mode stepMode) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	reason := srv.runUntilStop(mode)
+	atomic.StoreInt32(&srv.running, 0)
+	srv.out.flush()
+
+	switch {
+	case srv.exited:
+	case reason == "exited":
+		srv.exit(0)
+	case reason == "exception":
+		srv.faulted = true
+		srv.conn.send("output", map[string]interface{}{
+			"category": "stderr",
+			"output":   srv.cpu.Fault.Error() + "\n",
+		})
+		srv.stopped(reason, srv.cpu.Fault.Error())
+	default:
+		srv.stopped(reason, "")
+	}
+}
+
+// runUntilStop executes the program until it reaches a breakpoint,
+// finishes the requested step, is paused, or stops
+func (srv *Server) runUntilStop(mode stepMode) string {
+	depth := len(srv.calls.Frames)
+	for first := true; ; first = false {
+		if atomic.LoadInt32(&srv.pause) != 0 {
+			return "pause"
+		}
+		if !first && srv.isBreakpoint(srv.cpu.PC) {
+			return "breakpoint"
+		}
+
+		if !srv.cpu.DoNextCycle() {
+			if srv.cpu.Fault != nil {
+				return "exception"
+			}
+			return "exited"
+		}
+
+		switch {
+		case mode == stepIn,
+			mode == stepOver && len(srv.calls.Frames) <= depth,
+			mode == stepOut && len(srv.calls.Frames) < depth:
+			return "step"
+		}
+	}
+}
+
+func (srv *Server) isBreakpoint(addr uint16) bool {
+	srv.bpMu.Lock()
+	defer srv.bpMu.Unlock()
+	return srv.breakpoints[addr]
+}
+
+func (srv *Server) exit(code int) {
+	srv.exited = true
+	srv.conn.send("exited", map[string]interface{}{"exitCode": code})
+	srv.conn.send("terminated", nil)
+}
+
+func (srv *Server) stopped(reason, text string) {
+	body := map[string]interface{}{
+		"reason":            reason,
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	}
+	if text != "" {
+		body["description"] = text
+		body["text"] = text
+	}
+	srv.conn.send("stopped", body)
+}
+
+// lockStopped locks the session, and fails if the program is running
+//
+// The program runs holding the lock, a request made while it runs fails
+// rather than waiting for it to stop. The state is checked again once
+// locked, the program may have been resumed or stopped meanwhile.
+func (srv *Server) lockStopped() error {
+	if atomic.LoadInt32(&srv.running) != 0 {
+		return fmt.Errorf("the program is running")
+	}
+	srv.mu.Lock()
+	if atomic.LoadInt32(&srv.running) != 0 {
+		srv.mu.Unlock()
+		return fmt.Errorf("the program is running")
+	}
+	if srv.cpu == nil {
+		srv.mu.Unlock()
+		return fmt.Errorf("no program launched")
+	}
+	return nil
+}
+
+func (srv *Server) stackTrace() (interface{}, error) {
+	if err := srv.lockStopped(); err != nil {
+		return nil, err
+	}
+	defer srv.mu.Unlock()
+
+	frames := []map[string]interface{}{}
+	pc := srv.cpu.PC
+	calls := srv.calls.Frames
+	for idx := len(calls); idx >= 0; idx-- {
+		name := "main"
+		if idx > 0 {
+			name = srv.calls.Name(calls[idx-1].Callee)
+		}
+
+		sf := map[string]interface{}{
+			"id":                          idx,
+			"name":                        name,
+			"line":                        0,
+			"column":                      0,
+			"instructionPointerReference": fmt.Sprintf("0x%04x", pc),
+		}
+		if line, ok := srv.lst.LineAt(pc); ok {
+			src := srv.src
+			sf["line"] = line
+			sf["column"] = 1
+			sf["source"] = &src
+		}
+		frames = append(frames, sf)
+
+		if idx > 0 {
+			pc = calls[idx-1].Site
+		}
+	}
+
+	return map[string]interface{}{
+		"stackFrames": frames,
+		"totalFrames": len(frames),
+	}, nil
+}
+
+func (srv *Server) scopes(raw json.RawMessage) (interface{}, error) {
+	args := struct {
+		FrameID int `json:"frameId"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	if err := srv.lockStopped(); err != nil {
+		return nil, err
+	}
+	defer srv.mu.Unlock()
+
+	scopes := []map[string]interface{}{
+		{"name": "Registers", "variablesReference": registersScopeRef, "expensive": false},
+		{"name": "Stack frame", "variablesReference": stackScopeRef + args.FrameID, "expensive": false},
+	}
+	if len(srv.lst.Symbols) > 0 {
+		scopes = append(scopes, map[string]interface{}{
+			"name": "Symbols", "variablesReference": symbolsScopeRef, "expensive": false,
+		})
+	}
+
+	return map[string]interface{}{"scopes": scopes}, nil
+}
+
+func (srv *Server) variables(raw json.RawMessage) (interface{}, error) {
+	args := struct {
+		VariablesReference int `json:"variablesReference"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	if err := srv.lockStopped(); err != nil {
+		return nil, err
+	}
+	defer srv.mu.Unlock()
+
+	vars := []variable{}
+	c := srv.cpu
+	switch ref := args.VariablesReference; {
+	case ref == registersScopeRef:
+		vars = append(vars,
+			variable{Name: "A", Value: word(c.A)},
+			variable{Name: "X", Value: word(c.X)},
+			variable{Name: "SP", Value: word(c.SP), MemoryReference: fmt.Sprintf("0x%04x", c.SP)},
+			variable{Name: "PC", Value: word(c.PC), MemoryReference: fmt.Sprintf("0x%04x", c.PC)},
+			variable{Name: "N", Value: flag(c.N)},
+			variable{Name: "Z", Value: flag(c.Z)},
+			variable{Name: "V", Value: flag(c.V)},
+			variable{Name: "C", Value: flag(c.C)},
+			variable{Name: "Instruction", Value: c.Decode(c.PC).String()},
+		)
+	case ref == symbolsScopeRef:
+		for _, ll := range srv.lst.Lines {
+			if ll.Symbol == "" || !ll.HasAddr || ll.IsInstruction() {
+				continue
+			}
+			vars = append(vars, variable{
+				Name:            ll.Symbol,
+				Value:           word(srv.read16(ll.Addr)),
+				MemoryReference: fmt.Sprintf("0x%04x", ll.Addr),
+			})
+		}
+	case ref >= stackScopeRef && ref <= stackScopeRef+len(srv.calls.Frames):
+		lo, hi := srv.frameBounds(ref - stackScopeRef)
+		for addr := lo; addr+1 < hi && (addr-lo)/2 < maxFrameWords; addr += 2 {
+			vars = append(vars, variable{
+				Name:            fmt.Sprintf("%d,s", addr-lo),
+				Value:           word(srv.read16(uint16(addr))),
+				MemoryReference: fmt.Sprintf("0x%04x", addr),
+			})
+		}
+		if idx := ref - stackScopeRef; idx > 0 {
+			vars = append(vars, variable{
+				Name:  "return address",
+				Value: word(srv.read16(srv.calls.Frames[idx-1].SP)),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown variables reference %d", args.VariablesReference)
+	}
+
+	return map[string]interface{}{"variables": vars}, nil
+}
+
+// frameBounds returns the range of stack addresses owned by frame idx,
+// i.e. its local variables, below the return address of the frame
+func (srv *Server) frameBounds(idx int) (int, int) {
+	calls := srv.calls.Frames
+	lo := int(srv.cpu.SP)
+	if idx < len(calls) {
+		lo = int(calls[idx].SP) + 2
+	}
+	hi := 0x10000
+	if idx > 0 {
+		hi = int(calls[idx-1].SP)
+	}
+	if lo > hi {
+		lo = hi
+	}
+	return lo, hi
+}
+
+func (srv *Server) sourceContent(raw json.RawMessage) (interface{}, error) {
+	args := struct {
+		SourceReference int `json:"sourceReference"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	if args.SourceReference != disasmSourceRef || srv.disasm == "" {
+		return nil, fmt.Errorf("unknown source reference %d", args.SourceReference)
+	}
+	return map[string]interface{}{"content": srv.disasm}, nil
+}
+
+func (srv *Server) readMemory(raw json.RawMessage) (interface{}, error) {
+	args := struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Count           int    `json:"count"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	base, err := strconv.ParseUint(args.MemoryReference, 0, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory reference %q", args.MemoryReference)
+	}
+
+	if err := srv.lockStopped(); err != nil {
+		return nil, err
+	}
+	defer srv.mu.Unlock()
+
+	// The bytes out of the memory are unreadable, the address of a read
+	// past its end is the end of the memory
+	if args.Count < 0 {
+		args.Count = 0
+	}
+	start := clamp(int(base)+args.Offset, 0, len(srv.cpu.RAM))
+	end := clamp(int(base)+args.Offset+args.Count, start, len(srv.cpu.RAM))
+
+	return map[string]interface{}{
+		"address":         fmt.Sprintf("0x%04x", start),
+		"unreadableBytes": args.Count - (end - start),
+		"data":            base64.StdEncoding.EncodeToString(srv.cpu.RAM[start:end]),
+	}, nil
+}
+
+// evaluate resolves a register, a symbol, or an address, to the word it holds
+func (srv *Server) evaluate(raw json.RawMessage) (interface{}, error) {
+	args := struct {
+		Expression string `json:"expression"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	if err := srv.lockStopped(); err != nil {
+		return nil, err
+	}
+	defer srv.mu.Unlock()
+
+	expr := strings.TrimSpace(args.Expression)
+	var val uint16
+	switch strings.ToUpper(expr) {
+	case "A":
+		val = srv.cpu.A
+	case "X":
+		val = srv.cpu.X
+	case "SP":
+		val = srv.cpu.SP
+	case "PC":
+		val = srv.cpu.PC
+	default:
+		addr, ok := srv.lst.Symbols[expr]
+		if !ok {
+			parsed, err := strconv.ParseUint(expr, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("cannot evaluate %q: not a register, symbol or address", expr)
+			}
+			addr = uint16(parsed)
+		}
+		val = srv.read16(addr)
+	}
+
+	return map[string]interface{}{
+		"result":             word(val),
+		"variablesReference": 0,
+	}, nil
+}
+
+func (srv *Server) read16(addr uint16) uint16 {
+	return uint16(srv.cpu.RAM[addr])<<8 | uint16(srv.cpu.RAM[addr+1])
+}
+
+// clamp returns val within [lo, hi]
+func clamp(val, lo, hi int) int {
+	if val < lo {
+		return lo
+	}
+	if val > hi {
+		return hi
+	}
+	return val
+}
+
+func word(val uint16) string {
+	return fmt.Sprintf("0x%04x (%d)", val, int16(val))
+}
+
+func flag(val bool) string {
+	if val {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,323 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exampleProgram loads two words, adds them, stores the sum at 0x000E, and
+// stops
+const exampleProgram = "../cpu_tests/tests/01-exemple/01-exemple.pepo"
+
+// message is a response or an event read by the client
+type message struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Event      string          `json:"event"`
+	Command    string          `json:"command"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// client drives a server over pipes, as an editor would
+type client struct {
+	t      *testing.T
+	w      io.Writer
+	msgs   chan message
+	seq    int
+	events []message
+}
+
+func newClient(t *testing.T) (*client, chan error) {
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(reqR, respW)
+		respW.Close()
+	}()
+
+	c := &client{t: t, w: reqW, msgs: make(chan message, 64)}
+	go func() {
+		defer close(c.msgs)
+		rd := bufio.NewReader(respR)
+		for {
+			msg, err := readMessage(rd)
+			if err != nil {
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	t.Cleanup(func() { reqW.Close() })
+	return c, done
+}
+
+func readMessage(rd *bufio.Reader) (message, error) {
+	msg := message{}
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return msg, err
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Content-Length:")))
+	if err != nil {
+		return msg, err
+	}
+	if _, err := rd.ReadString('\n'); err != nil {
+		return msg, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		return msg, err
+	}
+	return msg, json.Unmarshal(payload, &msg)
+}
+
+// next returns the next message of the server
+func (c *client) next() message {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatal("the server closed the connection")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("no message from the server")
+	}
+	return message{}
+}
+
+// request sends a request and returns its response, keeping the events
+// received meanwhile
+func (c *client) request(command string, args interface{}) message {
+	c.t.Helper()
+	c.seq++
+	payload, err := json.Marshal(map[string]interface{}{
+		"seq": c.seq, "type": "request", "command": command, "arguments": args,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(payload), payload); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		msg := c.next()
+		if msg.Type == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg.RequestSeq != c.seq || msg.Command != command {
+			c.t.Fatalf("response to %s #%d, want %s #%d", msg.Command, msg.RequestSeq, command, c.seq)
+		}
+		return msg
+	}
+}
+
+// success sends a request that must succeed, and decodes its body in body
+func (c *client) success(command string, args interface{}, body interface{}) {
+	c.t.Helper()
+	resp := c.request(command, args)
+	if !resp.Success {
+		c.t.Fatalf("%s failed: %s", command, resp.Message)
+	}
+	if body != nil {
+		if err := json.Unmarshal(resp.Body, body); err != nil {
+			c.t.Fatalf("%s body: %s", command, err)
+		}
+	}
+}
+
+// event waits for an event, the ones received before are looked at first
+func (c *client) event(name string) message {
+	c.t.Helper()
+	for idx, ev := range c.events {
+		if ev.Event == name {
+			c.events = append(c.events[:idx], c.events[idx+1:]...)
+			return ev
+		}
+	}
+	for {
+		msg := c.next()
+		if msg.Type == "event" && msg.Event == name {
+			return msg
+		}
+		c.events = append(c.events, msg)
+	}
+}
+
+type memory struct {
+	Address         string `json:"address"`
+	UnreadableBytes int    `json:"unreadableBytes"`
+	Data            string `json:"data"`
+}
+
+func (c *client) readMemory(ref string, offset, count int) memory {
+	c.t.Helper()
+	mem := memory{}
+	c.success("readMemory", map[string]interface{}{"memoryReference": ref, "offset": offset, "count": count}, &mem)
+	return mem
+}
+
+func TestSession(t *testing.T) {
+	c, done := newClient(t)
+
+	c.success("initialize", map[string]interface{}{"adapterID": "qdpep8"}, nil)
+	c.event("initialized")
+	c.success("launch", map[string]interface{}{"program": exampleProgram}, nil)
+
+	// Without a listing, the breakpoints are set on the disassembly, at the
+	// line of ADDA
+	src := struct {
+		Content string `json:"content"`
+	}{}
+	c.success("source", map[string]interface{}{"sourceReference": disasmSourceRef}, &src)
+	line := 0
+	for num, text := range strings.Split(src.Content, "\n") {
+		if strings.HasPrefix(text, "0003 ") {
+			line = num + 1
+		}
+	}
+	if line == 0 {
+		t.Fatalf("no instruction at 0003 in the disassembly:\n%s", src.Content)
+	}
+	bps := struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}{}
+	c.success("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"sourceReference": disasmSourceRef},
+		"breakpoints": []map[string]interface{}{{"line": line}},
+	}, &bps)
+	if len(bps.Breakpoints) != 1 || !bps.Breakpoints[0].Verified || bps.Breakpoints[0].Line != line {
+		t.Fatalf("breakpoints %+v, want one verified on line %d", bps.Breakpoints, line)
+	}
+
+	c.success("configurationDone", nil, nil)
+	stopped := struct {
+		Reason string `json:"reason"`
+	}{}
+	json.Unmarshal(c.event("stopped").Body, &stopped)
+	if stopped.Reason != "breakpoint" {
+		t.Fatalf("stopped on %s, want breakpoint", stopped.Reason)
+	}
+
+	trace := struct {
+		StackFrames []struct {
+			Name string `json:"name"`
+			Line int    `json:"line"`
+			IP   string `json:"instructionPointerReference"`
+		} `json:"stackFrames"`
+	}{}
+	c.success("stackTrace", map[string]interface{}{"threadId": threadID}, &trace)
+	if len(trace.StackFrames) != 1 {
+		t.Fatalf("%d stack frames, want 1", len(trace.StackFrames))
+	}
+	if sf := trace.StackFrames[0]; sf.Name != "main" || sf.Line != line || sf.IP != "0x0003" {
+		t.Errorf("stack frame %+v, want main at line %d, 0x0003", sf, line)
+	}
+
+	for _, tc := range []struct {
+		ref           string
+		offset, count int
+		address       string
+		data          []byte
+		unreadable    int
+	}{
+		{"0x0000", 0, 3, "0x0000", []byte{0xC1, 0x00, 0x0A}, 0},
+		{"0x0000", 10, 2, "0x000a", []byte{0x00, 0x03}, 0},
+		{"0xfffe", 0, 4, "0xfffe", []byte{0x00, 0x00}, 2},
+		{"0xffff", 1, 8, "0x10000", []byte{}, 8},
+		{"0xffff", 1 << 20, 8, "0x10000", []byte{}, 8},
+		{"0x0000", -4, 6, "0x0000", []byte{0xC1, 0x00}, 4},
+		{"0x0000", 0, -1, "0x0000", []byte{}, 0},
+	} {
+		mem := c.readMemory(tc.ref, tc.offset, tc.count)
+		data, err := base64.StdEncoding.DecodeString(mem.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mem.Address != tc.address || string(data) != string(tc.data) || mem.UnreadableBytes != tc.unreadable {
+			t.Errorf("readMemory(%s, %d, %d) = %s % x, %d unreadable, want %s % x, %d unreadable",
+				tc.ref, tc.offset, tc.count, mem.Address, data, mem.UnreadableBytes, tc.address, tc.data, tc.unreadable)
+		}
+	}
+	if resp := c.request("readMemory", map[string]interface{}{"memoryReference": "0x10000", "count": 1}); resp.Success {
+		t.Errorf("readMemory of 0x10000 succeeded")
+	}
+
+	c.success("continue", map[string]interface{}{"threadId": threadID}, nil)
+	exited := struct {
+		ExitCode int `json:"exitCode"`
+	}{-1}
+	json.Unmarshal(c.event("exited").Body, &exited)
+	if exited.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", exited.ExitCode)
+	}
+	c.event("terminated")
+
+	// The sum, 3 + 5, is stored at 0x000E
+	if mem := c.readMemory("0x000e", 0, 2); mem.Data != base64.StdEncoding.EncodeToString([]byte{0x00, 0x08}) {
+		t.Errorf("sum %s, want AAg=", mem.Data)
+	}
+
+	c.success("disconnect", nil, nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not stop on disconnect")
+	}
+}
+
+func TestOutputEvents(t *testing.T) {
+	// CHARO 'h'; CHARI 0x0020,d; CHARO 'i'; CHARO '!'; STOP
+	dir := t.TempDir()
+	program := filepath.Join(dir, "echo.pepo")
+	input := filepath.Join(dir, "input")
+	if err := os.WriteFile(program, []byte("50 00 68 49 00 20 50 00 69 50 00 21 00 zz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(input, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := newClient(t)
+	c.success("initialize", map[string]interface{}{"adapterID": "qdpep8"}, nil)
+	c.event("initialized")
+	c.success("launch", map[string]interface{}{"program": program, "input": input}, nil)
+	c.success("configurationDone", nil, nil)
+	c.event("exited")
+
+	// The output is sent before the input is read, and when the program
+	// stops, not a character at a time
+	outputs := []string{}
+	for _, ev := range c.events {
+		if ev.Event != "output" {
+			continue
+		}
+		out := struct {
+			Category string `json:"category"`
+			Output   string `json:"output"`
+		}{}
+		json.Unmarshal(ev.Body, &out)
+		outputs = append(outputs, out.Category+":"+out.Output)
+	}
+	if got := strings.Join(outputs, " "); got != "stdout:h stdout:i!" {
+		t.Errorf("output events %q, want stdout:h stdout:i!", got)
+	}
+	c.success("disconnect", nil, nil)
+}
@@ -5,9 +5,11 @@ go 1.18
 require (
 	github.com/alecthomas/participle/v2 v2.0.0-beta.5
 	github.com/spf13/cobra v1.6.1
+	golang.org/x/term v0.29.0
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 )
@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lbajolet/qdpep8/cpu"
+	"github.com/spf13/cobra"
+)
+
+// batchCmd runs the programs of a manifest
+var batchCmd = &cobra.Command{
+	Use:   "batch manifest",
+	Short: "Run many programs concurrently and summarize their results",
+	Long: `Run many programs concurrently and summarize their results.
+
+The manifest has a run per line: the object program, then optionally its
+input file and the file of its expected output, separated by spaces. A -
+stands for no input or no expected output, blank lines and lines starting
+with # are ignored. Relative paths are relative to the directory of the
+manifest.
+
+  # program                input            expected output
+  alice/tp1.pepo           tp1/input        tp1/expected_output
+  bob/tp1.pepo             tp1/input        tp1/expected_output
+  carol/tp1.pepo           -                -
+
+Every run has a status:
+
+  pass        the program stopped without fault, with the expected
+              output if any
+  fail        the output differs from the expected one
+  fault       the program faulted, whatever its output
+  step-limit  the program ran more instructions than --max-steps
+  time-limit  the program ran longer than --timeout
+  error       the program or its input could not be read
+
+The exit status is 1 unless every run passed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runBatch,
+}
+
+var batchWorkers *int
+var batchMaxSteps *uint64
+var batchTimeout *time.Duration
+var batchFormat *string
+var batchSimMode *bool
+var batchEncoding *string
+
+// batchEntry is a run of the manifest
+type batchEntry struct {
+	Program string `json:"program"`
+	// Input and Expected are empty when the manifest has a -
+	Input    string `json:"input,omitempty"`
+	Expected string `json:"expected,omitempty"`
+}
+
+// batchOutcome is the summary of a run
+type batchOutcome struct {
+	batchEntry
+	Status string `json:"status"`
+	Steps  uint64 `json:"steps"`
+	// OutputMatch is nil when no output is expected, it is set for the
+	// runs that faulted too
+	OutputMatch *bool   `json:"output_match,omitempty"`
+	Fault       string  `json:"fault,omitempty"`
+	Seconds     float64 `json:"seconds"`
+}
+
+// readManifest reads the runs of a manifest
+func readManifest(path string) ([]batchEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "-" {
+			return ""
+		}
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	entries := []batchEntry{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected program [input [expected]], got %d fields", path, line, len(fields))
+		}
+		for len(fields) < 3 {
+			fields = append(fields, "-")
+		}
+		entries = append(entries, batchEntry{
+			Program:  resolve(fields[0]),
+			Input:    resolve(fields[1]),
+			Expected: resolve(fields[2]),
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// loadJob reads the program and input of a run
+func (be batchEntry) loadJob(enc cpu.Encoding) (cpu.Job, error) {
+	prgm, err := cpu.ReadObjectFile(be.Program)
+	if err != nil {
+		return cpu.Job{}, err
+	}
+	job := cpu.Job{
+		Program:        prgm,
+		NoEOFChariStop: *batchSimMode,
+		Encoding:       enc,
+		MaxSteps:       *batchMaxSteps,
+		Timeout:        *batchTimeout,
+	}
+	if be.Input != "" {
+		if job.Input, err = os.ReadFile(be.Input); err != nil {
+			return cpu.Job{}, err
+		}
+	}
+	return job, nil
+}
+
+// outcome summarizes the result of the run
+func (be batchEntry) outcome(res cpu.Result) batchOutcome {
+	bo := batchOutcome{
+		batchEntry: be,
+		Steps:      res.Steps,
+		Seconds:    res.Duration.Seconds(),
+	}
+	if res.Fault != nil {
+		bo.Fault = res.Fault.Error()
+	}
+	if be.Expected != "" {
+		expected, err := os.ReadFile(be.Expected)
+		if err != nil {
+			bo.Status, bo.Fault = "error", err.Error()
+			return bo
+		}
+		match := bytes.Equal(expected, res.Output)
+		bo.OutputMatch = &match
+	}
+
+	// A fault is reported even when the output is the expected one
+	switch {
+	case res.Fault == cpu.ErrStepLimit:
+		bo.Status = "step-limit"
+	case res.Fault == cpu.ErrTimeLimit:
+		bo.Status = "time-limit"
+	case res.Fault != nil:
+		bo.Status = "fault"
+	case bo.OutputMatch != nil && !*bo.OutputMatch:
+		bo.Status = "fail"
+	default:
+		bo.Status = "pass"
+	}
+	return bo
+}
+
+func runBatch(cmd *cobra.Command, args []string) error {
+	if *batchFormat != "table" && *batchFormat != "json" {
+		return fmt.Errorf("unknown format %q, expected table or json", *batchFormat)
+	}
+	encoding, err := cpu.ParseEncoding(*batchEncoding)
+	if err != nil {
+		return err
+	}
+	entries, err := readManifest(args[0])
+	if err != nil {
+		return fmt.Errorf("manifest error: %s", err)
+	}
+
+	// The runs that cannot be loaded are reported, without stopping the
+	// others
+	outcomes := make([]batchOutcome, len(entries))
+	jobs := []cpu.Job{}
+	ran := []int{}
+	for idx, be := range entries {
+		job, err := be.loadJob(encoding)
+		if err != nil {
+			outcomes[idx] = batchOutcome{batchEntry: be, Status: "error", Fault: err.Error()}
+			continue
+		}
+		jobs = append(jobs, job)
+		ran = append(ran, idx)
+	}
+	for k, res := range cpu.RunBatch(jobs, *batchWorkers) {
+		outcomes[ran[k]] = entries[ran[k]].outcome(res)
+	}
+
+	if *batchFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(outcomes); err != nil {
+			return err
+		}
+	} else {
+		writeBatchTable(os.Stdout, outcomes)
+	}
+
+	for _, bo := range outcomes {
+		if bo.Status != "pass" {
+			os.Exit(1)
+		}
+	}
+	return nil
+}
+
+// writeBatchTable writes the outcomes as a table, followed by the count of
+// each status
+func writeBatchTable(w io.Writer, outcomes []batchOutcome) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "STATUS\tPROGRAM\tSTEPS\tOUTPUT\tFAULT\n")
+	counts := map[string]int{}
+	for _, bo := range outcomes {
+		counts[bo.Status]++
+		match := "-"
+		if bo.OutputMatch != nil {
+			match = "differs"
+			if *bo.OutputMatch {
+				match = "matches"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", bo.Status, bo.Program, bo.Steps, match, bo.Fault)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d runs:", len(outcomes))
+	for _, status := range []string{"pass", "fail", "fault", "step-limit", "time-limit", "error"} {
+		if counts[status] > 0 {
+			fmt.Fprintf(w, " %d %s", counts[status], status)
+		}
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+func init() {
+	flags := batchCmd.Flags()
+	batchWorkers = flags.IntP("jobs", "j", 0, "number of programs run at the same time, defaults to the number of CPUs")
+	batchMaxSteps = flags.Uint64("max-steps", 0, "stop a program after this many instructions, 0 for no limit")
+	batchTimeout = flags.Duration("timeout", 10*time.Second, "stop a program after running this long, 0 for no limit")
+	batchFormat = flags.StringP("format", "f", "table", "format of the summary, table or json")
+	batchSimMode = flags.BoolP("eof", "e", false, "run as in simulator mode, i.e. on EOF return some \\x00 rather than immediately stopping")
+	batchEncoding = flags.String("encoding", "raw", "encoding of the characters output by the programs: raw writes their bytes as they are, latin1 writes them UTF-8 encoded")
+	rootCmd.AddCommand(batchCmd)
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lbajolet/qdpep8/cpu"
+)
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	abs := filepath.Join(dir, "abs.pepo")
+	for _, tc := range []struct {
+		name     string
+		manifest string
+		want     []batchEntry
+		err      string
+	}{
+		{
+			name:     "full",
+			manifest: "a.pepo in out\n",
+			want: []batchEntry{
+				{Program: filepath.Join(dir, "a.pepo"), Input: filepath.Join(dir, "in"), Expected: filepath.Join(dir, "out")},
+			},
+		},
+		{
+			name:     "comments and blanks",
+			manifest: "# program input expected\n\n   \n  # indented\na.pepo\n",
+			want:     []batchEntry{{Program: filepath.Join(dir, "a.pepo")}},
+		},
+		{
+			name:     "dashes",
+			manifest: "a.pepo - out\nb.pepo in -\n",
+			want: []batchEntry{
+				{Program: filepath.Join(dir, "a.pepo"), Expected: filepath.Join(dir, "out")},
+				{Program: filepath.Join(dir, "b.pepo"), Input: filepath.Join(dir, "in")},
+			},
+		},
+		{
+			name:     "absolute and nested",
+			manifest: abs + "\tsub/in\n",
+			want:     []batchEntry{{Program: abs, Input: filepath.Join(dir, "sub", "in")}},
+		},
+		{
+			name:     "empty",
+			manifest: "",
+			want:     []batchEntry{},
+		},
+		{
+			name:     "too many fields",
+			manifest: "a.pepo in\na.pepo in out extra\n",
+			err:      "manifest:2: expected program [input [expected]], got 4 fields",
+		},
+	} {
+		path := filepath.Join(dir, "manifest")
+		if err := os.WriteFile(path, []byte(tc.manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readManifest(path)
+		if tc.err != "" {
+			if err == nil || !strings.HasSuffix(err.Error(), tc.err) {
+				t.Errorf("%s: error %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: entries %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := readManifest(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("no error reading a missing manifest")
+	}
+}
+
+func TestBatchOutcome(t *testing.T) {
+	dir := t.TempDir()
+	expected := filepath.Join(dir, "expected_output")
+	if err := os.WriteFile(expected, []byte("42"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fault := errors.New("Unsupported instruction: RETTR")
+
+	for _, tc := range []struct {
+		name     string
+		expected string
+		res      cpu.Result
+		status   string
+		match    string
+	}{
+		{"pass", expected, cpu.Result{Output: []byte("42")}, "pass", "true"},
+		{"pass without expected output", "", cpu.Result{Output: []byte("anything")}, "pass", "nil"},
+		{"fail", expected, cpu.Result{Output: []byte("41")}, "fail", "false"},
+		{"fault", "", cpu.Result{Fault: fault}, "fault", "nil"},
+		{"fault with the expected output", expected, cpu.Result{Output: []byte("42"), Fault: fault}, "fault", "true"},
+		{"fault with another output", expected, cpu.Result{Output: []byte("4"), Fault: fault}, "fault", "false"},
+		{"step limit", expected, cpu.Result{Output: []byte("42"), Fault: cpu.ErrStepLimit}, "step-limit", "true"},
+		{"time limit", "", cpu.Result{Fault: cpu.ErrTimeLimit}, "time-limit", "nil"},
+		{"missing expected output", filepath.Join(dir, "missing"), cpu.Result{Output: []byte("42")}, "error", "nil"},
+	} {
+		be := batchEntry{Program: "p.pepo", Expected: tc.expected}
+		bo := be.outcome(tc.res)
+		match := "nil"
+		if bo.OutputMatch != nil {
+			match = fmt.Sprint(*bo.OutputMatch)
+		}
+		if bo.Status != tc.status || match != tc.match {
+			t.Errorf("%s: status %s, output match %s, want %s, %s", tc.name, bo.Status, match, tc.status, tc.match)
+		}
+		if tc.res.Fault != nil && bo.Fault != tc.res.Fault.Error() {
+			t.Errorf("%s: fault %q, want %q", tc.name, bo.Fault, tc.res.Fault)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/lbajolet/qdpep8/dap"
+	"github.com/spf13/cobra"
+)
+
+// dapCmd runs the emulator as a debug adapter, for editor integration
+var dapCmd = &cobra.Command{
+	Use:   "dap",
+	Short: "Run a Debug Adapter Protocol server on stdin/stdout",
+	Long: `Run a Debug Adapter Protocol server on stdin/stdout.
+
+The program to debug is given by the launch request, with the following arguments:
+
+  program      path to the object code (.pepo)
+  listing      path to the assembler listing (.pepl), used to map addresses to lines
+  input        path to the input file for the program
+  stopOnEntry  stop before the first instruction
+  eof          run as in simulator mode, see --eof
+
+Without a listing, breakpoints are set on a disassembly of the program.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return dap.Serve(os.Stdin, os.Stdout)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dapCmd)
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lbajolet/qdpep8/cpu"
+)
+
+var dumpWhen *[]string
+var dumpRanges *[]string
+var dumpFormat *string
+var dumpFile *string
+
+// stepDumper dumps the memory after some steps of the program
+type stepDumper struct {
+	cpu.NopObserver
+	steps map[uint64]bool
+	dump  func(when string)
+}
+
+func (sd *stepDumper) AfterInstruction(c *cpu.Pep8CPU, ins cpu.Instruction) {
+	if c.Fault == nil && sd.steps[c.Steps] {
+		sd.dump(fmt.Sprintf("step %d", c.Steps))
+	}
+}
+
+// setupDump configures the memory dumps from the flags, the returned
+// function dumps the memory once the program stopped, if asked to
+func setupDump(c *cpu.Pep8CPU, lst *cpu.Listing) (func() error, error) {
+	if len(*dumpWhen) == 0 {
+		return func() error { return nil }, nil
+	}
+
+	format, err := cpu.ParseDumpFormat(*dumpFormat)
+	if err != nil {
+		return nil, err
+	}
+	ranges := []cpu.AddrRange{}
+	for _, text := range *dumpRanges {
+		ar, err := cpu.ParseAddrRange(resolveSymbols(text, lst))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, ar)
+	}
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if *dumpFile != "" {
+		file, err = os.Create(*dumpFile)
+		if err != nil {
+			return nil, fmt.Errorf("dump file error: %s", err)
+		}
+		out = file
+	} else if format == cpu.DumpRaw {
+		return nil, fmt.Errorf("raw dumps need a --dump-file")
+	}
+
+	var dumpErr error
+	dump := func(when string) {
+		if dumpErr != nil {
+			return
+		}
+		if format != cpu.DumpRaw {
+			fmt.Fprintf(out, "memory at %s:\n", when)
+		}
+		dumpErr = c.DumpMemory(out, ranges, format)
+	}
+
+	atStop, atFault := false, false
+	steps := map[uint64]bool{}
+	for _, when := range *dumpWhen {
+		switch when {
+		case "stop":
+			atStop = true
+		case "fault":
+			atFault = true
+		case "exit":
+			atStop, atFault = true, true
+		default:
+			step, err := strconv.ParseUint(when, 10, 64)
+			if err != nil || step == 0 {
+				return nil, fmt.Errorf("invalid dump point %q, expected stop, fault, exit or a step number", when)
+			}
+			steps[step] = true
+		}
+	}
+	if len(steps) > 0 {
+		c.Observers = append(c.Observers, &stepDumper{steps: steps, dump: dump})
+		c.Interleave = c.Interleave || file == nil
+	}
+
+	return func() error {
+		switch {
+		case c.Fault == nil && atStop:
+			dump(fmt.Sprintf("stop, step %d", c.Steps))
+		case c.Fault != nil && atFault:
+			dump(fmt.Sprintf("fault, step %d", c.Steps+1))
+		}
+		if file != nil {
+			if err := file.Close(); dumpErr == nil {
+				dumpErr = err
+			}
+		}
+		if dumpErr != nil {
+			return fmt.Errorf("dump error: %s", dumpErr)
+		}
+		return nil
+	}, nil
+}
+
+// resolveSymbols replaces the symbols of lst in a range by their address
+func resolveSymbols(text string, lst *cpu.Listing) string {
+	if lst == nil {
+		return text
+	}
+
+	// The length of a lo:len range is a number, not an address
+	sep := "-"
+	if strings.Contains(text, ":") {
+		sep = ":"
+	}
+	parts := strings.SplitN(text, sep, 2)
+	for idx := range parts {
+		if idx > 0 && sep == ":" {
+			break
+		}
+		if addr, ok := lst.Symbols[strings.TrimSpace(parts[idx])]; ok {
+			parts[idx] = fmt.Sprintf("%04x", addr)
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+func init() {
+	flags := rootCmd.Flags()
+	dumpWhen = flags.StringSlice("dump", nil, "dump the memory at these points: stop, fault, exit (stop or fault) or step numbers")
+	dumpRanges = flags.StringSlice("dump-range", nil, "address ranges dumped, as lo-hi or lo:len in hexadecimal or symbols, all the memory by default")
+	dumpFormat = flags.String("dump-format", "hex", "format of the dumps: hex (with ASCII), signed or unsigned decimal words, or raw bytes")
+	dumpFile = flags.String("dump-file", "", "write the dumps to this file rather than stdout")
+}
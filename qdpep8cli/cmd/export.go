@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lbajolet/qdpep8/cpu"
+)
+
+var chromeTraceFile *string
+var foldedFile *string
+var vcdFile *string
+var vcdWatch *[]string
+
+// setupExports registers the observers recording the run of the program
+// for the export flags, the returned function writes the files once the
+// program stopped
+func setupExports(c *cpu.Pep8CPU, program string, lst *cpu.Listing) (func() error, error) {
+	writers := []func() error{}
+
+	if *vcdFile != "" {
+		watch, err := watchedWords(lst)
+		if err != nil {
+			return nil, err
+		}
+		out, err := os.Create(*vcdFile)
+		if err != nil {
+			return nil, fmt.Errorf("vcd file error: %s", err)
+		}
+		vcd := cpu.NewVCD(out, watch)
+		c.Observers = append(c.Observers, vcd)
+		writers = append(writers, func() error {
+			err := vcd.Close()
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("vcd file error: %s", err)
+			}
+			return nil
+		})
+	}
+
+	if *chromeTraceFile != "" {
+		ct := cpu.NewChromeTrace(filepath.Base(program), lst)
+		c.Observers = append(c.Observers, ct)
+		writers = append(writers, func() error {
+			return writeExport(*chromeTraceFile, "chrome trace", ct.WriteJSON)
+		})
+	}
+
+	if *foldedFile != "" {
+		prof := cpu.NewProfiler()
+		c.Observers = append(c.Observers, prof)
+		writers = append(writers, func() error {
+			return writeExport(*foldedFile, "folded stacks", func(w io.Writer) error {
+				return prof.WriteFolded(w, lst)
+			})
+		})
+	}
+
+	return func() error {
+		for _, write := range writers {
+			if err := write(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// watchedWords resolves the words of --vcd-watch, as symbols of the
+// listing or addresses
+func watchedWords(lst *cpu.Listing) ([]cpu.WatchedWord, error) {
+	watch := []cpu.WatchedWord{}
+	for _, name := range *vcdWatch {
+		if lst != nil {
+			if addr, ok := lst.Symbols[name]; ok {
+				watch = append(watch, cpu.WatchedWord{Name: name, Addr: addr})
+				continue
+			}
+		}
+		addr, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(name), "0x"), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unknown word %q, expected a symbol of the listing or an address", name)
+		}
+		watch = append(watch, cpu.WatchedWord{Name: fmt.Sprintf("mem_%04x", addr), Addr: uint16(addr)})
+	}
+	return watch, nil
+}
+
+// writeExport creates path, and writes it with write
+func writeExport(path, what string, write func(w io.Writer) error) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("%s file error: %s", what, err)
+	}
+	err = write(out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s file error: %s", what, err)
+	}
+	return nil
+}
+
+func init() {
+	flags := rootCmd.Flags()
+	vcdFile = flags.String("vcd", "", "write the registers and flags after each cycle to this file as a Value Change Dump, for GTKWave")
+	vcdWatch = flags.StringSlice("vcd-watch", nil, "words of memory added to the VCD, as symbols or addresses")
+	foldedFile = flags.String("folded", "", "write the instructions executed per call stack to this file as folded stacks, for flamegraph tools")
+	chromeTraceFile = flags.String("chrome-trace", "", "write the calls and I/O of the program to this file as Chrome trace events, for Perfetto or chrome://tracing")
+}
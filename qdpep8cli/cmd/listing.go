@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lbajolet/qdpep8/cpu"
+)
+
+// loadListing loads the listing of program from path, or from the .pepl
+// next to program if path is empty, it returns nil if there is none
+func loadListing(program, path string) (*cpu.Listing, error) {
+	if path == "" {
+		pepl := strings.TrimSuffix(program, filepath.Ext(program)) + ".pepl"
+		if _, err := os.Stat(pepl); err != nil {
+			return nil, nil
+		}
+		path = pepl
+	}
+
+	lst, err := cpu.LoadListing(path)
+	if err != nil {
+		return nil, fmt.Errorf("listing error: %s", err)
+	}
+	return lst, nil
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lbajolet/qdpep8/cpu"
+)
+
+var memdiffPoints *string
+var memdiffCalls *bool
+var memdiffRanges *[]string
+
+// stepSnapshot takes a snapshot of the memory after a step of the program
+type stepSnapshot struct {
+	cpu.NopObserver
+	step uint64
+	snap []byte
+}
+
+func (ss *stepSnapshot) AfterInstruction(c *cpu.Pep8CPU, ins cpu.Instruction) {
+	if c.Fault == nil && c.Steps == ss.step {
+		ss.snap = c.Snapshot()
+	}
+}
+
+// parseMemdiffPoint parses start, stop or a step number, stop is -1
+func parseMemdiffPoint(text string) (int64, error) {
+	switch text {
+	case "start":
+		return 0, nil
+	case "stop":
+		return -1, nil
+	}
+	step, err := strconv.ParseUint(text, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memdiff point %q, expected start, stop or a step number", text)
+	}
+	return int64(step), nil
+}
+
+// setupMemdiff configures the memory diffs from the flags, the returned
+// function writes the diff between the points once the program stopped
+func setupMemdiff(c *cpu.Pep8CPU, lst *cpu.Listing) (func() error, error) {
+	done := func() error { return nil }
+	if *memdiffPoints == "" && !*memdiffCalls {
+		return done, nil
+	}
+
+	ranges := []cpu.AddrRange{}
+	for _, text := range *memdiffRanges {
+		ar, err := cpu.ParseAddrRange(resolveSymbols(text, lst))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, ar)
+	}
+
+	if *memdiffCalls {
+		names := cpu.CallStack{Symbols: lst}
+		c.Observers = append(c.Observers, &cpu.CallDiffer{
+			Ranges: ranges,
+			OnReturn: func(fr cpu.Frame, changes []cpu.MemChange) {
+				if len(changes) == 0 {
+					return
+				}
+				fmt.Printf("memory changed by %s, called at %04x:\n", names.Name(fr.Callee), fr.Site)
+				cpu.WriteMemDiff(os.Stdout, changes, lst)
+			},
+		})
+		c.Interleave = true
+	}
+
+	if *memdiffPoints == "" {
+		return done, nil
+	}
+
+	from, to, ok := strings.Cut(*memdiffPoints, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid memdiff %q, expected from:to", *memdiffPoints)
+	}
+	points := []*stepSnapshot{}
+	for _, text := range []string{from, to} {
+		step, err := parseMemdiffPoint(text)
+		if err != nil {
+			return nil, err
+		}
+		ss := &stepSnapshot{}
+		switch {
+		case step == 0:
+			ss.snap = c.Snapshot()
+		case step > 0:
+			ss.step = uint64(step)
+			c.Observers = append(c.Observers, ss)
+		}
+		points = append(points, ss)
+	}
+
+	return func() error {
+		for _, ss := range points {
+			if ss.snap == nil && ss.step == 0 {
+				ss.snap = c.Snapshot()
+			}
+			if ss.snap == nil {
+				return fmt.Errorf("memdiff error: the program stopped before step %d", ss.step)
+			}
+		}
+		fmt.Printf("memory changed from %s to %s:\n", from, to)
+		cpu.WriteMemDiff(os.Stdout, cpu.DiffMemory(points[0].snap, points[1].snap, ranges), lst)
+		return nil
+	}, nil
+}
+
+func init() {
+	flags := rootCmd.Flags()
+	memdiffPoints = flags.String("memdiff", "", "print the memory changed between two points, as from:to with start, stop or step numbers, e.g. start:stop")
+	memdiffCalls = flags.Bool("memdiff-calls", false, "print the memory changed by every subroutine call")
+	memdiffRanges = flags.StringSlice("memdiff-range", nil, "address ranges compared, as lo-hi or lo:len in hexadecimal or symbols, all the memory by default")
+}
@@ -3,6 +3,8 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/lbajolet/qdpep8/cpu"
 	"github.com/spf13/cobra"
@@ -12,22 +14,74 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "qdpep8cli",
 	Short: "A quick-and-dirty implementation of a PEP/8 emulator",
-	Args:  cobra.ExactArgs(1),
-	RunE:  runCmd,
+	Long: `A quick-and-dirty implementation of a PEP/8 emulator.
+
+Run an object program on stdin and stdout, or the files of --input and
+--output. The exit status is 0 when the program stops on STOP. A program
+that faults, e.g. on an invalid addressing mode, on reading past the end
+of its input, or on RETTR, which is not supported, prints the fault and
+exits with status 1.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runCmd,
 }
 
 var inputFile *string
 var outputFile *string
 var simMode *bool
 var traceMode *bool
+var recordSize *int
+var listingFile *string
+var profileFile *string
+var coverageFile *string
+var coverageSummary *bool
+var fastMode *bool
+var backtraceMode *bool
+var outputEncoding *string
 
 func runCmd(cmd *cobra.Command, args []string) error {
-	cpu := cpu.NewPep8Cpu()
-	err := cpu.LoadFromFile(args[0])
+	var calls *cpu.CallStack
+	if *backtraceMode {
+		calls = &cpu.CallStack{
+			OnBadReturn: func(br cpu.BadReturn) {
+				fmt.Fprintf(os.Stderr, "warning: %s\n", br)
+			},
+		}
+	}
+	var recorder *cpu.Recorder
+	if *recordSize > 0 {
+		recorder = cpu.NewRecorder(*recordSize)
+	}
+	var profiler *cpu.Profiler
+	if *profileFile != "" {
+		profiler = cpu.NewProfiler()
+	}
+
+	var coverage *cpu.Coverage
+	if *coverageFile != "" || *coverageSummary {
+		coverage = cpu.NewCoverage()
+	}
+
+	lst, err := loadListing(args[0], *listingFile)
+	if err != nil {
+		return err
+	}
+	if calls != nil {
+		calls.Symbols = lst
+	}
+
+	prgm, err := cpu.ReadObjectFile(args[0])
 	if err != nil {
 		return fmt.Errorf("load error: %s", err)
 	}
 
+	encoding, err := cpu.ParseEncoding(*outputEncoding)
+	if err != nil {
+		return err
+	}
+
+	cpu := cpu.NewPep8Cpu()
+	cpu.Load(prgm)
+
 	if *inputFile != "" {
 		in, err := os.Open(*inputFile)
 		if err != nil {
@@ -47,12 +101,127 @@ func runCmd(cmd *cobra.Command, args []string) error {
 	if *simMode {
 		cpu.NoEOFChariStop = true
 	}
+	cpu.Encoding = encoding
 
-	if *traceMode {
-		cpu.Trace = true
+	if calls != nil {
+		cpu.Observers = append(cpu.Observers, calls)
+	}
+	if recorder != nil {
+		cpu.Observers = append(cpu.Observers, recorder)
+	}
+	if profiler != nil {
+		cpu.Observers = append(cpu.Observers, profiler)
+	}
+	if coverage != nil {
+		cpu.Observers = append(cpu.Observers, coverage)
 	}
 
-	return cpu.Run()
+	traceDone, err := setupTrace(cpu, lst)
+	if err != nil {
+		return err
+	}
+	exportsDone, err := setupExports(cpu, args[0], lst)
+	if err != nil {
+		return err
+	}
+	dumpDone, err := setupDump(cpu, lst)
+	if err != nil {
+		return err
+	}
+	memdiffDone, err := setupMemdiff(cpu, lst)
+	if err != nil {
+		return err
+	}
+
+	// The fast interpreter is used unless the run is traced or observed
+	if *fastMode && !cpu.CanRunFast() {
+		fmt.Fprintf(os.Stderr, "warning: the run is traced or observed, it is not run fast\n")
+	}
+	err = cpu.RunFast()
+	if terr := traceDone(); terr != nil {
+		return terr
+	}
+	if eerr := exportsDone(); eerr != nil {
+		return eerr
+	}
+	if derr := dumpDone(); derr != nil {
+		return derr
+	}
+	if merr := memdiffDone(); merr != nil {
+		return merr
+	}
+
+	if profiler != nil {
+		if perr := writeProfile(profiler, args[0], lst); perr != nil {
+			return perr
+		}
+	}
+
+	if coverage != nil {
+		if lst == nil {
+			lst = cpu.Disassemble(0, len(prgm))
+		}
+		if cerr := writeCoverage(coverage, args[0], lst); cerr != nil {
+			return cerr
+		}
+	}
+
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		if calls != nil {
+			fmt.Fprintf(os.Stderr, "backtrace:\n")
+			calls.WriteBacktrace(os.Stderr, cpu.PC)
+		}
+		if recorder != nil {
+			fmt.Fprintf(os.Stderr, "last instructions:\n")
+			recorder.Dump(os.Stderr)
+		}
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+func writeProfile(prof *cpu.Profiler, program string, lst *cpu.Listing) error {
+	out, err := os.Create(*profileFile)
+	if err != nil {
+		return fmt.Errorf("profile file error: %s", err)
+	}
+	defer out.Close()
+
+	if err := prof.WritePprof(out, program, lst); err != nil {
+		return fmt.Errorf("profile file error: %s", err)
+	}
+	return nil
+}
+
+func writeCoverage(cov *cpu.Coverage, program string, lst *cpu.Listing) error {
+	if *coverageSummary {
+		cov.WriteSummary(os.Stderr, lst)
+	}
+	if *coverageFile == "" {
+		return nil
+	}
+
+	// The lines of the coverage are the ones of the disassembly without a
+	// listing, it is saved next to the coverage for lcov tools to show it
+	if lst.Path == "" {
+		base := strings.TrimSuffix(filepath.Base(program), filepath.Ext(program))
+		if err := lst.Save(filepath.Join(filepath.Dir(*coverageFile), base+".dis.pepl")); err != nil {
+			return fmt.Errorf("disassembly file error: %s", err)
+		}
+	}
+
+	out, err := os.Create(*coverageFile)
+	if err != nil {
+		return fmt.Errorf("coverage file error: %s", err)
+	}
+	defer out.Close()
+
+	if err := cov.WriteLcov(out, lst); err != nil {
+		return fmt.Errorf("coverage file error: %s", err)
+	}
+	return nil
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -69,4 +238,13 @@ func init() {
 	outputFile = rootCmd.Flags().StringP("output", "o", "", "path to the output file for stdout")
 	simMode = rootCmd.Flags().BoolP("eof", "e", false, "run the tests as in simulator mode, i.e. on EOF return some \\x00 rather than immediately stopping")
 	traceMode = rootCmd.Flags().BoolP("trace", "t", false, "print the state of the CPU after each cycle")
+	listingFile = rootCmd.Flags().StringP("listing", "l", "", "path to the assembler listing of the program, to name its subroutines (defaults to the .pepl next to the program)")
+	profileFile = rootCmd.Flags().StringP("profile", "p", "", "write a pprof profile of the instructions executed to this file")
+	coverageFile = rootCmd.Flags().String("coverage", "", "write the coverage of the listing to this lcov file, without a listing the whole program is disassembled, data included, to a .dis.pepl file next to it")
+	coverageSummary = rootCmd.Flags().Bool("coverage-summary", false, "print a summary of the coverage, with the lines and branches missed, to stderr")
+	fastMode = rootCmd.Flags().Bool("fast", false, "run with the fast interpreter, warn if the tracing and analysis options prevent it")
+	rootCmd.Flags().MarkDeprecated("fast", "the fast interpreter is used whenever the run is not traced nor observed")
+	outputEncoding = rootCmd.Flags().String("encoding", "raw", "encoding of the characters output by the program: raw writes their bytes as they are, latin1 writes them UTF-8 encoded")
+	recordSize = rootCmd.Flags().IntP("record", "r", 0, "number of instructions to remember and print if the program faults, 0 to disable")
+	backtraceMode = rootCmd.Flags().Bool("backtrace", false, "track the subroutine calls, to print a backtrace if the program faults and warn of mismatched returns")
 }
@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lbajolet/qdpep8/cpu"
+	"github.com/spf13/cobra"
+)
+
+// testCmd runs a test directory
+var testCmd = &cobra.Command{
+	Use:   "test dir",
+	Short: "Run a directory of tests, as cpu_tests/tests",
+	Long: `Run a directory of tests, as cpu_tests/tests.
+
+A test is a directory with a single object program, and either the files
+of its run or a subtests directory with a directory of files per subtest:
+
+  tests/08-fib/08-fib.pepo
+  tests/08-fib/subtests/zero/{input,expected_output,expected_trace}
+  tests/09-liste/09-liste.pepo
+  tests/09-liste/{input,expected_output,expected_trace}
+
+A run passes when its output and its trace, as printed by -t, are the
+expected ones. A missing input is empty. The output is compared in the
+encoding of --encoding, raw by default: the expected outputs of
+cpu_tests/tests hold the bytes written by the programs. The runs are made
+concurrently, each under the step and time limits.
+
+The results are printed, and can be reported as JUnit XML and as JSON for
+continuous integration. The exit status is 1 unless every run passed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runTest,
+}
+
+var testWorkers *int
+var testMaxSteps *uint64
+var testTimeout *time.Duration
+var testFilter *string
+var testEncoding *string
+var testSimMode *bool
+var testJUnit *string
+var testJSON *string
+var testVerbose *bool
+
+// testOutcome is the result of a run of the suite
+type testOutcome struct {
+	Name    string `json:"name"`
+	Program string `json:"program,omitempty"`
+	// Status is pass, fail, or error when the run could not be made
+	Status  string  `json:"status"`
+	Steps   uint64  `json:"steps"`
+	Seconds float64 `json:"seconds"`
+	Fault   string  `json:"fault,omitempty"`
+	// Failures describe the mismatches with the expected files, or the
+	// error
+	Failures []string `json:"failures,omitempty"`
+}
+
+// testReport is the JSON report
+type testReport struct {
+	Suite   string        `json:"suite"`
+	Tests   int           `json:"tests"`
+	Passed  int           `json:"passed"`
+	Failed  int           `json:"failed"`
+	Errors  int           `json:"errors"`
+	Seconds float64       `json:"seconds"`
+	Cases   []testOutcome `json:"cases"`
+}
+
+func runTest(cmd *cobra.Command, args []string) error {
+	encoding, err := cpu.ParseEncoding(*testEncoding)
+	if err != nil {
+		return err
+	}
+	filter, err := regexp.Compile(*testFilter)
+	if err != nil {
+		return fmt.Errorf("invalid --run pattern: %s", err)
+	}
+	all, err := cpu.FindSuite(args[0])
+	if err != nil {
+		return fmt.Errorf("test directory error: %s", err)
+	}
+
+	start := time.Now()
+	cases := []cpu.SuiteCase{}
+	outcomes := []testOutcome{}
+	jobs := []cpu.Job{}
+	ran := []int{}
+	for _, sc := range all {
+		if !filter.MatchString(sc.Name) {
+			continue
+		}
+		cases = append(cases, sc)
+		outcomes = append(outcomes, testOutcome{Name: sc.Name, Program: sc.Program})
+		job, err := sc.Job()
+		if err != nil {
+			outcomes[len(outcomes)-1].Status = "error"
+			outcomes[len(outcomes)-1].Failures = []string{err.Error()}
+			continue
+		}
+		job.NoEOFChariStop = *testSimMode
+		job.Encoding = encoding
+		job.MaxSteps = *testMaxSteps
+		job.Timeout = *testTimeout
+		jobs = append(jobs, job)
+		ran = append(ran, len(outcomes)-1)
+	}
+	for k, res := range cpu.RunBatch(jobs, *testWorkers) {
+		to := &outcomes[ran[k]]
+		to.Steps, to.Seconds = res.Steps, res.Duration.Seconds()
+		if res.Fault != nil {
+			to.Fault = res.Fault.Error()
+		}
+		if res.Fault == cpu.ErrStepLimit || res.Fault == cpu.ErrTimeLimit {
+			to.Failures = append(to.Failures, res.Fault.Error())
+		}
+		to.Failures = append(to.Failures, cases[ran[k]].Check(res)...)
+		to.Status = "pass"
+		if len(to.Failures) > 0 {
+			to.Status = "fail"
+		}
+	}
+
+	report := testReport{Suite: filepath.Base(filepath.Clean(args[0])), Tests: len(outcomes), Seconds: time.Since(start).Seconds(), Cases: outcomes}
+	for _, to := range outcomes {
+		switch to.Status {
+		case "pass":
+			report.Passed++
+		case "fail":
+			report.Failed++
+		default:
+			report.Errors++
+		}
+	}
+
+	writeTestResults(os.Stdout, report)
+	if *testJUnit != "" {
+		if err := writeReportFile(*testJUnit, report, writeJUnit); err != nil {
+			return err
+		}
+	}
+	if *testJSON != "" {
+		if err := writeReportFile(*testJSON, report, writeTestJSON); err != nil {
+			return err
+		}
+	}
+
+	if report.Passed != report.Tests {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// writeTestResults prints a line per run, with the failures, and a summary
+func writeTestResults(w io.Writer, report testReport) {
+	for _, to := range report.Cases {
+		if to.Status == "pass" {
+			if *testVerbose {
+				fmt.Fprintf(w, "ok    %s (%d steps, %.3fs)\n", to.Name, to.Steps, to.Seconds)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%-5s %s\n", strings.ToUpper(to.Status), to.Name)
+		for _, failure := range to.Failures {
+			fmt.Fprintf(w, "      %s\n", strings.ReplaceAll(strings.TrimSuffix(failure, "\n"), "\n", "\n      "))
+		}
+	}
+	fmt.Fprintf(w, "%d tests: %d passed, %d failed, %d errors in %.3fs\n",
+		report.Tests, report.Passed, report.Failed, report.Errors, report.Seconds)
+}
+
+// writeReportFile writes a report to a file with write
+func writeReportFile(path string, report testReport, write func(io.Writer, testReport) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("report file error: %s", err)
+	}
+	err = write(f, report)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("report file error: %s", err)
+	}
+	return nil
+}
+
+func writeTestJSON(w io.Writer, report testReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// The JUnit XML elements, as read by CI servers
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the report as JUnit XML, a test case per run, named
+// after its subtest if any, in a class named after its test, with its
+// failures and fault
+func writeJUnit(w io.Writer, report testReport) error {
+	seconds := func(s float64) string { return fmt.Sprintf("%.3f", s) }
+	suite := junitTestSuite{
+		Name:     report.Suite,
+		Tests:    report.Tests,
+		Failures: report.Failed,
+		Errors:   report.Errors,
+		Time:     seconds(report.Seconds),
+	}
+	for _, to := range report.Cases {
+		tc := junitTestCase{Name: to.Name, ClassName: report.Suite, Time: seconds(to.Seconds)}
+		if test, sub, ok := strings.Cut(to.Name, "/"); ok {
+			tc.Name, tc.ClassName = sub, report.Suite+"."+test
+		}
+		if len(to.Failures) > 0 {
+			problem := &junitProblem{
+				Message: strings.SplitN(to.Failures[0], "\n", 2)[0],
+				Text:    strings.Join(to.Failures, "\n"),
+			}
+			// The fault is kept, unless it is a failure already, as the
+			// limits are
+			if to.Fault != "" && to.Failures[0] != to.Fault {
+				problem.Text += "\nfault: " + to.Fault
+			}
+			if to.Status == "error" {
+				tc.Error = problem
+			} else {
+				tc.Failure = problem
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err := enc.Encode(junitTestSuites{
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+func init() {
+	flags := testCmd.Flags()
+	testWorkers = flags.IntP("jobs", "j", 0, "number of runs made at the same time, defaults to the number of CPUs")
+	testMaxSteps = flags.Uint64("max-steps", 10000000, "fail a run after this many instructions, 0 for no limit")
+	testTimeout = flags.Duration("timeout", 10*time.Second, "fail a run after running this long, 0 for no limit")
+	testFilter = flags.String("run", "", "only make the runs whose name, e.g. 08-fib/zero, matches this regular expression")
+	testEncoding = flags.String("encoding", "raw", "encoding of the characters output by the programs: raw writes their bytes as they are, latin1 writes them UTF-8 encoded")
+	testSimMode = flags.BoolP("eof", "e", false, "run as in simulator mode, i.e. on EOF return some \\x00 rather than immediately stopping")
+	testJUnit = flags.String("junit", "", "write a JUnit XML report to this file")
+	testJSON = flags.String("json", "", "write a JSON report to this file")
+	testVerbose = flags.BoolP("verbose", "v", false, "print the runs that passed too")
+	rootCmd.AddCommand(testCmd)
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lbajolet/qdpep8/cpu"
+)
+
+var update = flag.Bool("update", false, "write the golden reports of testdata from the current results")
+
+// goldenReport has a run of each kind: passed, failed with the failures
+// of Check, faulted, stopped by the step limit, and not made
+var goldenReport = testReport{
+	Suite:   "tests",
+	Tests:   5,
+	Passed:  1,
+	Failed:  3,
+	Errors:  1,
+	Seconds: 1.5,
+	Cases: []testOutcome{
+		{Name: "08-fib/zero", Program: "tests/08-fib/08-fib.pepo", Status: "pass", Steps: 42, Seconds: 0.001},
+		{
+			Name:    "09-liste",
+			Program: "tests/09-liste/09-liste.pepo",
+			Status:  "fail",
+			Steps:   1234,
+			Seconds: 0.0125,
+			Failures: []string{
+				"output differs:\n--- expected\n+++ got\n-1 2 3\n+1 2 <3>",
+				"trace differs at line 12",
+			},
+		},
+		{
+			Name:     "10-rettr/main",
+			Program:  "tests/10-rettr/10-rettr.pepo",
+			Status:   "fail",
+			Steps:    7,
+			Seconds:  0.0004,
+			Fault:    "Unsupported instruction: RETTR",
+			Failures: []string{"output differs:\n--- expected\n+++ got\n-done\n+Unsupported instruction: RETTR"},
+		},
+		{
+			Name:     "11-boucle",
+			Program:  "tests/11-boucle/11-boucle.pepo",
+			Status:   "fail",
+			Steps:    10000000,
+			Seconds:  0.25,
+			Fault:    cpu.ErrStepLimit.Error(),
+			Failures: []string{cpu.ErrStepLimit.Error(), "output differs:\n--- expected\n+++ got\n-fin\n+"},
+		},
+		{
+			Name:     "12-missing",
+			Status:   "error",
+			Failures: []string{"no object program in tests/12-missing"},
+		},
+	},
+}
+
+func TestReports(t *testing.T) {
+	for _, tc := range []struct {
+		golden string
+		write  func(io.Writer, testReport) error
+	}{
+		{"report.xml", writeJUnit},
+		{"report.json", writeTestJSON},
+	} {
+		got := &bytes.Buffer{}
+		if err := tc.write(got, goldenReport); err != nil {
+			t.Fatalf("%s: %s", tc.golden, err)
+		}
+
+		path := filepath.Join("testdata", tc.golden)
+		if *update {
+			if err := os.WriteFile(path, got.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("%s differs, got:\n%s\nwant:\n%s", tc.golden, got, want)
+		}
+	}
+}
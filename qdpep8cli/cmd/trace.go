@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lbajolet/qdpep8/cpu"
+)
+
+var traceFormat *string
+var traceFields *string
+var traceFile *string
+var traceRanges *[]string
+var traceSubs *[]string
+var traceOps *string
+var traceFrom *uint64
+var traceTo *uint64
+
+// setupTrace configures the trace of the program run by c from the flags,
+// the returned function flushes the trace once the program stopped
+func setupTrace(c *cpu.Pep8CPU, lst *cpu.Listing) (func() error, error) {
+	done := func() error { return nil }
+	if !*traceMode && *traceFormat == "" {
+		return done, nil
+	}
+
+	format := cpu.TraceText
+	if *traceFormat != "" {
+		var err error
+		format, err = cpu.ParseTraceFormat(*traceFormat)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fields, err := cpu.ParseTraceFields(*traceFields)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := traceFilter(lst)
+	if err != nil {
+		return nil, err
+	}
+
+	// The trace is written unbuffered to stdout, as it is interleaved with
+	// the output of the program
+	var out io.Writer = os.Stdout
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			return nil, fmt.Errorf("trace file error: %s", err)
+		}
+		bw := bufio.NewWriter(f)
+		out = bw
+		done = func() error {
+			err := bw.Flush()
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("trace file error: %s", err)
+			}
+			return nil
+		}
+	}
+
+	if format == cpu.TraceText && isZeroFilter(filter) {
+		c.Trace = true
+		c.TraceOut = out
+		return done, nil
+	}
+
+	tracer := cpu.NewTracer(out, format, fields)
+	tracer.Filter = filter
+	c.Observers = append(c.Observers, tracer)
+	c.Interleave = c.Interleave || *traceFile == ""
+	return func() error {
+		if err := done(); err != nil {
+			return err
+		}
+		if tracer.Err != nil {
+			return fmt.Errorf("trace error: %s", tracer.Err)
+		}
+		return nil
+	}, nil
+}
+
+func isZeroFilter(tf cpu.TraceFilter) bool {
+	return tf.From == 0 && tf.To == 0 && len(tf.Addrs) == 0 && len(tf.Subroutines) == 0 && len(tf.Ops) == 0
+}
+
+func traceFilter(lst *cpu.Listing) (cpu.TraceFilter, error) {
+	tf := cpu.TraceFilter{From: *traceFrom, To: *traceTo}
+
+	for _, text := range *traceRanges {
+		ar, err := cpu.ParseAddrRange(text)
+		if err != nil {
+			return tf, err
+		}
+		tf.Addrs = append(tf.Addrs, ar)
+	}
+
+	for _, sub := range *traceSubs {
+		if lst != nil {
+			if addr, ok := lst.Symbols[sub]; ok {
+				tf.Subroutines = append(tf.Subroutines, addr)
+				continue
+			}
+		}
+		addr, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(sub), "0x"), 16, 16)
+		if err != nil {
+			return tf, fmt.Errorf("unknown subroutine %q, expected a symbol of the listing or an address", sub)
+		}
+		tf.Subroutines = append(tf.Subroutines, uint16(addr))
+	}
+
+	if *traceOps != "" {
+		ops, err := cpu.ParseOps(*traceOps)
+		if err != nil {
+			return tf, err
+		}
+		tf.Ops = ops
+	}
+
+	return tf, nil
+}
+
+func init() {
+	flags := rootCmd.Flags()
+	traceFormat = flags.String("trace-format", "", "print a trace of the CPU after each cycle in this format: text, jsonl or csv")
+	traceFields = flags.String("trace-fields", "all", "comma separated fields of the jsonl and csv traces: step, addr, pc, sp, a, x, opcode, spec, operand, effaddr, flags, mnemonic, mode, writes, in, out")
+	traceFile = flags.String("trace-file", "", "write the trace to this file rather than stdout")
+	traceRanges = flags.StringSlice("trace-range", nil, "only trace the instructions in these address ranges, as lo-hi or lo:len in hexadecimal")
+	traceSubs = flags.StringSlice("trace-sub", nil, "only trace the instructions executed within these subroutines, as symbols or addresses")
+	traceOps = flags.String("trace-only", "", "only trace these instructions, as comma separated mnemonics (e.g. LDA), operations of both registers (e.g. LD) or classes: branch, call, io")
+	traceFrom = flags.Uint64("trace-from", 0, "first step traced, starting at 1")
+	traceTo = flags.Uint64("trace-to", 0, "last step traced, 0 for no limit")
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lbajolet/qdpep8/cpu"
+	"github.com/spf13/cobra"
+)
+
+// tracediffCmd compares two traces
+var tracediffCmd = &cobra.Command{
+	Use:   "tracediff expected actual",
+	Short: "Report the first step where two traces diverge",
+	Long: `Report the first step where two traces diverge.
+
+The traces are aligned by step, and the registers, flags, operand
+specifier and opcode of every step are compared. The first divergence is
+shown with a few steps of context, followed by a summary of the steps
+that differ later on.
+
+Both the text traces of -t and the jsonl traces of --trace-format are
+read, other lines such as the output of the program are ignored. The
+exit status is 1 when the traces differ.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runTracediff,
+}
+
+var tracediffContext *int
+
+func runTracediff(cmd *cobra.Command, args []string) error {
+	traces := make([][]cpu.TraceStep, 2)
+	for idx, path := range args {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("trace error: %s", err)
+		}
+		traces[idx], err = cpu.ParseTrace(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("trace error: %s: %s", path, err)
+		}
+	}
+
+	td := cpu.DiffTraces(traces[0], traces[1])
+	td.Report(os.Stdout, *tracediffContext)
+	if !td.Equal() {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func init() {
+	tracediffContext = tracediffCmd.Flags().IntP("context", "C", 3, "number of steps shown around the first divergence")
+	rootCmd.AddCommand(tracediffCmd)
+}
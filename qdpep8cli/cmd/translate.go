@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lbajolet/qdpep8/cpu"
+	"github.com/spf13/cobra"
+)
+
+var translateOutput *string
+var translateEncoding *string
+
+var translateCmd = &cobra.Command{
+	Use:   "translate program.pepo",
+	Short: "Translate an object program to a Go program",
+	Long: `Translate an object program to a Go program that runs it on stdin and stdout.
+
+The instructions reachable by fallthrough and immediate branches and calls are
+translated to Go, the others, reached by computed jumps or overwritten by the
+program, run on the interpreter. The output is flushed before every read of
+stdin.
+
+The Go program is not standalone: it imports the cpu package of qdpep8, for
+the operations and the interpreter. It is meant to speed up long runs, build
+it within the qdpep8 module or a module that requires it.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runTranslate,
+}
+
+func runTranslate(cmd *cobra.Command, args []string) error {
+	prgm, err := cpu.ReadObjectFile(args[0])
+	if err != nil {
+		return fmt.Errorf("load error: %s", err)
+	}
+
+	encoding, err := cpu.ParseEncoding(*translateEncoding)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *translateOutput != "" {
+		f, err := os.Create(*translateOutput)
+		if err != nil {
+			return fmt.Errorf("output file error: %s", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	return cpu.Translate(out, prgm, filepath.Base(args[0]), encoding)
+}
+
+func init() {
+	translateOutput = translateCmd.Flags().StringP("output", "o", "", "write the Go program to this file rather than stdout")
+	translateEncoding = translateCmd.Flags().String("encoding", "raw", "encoding of the characters output by the program: raw writes their bytes as they are, latin1 writes them UTF-8 encoded")
+	rootCmd.AddCommand(translateCmd)
+}
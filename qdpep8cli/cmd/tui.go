@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lbajolet/qdpep8/cpu"
+	"github.com/lbajolet/qdpep8/tui"
+	"github.com/spf13/cobra"
+)
+
+// tuiCmd runs a program in the full-screen debugger
+var tuiCmd = &cobra.Command{
+	Use:   "tui program.pepo",
+	Short: "Debug a program in a full-screen terminal UI",
+	Long: `Debug a program in a full-screen terminal UI.
+
+The screen shows the disassembly around PC, the registers, the memory,
+the stack around SP, and the output of the program. When no input file
+is given, the program's input is typed in the terminal when it needs it.
+
+If a listing (.pepl) is found next to the program, or given with
+--listing, it is shown in place of the disassembly.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runTui,
+}
+
+var tuiInputFile *string
+var tuiListing *string
+var tuiSimMode *bool
+
+func runTui(cmd *cobra.Command, args []string) error {
+	prgm, err := cpu.ReadObjectFile(args[0])
+	if err != nil {
+		return fmt.Errorf("load error: %s", err)
+	}
+
+	opts := tui.Options{
+		Name:           filepath.Base(args[0]),
+		NoEOFChariStop: *tuiSimMode,
+	}
+
+	if *tuiInputFile != "" {
+		opts.Input, err = os.ReadFile(*tuiInputFile)
+		if err != nil {
+			return fmt.Errorf("input file error: %s", err)
+		}
+	}
+
+	opts.Listing, err = loadListing(args[0], *tuiListing)
+	if err != nil {
+		return err
+	}
+
+	return tui.New(prgm, opts).Run()
+}
+
+func init() {
+	tuiInputFile = tuiCmd.Flags().StringP("input", "i", "", "path to the input file for stdin, the terminal is used otherwise")
+	tuiListing = tuiCmd.Flags().StringP("listing", "l", "", "path to the assembler listing of the program")
+	tuiSimMode = tuiCmd.Flags().BoolP("eof", "e", false, "run as in simulator mode, i.e. on EOF return some \\x00 rather than immediately stopping")
+	rootCmd.AddCommand(tuiCmd)
+}
@@ -0,0 +1,286 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Width of the right column, with the registers and stack panes
+const rightWidth = 30
+
+// Height of the registers pane, borders included
+const regsHeight = 11
+
+const (
+	minWidth  = 72
+	minHeight = 20
+)
+
+const help = "s:step n:next o:out c:cont p:pause b:break up/down:cursor pgup/pgdn:mem g:goto r:restart q:quit"
+
+// layout is the position of every pane for the current terminal size
+type layout struct {
+	w, h               int
+	leftW              int
+	disasmY, disasmH   int
+	memY, memH         int
+	consoleY, consoleH int
+	regsY, regsH       int
+	stackY, stackH     int
+}
+
+func (dbg *Debugger) layout() layout {
+	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		w, h = 80, 24
+	}
+
+	lay := layout{w: w, h: h, leftW: w - rightWidth}
+	body := h - 2
+
+	lay.disasmY = 1
+	lay.disasmH = body * 2 / 5
+	lay.memY = lay.disasmY + lay.disasmH
+	lay.memH = body * 3 / 10
+	lay.consoleY = lay.memY + lay.memH
+	lay.consoleH = body - lay.disasmH - lay.memH
+
+	lay.regsY = 1
+	lay.regsH = regsHeight
+	lay.stackY = lay.regsY + lay.regsH
+	lay.stackH = body - lay.regsH
+
+	return lay
+}
+
+// memWidth is the number of bytes per row of the memory pane
+func (dbg *Debugger) memWidth() int {
+	if dbg.layout().leftW >= 4+16*3+3+16+4 {
+		return 16
+	}
+	return 8
+}
+
+// memRows is the number of rows shown in the memory pane
+func (dbg *Debugger) memRows() int {
+	return dbg.layout().memH - 2
+}
+
+func (dbg *Debugger) draw() {
+	lay := dbg.layout()
+	sc := dbg.scr
+	sc.resize(lay.w, lay.h)
+	sc.clear()
+
+	if lay.w < minWidth || lay.h < minHeight {
+		sc.put(0, 0, lay.w, fmt.Sprintf("terminal too small, need at least %dx%d", minWidth, minHeight), attrBold)
+		sc.flush()
+		return
+	}
+
+	dbg.drawTitle(lay)
+	dbg.drawDisasm(lay)
+	dbg.drawMemory(lay)
+	dbg.drawConsole(lay)
+	dbg.drawRegisters(lay)
+	dbg.drawStack(lay)
+	dbg.drawFooter(lay)
+
+	sc.flush()
+}
+
+func (dbg *Debugger) drawTitle(lay layout) {
+	title := fmt.Sprintf(" qdpep8 | %s | %s", dbg.opts.Name, dbg.status)
+	dbg.scr.put(0, 0, lay.w, title, attrReverse)
+	dbg.scr.fill(0, 0, lay.w, attrReverse)
+}
+
+func (dbg *Debugger) drawFooter(lay layout) {
+	if dbg.prompt != "" {
+		dbg.scr.put(0, lay.h-1, lay.w, dbg.prompt+string(dbg.line)+"_", attrBold)
+		return
+	}
+	dbg.scr.put(0, lay.h-1, lay.w, help, attrNormal)
+}
+
+// drawDisasm shows the listing around the cursor, or decodes memory from
+// the cursor if it is not in the listing
+func (dbg *Debugger) drawDisasm(lay layout) {
+	sc := dbg.scr
+	sc.box(0, lay.disasmY, lay.leftW, lay.disasmH, "Disassembly")
+
+	rows := lay.disasmH - 2
+	width := lay.leftW - 4
+	pc := dbg.cpu.PC
+
+	type row struct {
+		addr  uint16
+		isIns bool
+		text  string
+	}
+	var lines []row
+
+	if num, ok := dbg.lst.LineAt(dbg.cursor); ok {
+		first := num - 1 - rows/3
+		if first < 0 {
+			first = 0
+		}
+		for idx := first; idx < len(dbg.lst.Lines) && len(lines) < rows; idx++ {
+			ll := dbg.lst.Lines[idx]
+			lines = append(lines, row{ll.Addr, ll.IsInstruction(), ll.Text})
+		}
+	} else {
+		addr := dbg.cursor
+		for len(lines) < rows {
+			ins := dbg.cpu.Decode(addr)
+			lines = append(lines, row{addr, true, fmt.Sprintf("%04X  %s", addr, ins)})
+			addr = ins.Next()
+		}
+	}
+
+	for idx, ln := range lines {
+		y := lay.disasmY + 1 + idx
+		gutter := "  "
+		a := attrNormal
+		if ln.isIns {
+			if dbg.breakpoints[ln.addr] {
+				gutter = "*" + gutter[1:]
+			}
+			if ln.addr == pc {
+				gutter = gutter[:1] + ">"
+				a = attrReverse
+			} else if ln.addr == dbg.cursor {
+				a = attrBold
+			}
+		}
+		sc.put(1, y, 2, gutter, attrBold)
+		sc.put(3, y, width, ln.text, a)
+		if a == attrReverse {
+			sc.fill(3, y, width, a)
+		}
+	}
+}
+
+// drawMemory shows memory as hex and ASCII, as in the Pep/8 memory pane,
+// bytes modified by the last command are highlighted
+func (dbg *Debugger) drawMemory(lay layout) {
+	sc := dbg.scr
+	sc.box(0, lay.memY, lay.leftW, lay.memH, "Memory")
+
+	ram := dbg.cpu.RAM
+	bpr := dbg.memWidth()
+	addr := dbg.memAddr
+	for row := 0; row < lay.memH-2; row++ {
+		y := lay.memY + 1 + row
+		sc.put(2, y, 7, fmt.Sprintf("%04X |", addr), attrNormal)
+		ascii := 9 + bpr*3 + 1
+		sc.put(ascii-1, y, 1, "|", attrNormal)
+		for col := 0; col < bpr; col++ {
+			a := attrNormal
+			if ram[addr] != dbg.prevRAM[addr] {
+				a = attrReverse
+			}
+			sc.put(9+col*3, y, 2, fmt.Sprintf("%02X", ram[addr]), a)
+			chr := "."
+			if ram[addr] >= ' ' && ram[addr] < 0x7f {
+				chr = string(rune(ram[addr]))
+			}
+			sc.put(ascii+col, y, 1, chr, a)
+			addr++
+		}
+	}
+}
+
+// drawConsole shows the end of the program's output
+func (dbg *Debugger) drawConsole(lay layout) {
+	sc := dbg.scr
+	sc.box(0, lay.consoleY, lay.leftW, lay.consoleH, "Console")
+
+	width := lay.leftW - 4
+	var lines []string
+	cur := strings.Builder{}
+	for _, b := range dbg.console {
+		if b == '\n' || cur.Len() >= width {
+			lines = append(lines, cur.String())
+			cur.Reset()
+			if b == '\n' {
+				continue
+			}
+		}
+		// Output is shown as Latin-1, as does the Pep/8 simulator
+		cur.WriteRune(rune(b))
+	}
+	lines = append(lines, cur.String())
+
+	rows := lay.consoleH - 2
+	if len(lines) > rows {
+		lines = lines[len(lines)-rows:]
+	}
+	for idx, ln := range lines {
+		sc.put(2, lay.consoleY+1+idx, width, ln, attrNormal)
+	}
+}
+
+func (dbg *Debugger) drawRegisters(lay layout) {
+	sc := dbg.scr
+	x := lay.leftW
+	sc.box(x, lay.regsY, rightWidth, lay.regsH, "Registers")
+
+	c := dbg.cpu
+	ins := c.Decode(c.PC)
+	ir := fmt.Sprintf("%02X", ins.Opcode)
+	if ins.HasSpec {
+		ir += fmt.Sprintf("%04X", ins.Spec)
+	}
+	lines := []string{
+		fmt.Sprintf("A   %04X  %6d", c.A, int16(c.A)),
+		fmt.Sprintf("X   %04X  %6d", c.X, int16(c.X)),
+		fmt.Sprintf("SP  %04X", c.SP),
+		fmt.Sprintf("PC  %04X", c.PC),
+		fmt.Sprintf("N %d  Z %d  V %d  C %d", bit(c.N), bit(c.Z), bit(c.V), bit(c.C)),
+		fmt.Sprintf("IR  %s", ir),
+		fmt.Sprintf("    %s", ins),
+		"",
+		fmt.Sprintf("Steps %d", dbg.steps),
+	}
+	for idx, ln := range lines {
+		sc.put(x+2, lay.regsY+1+idx, rightWidth-4, ln, attrNormal)
+	}
+}
+
+// drawStack shows the words around SP, from two words above SP down to the
+// bottom of the stack
+func (dbg *Debugger) drawStack(lay layout) {
+	sc := dbg.scr
+	x := lay.leftW
+	sc.box(x, lay.stackY, rightWidth, lay.stackH, "Stack")
+
+	sp := dbg.cpu.SP
+	addr := int(sp) - 4
+	for row := 0; row < lay.stackH-2 && addr < 0xFFFF; row, addr = row+1, addr+2 {
+		if addr < 0 {
+			continue
+		}
+		word := uint16(dbg.cpu.RAM[addr])<<8 | uint16(dbg.cpu.RAM[addr+1])
+		marker := "   "
+		a := attrNormal
+		if uint16(addr) == sp {
+			marker = "SP>"
+			a = attrBold
+		}
+		if dbg.cpu.RAM[addr] != dbg.prevRAM[addr] || dbg.cpu.RAM[addr+1] != dbg.prevRAM[addr+1] {
+			a = attrReverse
+		}
+		sc.put(x+2, lay.stackY+1+row, rightWidth-4, fmt.Sprintf("%s %04X  %04X %6d", marker, addr, word, int16(word)), a)
+	}
+}
+
+func bit(flg bool) int {
+	if flg {
+		return 1
+	}
+	return 0
+}
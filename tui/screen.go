@@ -0,0 +1,201 @@
+package tui
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+type attr uint8
+
+const (
+	attrNormal attr = iota
+	attrBold
+	attrReverse
+)
+
+func (a attr) escape() string {
+	switch a {
+	case attrBold:
+		return "\x1b[0;1m"
+	case attrReverse:
+		return "\x1b[0;7m"
+	}
+	return "\x1b[0m"
+}
+
+// screen is a grid of cells, drawn off-screen then flushed to the terminal
+// in one go to avoid flickering
+type screen struct {
+	w, h  int
+	cells [][]rune
+	attrs [][]attr
+	out   *bufio.Writer
+}
+
+func newScreen(out io.Writer) *screen {
+	return &screen{out: bufio.NewWriter(out)}
+}
+
+func (sc *screen) resize(w, h int) {
+	if w == sc.w && h == sc.h {
+		return
+	}
+	sc.w, sc.h = w, h
+	sc.cells = make([][]rune, h)
+	sc.attrs = make([][]attr, h)
+	for y := range sc.cells {
+		sc.cells[y] = make([]rune, w)
+		sc.attrs[y] = make([]attr, w)
+	}
+}
+
+func (sc *screen) clear() {
+	for y := range sc.cells {
+		for x := range sc.cells[y] {
+			sc.cells[y][x] = ' '
+			sc.attrs[y][x] = attrNormal
+		}
+	}
+}
+
+// put writes s at x, y, clipped to at most w cells
+func (sc *screen) put(x, y, w int, s string, a attr) {
+	if y < 0 || y >= sc.h {
+		return
+	}
+	for _, r := range s {
+		if w <= 0 || x >= sc.w {
+			return
+		}
+		if x >= 0 {
+			if r < ' ' || r == 0x7f {
+				r = '.'
+			}
+			sc.cells[y][x] = r
+			sc.attrs[y][x] = a
+		}
+		x++
+		w--
+	}
+}
+
+// fill sets the attribute of w cells from x, y
+func (sc *screen) fill(x, y, w int, a attr) {
+	if y < 0 || y >= sc.h {
+		return
+	}
+	for ; w > 0 && x < sc.w; x, w = x+1, w-1 {
+		if x >= 0 {
+			sc.attrs[y][x] = a
+		}
+	}
+}
+
+// box draws the borders of a pane, with its title on the top border
+func (sc *screen) box(x, y, w, h int, title string) {
+	if w < 2 || h < 2 {
+		return
+	}
+	hline := "+" + strings.Repeat("-", w-2) + "+"
+	sc.put(x, y, w, hline, attrNormal)
+	sc.put(x, y+h-1, w, hline, attrNormal)
+	for row := y + 1; row < y+h-1; row++ {
+		sc.put(x, row, 1, "|", attrNormal)
+		sc.put(x+w-1, row, 1, "|", attrNormal)
+	}
+	if title != "" {
+		sc.put(x+2, y, w-4, " "+title+" ", attrBold)
+	}
+}
+
+func (sc *screen) flush() error {
+	sc.out.WriteString("\x1b[H")
+	for y := range sc.cells {
+		cur := attrNormal
+		sc.out.WriteString(cur.escape())
+		for x, r := range sc.cells[y] {
+			if a := sc.attrs[y][x]; a != cur {
+				cur = a
+				sc.out.WriteString(cur.escape())
+			}
+			sc.out.WriteRune(r)
+		}
+		if y < len(sc.cells)-1 {
+			sc.out.WriteString("\r\n")
+		}
+	}
+	sc.out.WriteString(attrNormal.escape())
+	return sc.out.Flush()
+}
+
+// readKeys decodes the keys pressed on the terminal, and sends them on
+// keys until r fails
+//
+// Printable characters are sent as-is, others by name, e.g. "up" or "ctrl-c"
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+
+	buf := make([]byte, 64)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, k := range parseKeys(buf[:n]) {
+			keys <- k
+		}
+	}
+}
+
+var escapes = map[string]string{
+	"\x1b[A":  "up",
+	"\x1b[B":  "down",
+	"\x1b[C":  "right",
+	"\x1b[D":  "left",
+	"\x1bOA":  "up",
+	"\x1bOB":  "down",
+	"\x1bOC":  "right",
+	"\x1bOD":  "left",
+	"\x1b[5~": "pgup",
+	"\x1b[6~": "pgdn",
+	"\x1b[H":  "home",
+	"\x1b[F":  "end",
+}
+
+func parseKeys(buf []byte) []string {
+	keys := []string{}
+	for len(buf) > 0 {
+		if buf[0] == 0x1b {
+			found := false
+			for seq, name := range escapes {
+				if strings.HasPrefix(string(buf), seq) {
+					keys = append(keys, name)
+					buf = buf[len(seq):]
+					found = true
+					break
+				}
+			}
+			if !found {
+				keys = append(keys, "esc")
+				buf = buf[1:]
+			}
+			continue
+		}
+
+		switch c := buf[0]; c {
+		case '\r', '\n':
+			keys = append(keys, "enter")
+		case 0x7f, 0x08:
+			keys = append(keys, "backspace")
+		case 0x03:
+			keys = append(keys, "ctrl-c")
+		case 0x04:
+			keys = append(keys, "ctrl-d")
+		default:
+			keys = append(keys, string([]byte{c}))
+		}
+		buf = buf[1:]
+	}
+	return keys
+}
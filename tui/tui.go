@@ -0,0 +1,410 @@
+// Package tui implements a full-screen terminal debugger for Pep/8 programs
+package tui
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbajolet/qdpep8/cpu"
+	"golang.org/x/term"
+)
+
+// Number of cycles executed between two checks for a key press while running
+const runBatch = 1000
+
+// Minimum delay between two redraws while running
+const redrawDelay = 50 * time.Millisecond
+
+type state int
+
+const (
+	stopped state = iota
+	running
+	halted
+)
+
+type stepMode int
+
+const (
+	stepInto stepMode = iota
+	stepOver
+	stepOut
+	stepContinue
+)
+
+// Options configures a debugging session
+type Options struct {
+	// Name is the name of the program, shown in the title bar
+	Name string
+	// Listing is the assembler listing of the program, if nil the
+	// program is disassembled
+	Listing *cpu.Listing
+	// Input is fed to the program, if nil the program reads from the console pane
+	Input []byte
+	// NoEOFChariStop is passed to the cpu, see Pep8CPU.NoEOFChariStop
+	NoEOFChariStop bool
+}
+
+// Debugger is a full-screen debugger for one program
+type Debugger struct {
+	opts Options
+	prog []byte
+	lst  *cpu.Listing
+	cpu  *cpu.Pep8CPU
+	// calls tracks the subroutine calls of the program
+	calls *cpu.CallStack
+	// badReturn is set by a mismatched RET, which stops the execution
+	badReturn *cpu.BadReturn
+
+	scr  *screen
+	keys chan string
+
+	state       state
+	status      string
+	steps       uint64
+	breakpoints map[uint16]bool
+	// cursor is the address of the selected instruction in the disassembly
+	cursor uint16
+	// memAddr is the first address shown in the memory pane
+	memAddr uint16
+	// prevRAM is the memory before the last command, changes are highlighted
+	prevRAM []byte
+
+	// console is everything the program wrote, and the input typed for it
+	console []byte
+	// pending is the input typed in the console, not yet read by the program
+	pending []byte
+	// prompt and line are the line being edited in the footer, if any
+	prompt string
+	line   []byte
+}
+
+// New creates a debugger for the program prog
+func New(prog []byte, opts Options) *Debugger {
+	dbg := &Debugger{
+		opts:        opts,
+		prog:        prog,
+		lst:         opts.Listing,
+		breakpoints: map[uint16]bool{},
+		prevRAM:     make([]byte, 65536),
+	}
+	if dbg.lst == nil {
+		tmp := cpu.NewPep8Cpu()
+		tmp.Load(prog)
+		dbg.lst = tmp.Disassemble(0, len(prog))
+	}
+	dbg.reset()
+	return dbg
+}
+
+// reset reloads the program, as if it was never run
+func (dbg *Debugger) reset() {
+	dbg.cpu = cpu.NewPep8Cpu()
+	dbg.cpu.Load(dbg.prog)
+	dbg.cpu.NoEOFChariStop = dbg.opts.NoEOFChariStop
+	dbg.cpu.Out = consoleWriter{dbg}
+	// The console shows text, the output must be valid UTF-8
+	dbg.cpu.Encoding = cpu.EncodingLatin1
+	dbg.cpu.In = consoleReader{dbg}
+	if dbg.opts.Input != nil {
+		dbg.cpu.In = bytes.NewReader(dbg.opts.Input)
+	}
+	dbg.calls = &cpu.CallStack{
+		Symbols: dbg.lst,
+		OnBadReturn: func(br cpu.BadReturn) {
+			dbg.badReturn = &br
+		},
+	}
+	dbg.cpu.Observers = append(dbg.cpu.Observers, dbg.calls)
+	copy(dbg.prevRAM, dbg.cpu.RAM)
+
+	dbg.state = stopped
+	dbg.status = "ready"
+	dbg.steps = 0
+	dbg.cursor = dbg.cpu.PC
+	dbg.console = nil
+	dbg.pending = nil
+}
+
+// Run takes over the terminal until the user quits
+func (dbg *Debugger) Run() error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("the debugger needs a terminal")
+	}
+
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, old)
+
+	// Alternate screen, without cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan string, 64)
+	go readKeys(os.Stdin, keys)
+	dbg.serve(os.Stdout, keys)
+	return nil
+}
+
+// serve draws the debugger on out, and runs the commands bound to the keys
+// until the user quits or keys is closed, it needs no terminal
+func (dbg *Debugger) serve(out io.Writer, keys chan string) {
+	dbg.scr = newScreen(out)
+	dbg.keys = keys
+	for {
+		dbg.draw()
+		key, ok := <-dbg.keys
+		if !ok || !dbg.handle(key) {
+			return
+		}
+	}
+}
+
+// handle runs the command bound to key, returns false to quit
+func (dbg *Debugger) handle(key string) bool {
+	switch key {
+	case "q", "ctrl-c":
+		return false
+	case "s", "enter":
+		dbg.exec(stepInto)
+	case "n":
+		dbg.exec(stepOver)
+	case "o":
+		dbg.exec(stepOut)
+	case "c":
+		dbg.exec(stepContinue)
+	case "b":
+		dbg.breakpoints[dbg.cursor] = !dbg.breakpoints[dbg.cursor]
+		if !dbg.breakpoints[dbg.cursor] {
+			delete(dbg.breakpoints, dbg.cursor)
+		}
+	case "up":
+		dbg.cursor = dbg.prevInstruction(dbg.cursor)
+	case "down":
+		dbg.cursor = dbg.cpu.Decode(dbg.cursor).Next()
+	case "pgup":
+		dbg.memAddr -= uint16(dbg.memRows() * dbg.memWidth())
+	case "pgdn":
+		dbg.memAddr += uint16(dbg.memRows() * dbg.memWidth())
+	case "g":
+		dbg.gotoAddr()
+	case "r":
+		dbg.reset()
+	}
+	return true
+}
+
+// exec runs the program according to mode, until the step is done, a
+// breakpoint is reached, the program stops, or the user pauses it
+func (dbg *Debugger) exec(mode stepMode) {
+	if dbg.state == halted {
+		dbg.status = "program halted, press r to restart"
+		return
+	}
+
+	copy(dbg.prevRAM, dbg.cpu.RAM)
+	dbg.state = running
+	dbg.status = "running"
+
+	sp := dbg.cpu.SP
+	var retAddr uint16
+	lastDraw := time.Now()
+	for n := 0; ; n++ {
+		if n > 0 && dbg.breakpoints[dbg.cpu.PC] {
+			dbg.status = fmt.Sprintf("breakpoint at %04x", dbg.cpu.PC)
+			break
+		}
+
+		ins := dbg.cpu.Decode(dbg.cpu.PC)
+		if n == 0 && mode == stepOver {
+			if ins.BaseOp != "CALL" {
+				mode = stepInto
+			}
+			retAddr = ins.Next()
+		}
+
+		if !dbg.step() {
+			break
+		}
+		if dbg.badReturn != nil {
+			dbg.status = "warning: " + dbg.badReturn.String()
+			dbg.badReturn = nil
+			break
+		}
+
+		done := false
+		switch mode {
+		case stepInto:
+			done = true
+		case stepOver:
+			done = dbg.cpu.PC == retAddr && dbg.cpu.SP >= sp
+		case stepOut:
+			done = ins.BaseOp == "RET" && dbg.cpu.SP > sp
+		}
+		if done {
+			dbg.status = "stopped"
+			break
+		}
+
+		if n%runBatch == runBatch-1 && dbg.interrupted() {
+			dbg.status = "paused"
+			break
+		}
+		if time.Since(lastDraw) > redrawDelay {
+			dbg.draw()
+			lastDraw = time.Now()
+		}
+	}
+
+	if dbg.state == running {
+		dbg.state = stopped
+	}
+	dbg.cursor = dbg.cpu.PC
+}
+
+// step executes one cycle, and returns false when the program halted
+func (dbg *Debugger) step() bool {
+	cont := dbg.cpu.DoNextCycle()
+	if dbg.cpu.Fault == nil {
+		dbg.steps++
+	}
+	if cont {
+		return true
+	}
+
+	dbg.state = halted
+	dbg.status = "halted"
+	if dbg.cpu.Fault != nil {
+		dbg.status = "fault: " + dbg.cpu.Fault.Error()
+		if frames := dbg.calls.Frames; len(frames) > 0 {
+			dbg.status += " in " + dbg.calls.Name(frames[len(frames)-1].Callee)
+		}
+	}
+	return false
+}
+
+// interrupted consumes the keys pressed while running, and reports if the
+// user asked to pause
+func (dbg *Debugger) interrupted() bool {
+	for {
+		select {
+		case key, ok := <-dbg.keys:
+			// The keys are closed once the terminal is gone, nothing pauses
+			if !ok {
+				return false
+			}
+			switch key {
+			case "p", " ", "esc", "q", "ctrl-c":
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
+// prevInstruction is the address of the instruction before addr, as found
+// in the listing, or the byte before if addr is not in the listing
+func (dbg *Debugger) prevInstruction(addr uint16) uint16 {
+	if num, ok := dbg.lst.LineAt(addr); ok {
+		for num--; num > 0; num-- {
+			if ll := dbg.lst.Lines[num-1]; ll.IsInstruction() {
+				return ll.Addr
+			}
+		}
+		return addr
+	}
+	return addr - 1
+}
+
+// gotoAddr asks for an address or a symbol, and shows it in the memory pane
+func (dbg *Debugger) gotoAddr() {
+	text, ok := dbg.readLine("go to address or symbol: ")
+	if !ok || text == "" {
+		return
+	}
+
+	if addr, found := dbg.lst.Symbols[text]; found {
+		dbg.memAddr = addr
+		return
+	}
+	addr, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(text), "0x"), 16, 16)
+	if err != nil {
+		dbg.status = fmt.Sprintf("invalid address %q", text)
+		return
+	}
+	dbg.memAddr = uint16(addr)
+}
+
+// readLine edits a line in the footer, returns false if cancelled
+func (dbg *Debugger) readLine(prompt string) (string, bool) {
+	dbg.prompt = prompt
+	dbg.line = dbg.line[:0]
+	defer func() { dbg.prompt = "" }()
+
+	for {
+		dbg.draw()
+		key, ok := <-dbg.keys
+		if !ok {
+			return "", false
+		}
+
+		switch key {
+		case "enter":
+			return string(dbg.line), true
+		case "esc", "ctrl-c", "ctrl-d":
+			return "", false
+		case "backspace":
+			if len(dbg.line) > 0 {
+				dbg.line = dbg.line[:len(dbg.line)-1]
+			}
+		default:
+			if len(key) == 1 {
+				dbg.line = append(dbg.line, key[0])
+			}
+		}
+	}
+}
+
+// consoleWriter appends the output of the program to the console pane
+type consoleWriter struct {
+	dbg *Debugger
+}
+
+func (cw consoleWriter) Write(p []byte) (int, error) {
+	cw.dbg.console = append(cw.dbg.console, p...)
+	return len(p), nil
+}
+
+// consoleReader asks for a line of input in the console when the program
+// needs more than has been typed
+type consoleReader struct {
+	dbg *Debugger
+}
+
+func (cr consoleReader) Read(p []byte) (int, error) {
+	dbg := cr.dbg
+	if len(dbg.pending) == 0 {
+		status := dbg.status
+		dbg.status = "waiting for input, ctrl-d for EOF"
+		line, ok := dbg.readLine("input: ")
+		dbg.status = status
+		if !ok {
+			return 0, io.EOF
+		}
+		dbg.pending = append([]byte(line), '\n')
+		dbg.console = append(dbg.console, dbg.pending...)
+	}
+
+	n := copy(p, dbg.pending)
+	dbg.pending = dbg.pending[n:]
+	return n, nil
+}
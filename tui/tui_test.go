@@ -0,0 +1,154 @@
+package tui
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// addProgram adds 3 and 4 in A
+var addProgram = []byte{
+	0xC0, 0x00, 0x03, // LDA 3,i
+	0x70, 0x00, 0x04, // ADDA 4,i
+	0x00, // STOP
+}
+
+// callProgram calls sub, then prints A
+var callProgram = []byte{
+	0x16, 0x00, 0x07, // CALL sub,i
+	0x50, 0x00, 0x41, // CHARO 'A',i
+	0x00,             // STOP
+	0xC0, 0x00, 0x01, // sub: LDA 1,i
+	0x58, // RET0
+}
+
+// echoProgram reads a character, and prints it back
+var echoProgram = []byte{
+	0x49, 0x00, 0x20, // CHARI 0x0020,d
+	0x51, 0x00, 0x20, // CHARO 0x0020,d
+	0x00, // STOP
+}
+
+// press runs the debugger on the keys, without a terminal, and returns what
+// it drew
+func press(dbg *Debugger, keys ...string) string {
+	ch := make(chan string, len(keys))
+	for _, key := range keys {
+		ch <- key
+	}
+	close(ch)
+	out := &bytes.Buffer{}
+	dbg.serve(out, ch)
+	return out.String()
+}
+
+func TestStep(t *testing.T) {
+	dbg := New(addProgram, Options{Name: "add"})
+	for _, tc := range []struct {
+		key    string
+		pc     uint16
+		a      uint16
+		steps  uint64
+		status string
+	}{
+		{"s", 0x0003, 3, 1, "stopped"},
+		{"enter", 0x0006, 7, 2, "stopped"},
+		{"s", 0x0007, 7, 3, "halted"},
+		{"s", 0x0007, 7, 3, "program halted, press r to restart"},
+		{"r", 0x0000, 0, 0, "ready"},
+	} {
+		press(dbg, tc.key)
+		if dbg.cpu.PC != tc.pc || dbg.cpu.A != tc.a || dbg.steps != tc.steps || dbg.status != tc.status {
+			t.Errorf("after %s: PC %04x A %d, %d steps, %q, want PC %04x A %d, %d steps, %q",
+				tc.key, dbg.cpu.PC, dbg.cpu.A, dbg.steps, dbg.status, tc.pc, tc.a, tc.steps, tc.status)
+		}
+	}
+
+	// The title shows the program and its status
+	if screen := press(dbg, "s"); !strings.Contains(screen, " qdpep8 | add | stopped") {
+		t.Errorf("no title in the screen:\n%q", screen)
+	}
+}
+
+func TestStepCalls(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		keys  []string
+		pc    uint16
+		steps uint64
+	}{
+		// next runs the subroutine to its return
+		{"next", []string{"n"}, 0x0003, 3},
+		{"into", []string{"s"}, 0x0007, 1},
+		{"out", []string{"s", "o"}, 0x0003, 3},
+		// out of the main program runs it to its end
+		{"out of main", []string{"o"}, 0x0007, 5},
+	} {
+		dbg := New(callProgram, Options{})
+		press(dbg, tc.keys...)
+		if dbg.cpu.PC != tc.pc || dbg.steps != tc.steps {
+			t.Errorf("%s: PC %04x after %d steps, want %04x after %d", tc.name, dbg.cpu.PC, dbg.steps, tc.pc, tc.steps)
+		}
+		if dbg.cursor != dbg.cpu.PC {
+			t.Errorf("%s: cursor %04x, not on PC", tc.name, dbg.cursor)
+		}
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	dbg := New(callProgram, Options{})
+
+	// The cursor moves to the CHARO, where the breakpoint is set
+	press(dbg, "down", "b")
+	if !dbg.breakpoints[0x0003] || len(dbg.breakpoints) != 1 {
+		t.Fatalf("breakpoints %v, want 0003", dbg.breakpoints)
+	}
+	press(dbg, "c")
+	if dbg.cpu.PC != 0x0003 || dbg.status != "breakpoint at 0003" || dbg.state != stopped {
+		t.Errorf("continued to %04x, %q, want the breakpoint at 0003", dbg.cpu.PC, dbg.status)
+	}
+	// Continuing from a breakpoint leaves it
+	press(dbg, "c")
+	if dbg.state != halted || string(dbg.console) != "A" {
+		t.Errorf("state %d, console %q, want halted after A", dbg.state, dbg.console)
+	}
+
+	// The breakpoints are kept on restart, b on one removes it
+	press(dbg, "r", "down", "b", "c")
+	if len(dbg.breakpoints) != 0 || dbg.state != halted {
+		t.Errorf("breakpoints %v, state %d, want none and halted", dbg.breakpoints, dbg.state)
+	}
+}
+
+func TestConsoleInput(t *testing.T) {
+	// The line typed in the console is fed to the program, and echoed
+	dbg := New(echoProgram, Options{})
+	press(dbg, "c", "x", "y", "backspace", "z", "enter")
+	if string(dbg.console) != "xz\nx" || dbg.status != "halted" {
+		t.Errorf("console %q, %q, want \"xz\\nx\", halted", dbg.console, dbg.status)
+	}
+	if string(dbg.pending) != "z\n" {
+		t.Errorf("pending input %q, want \"z\\n\"", dbg.pending)
+	}
+
+	// ctrl-d ends the input, CHARI then faults
+	press(dbg, "r", "c", "ctrl-d")
+	if dbg.state != halted || !strings.HasPrefix(dbg.status, "fault: ") {
+		t.Errorf("state %d, %q, want a fault", dbg.state, dbg.status)
+	}
+
+	// The input of the options is read rather than the console
+	dbg = New(echoProgram, Options{Input: []byte("q")})
+	press(dbg, "c")
+	if string(dbg.console) != "q" {
+		t.Errorf("console %q, want q", dbg.console)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("s\r\x1b[A\x1bOB\x1b[5~\x7f\x03\x04\x1bq"))
+	want := []string{"s", "enter", "up", "down", "pgup", "backspace", "ctrl-c", "ctrl-d", "esc", "q"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("keys %q, want %q", got, want)
+	}
+}